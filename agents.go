@@ -0,0 +1,752 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// MAXATTEMPTS - a job is requeued when its agent disappears, at most this many times
+	MAXATTEMPTS int = 3
+	// AGENTWAIT - how long a job waits for an agent matching its runsOn labels
+	AGENTWAIT time.Duration = 10 * time.Minute
+)
+
+// AgentMessage - the json messages of the agent protocol (one websocket per agent)
+// agent to server : register, heartbeat, log, result - server to agent : registered, job, cancel
+type AgentMessage struct {
+	Type      string            `json:"type"`
+	Name      string            `json:"name,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Heartbeat int               `json:"heartbeat,omitempty"`
+	Lease     string            `json:"lease,omitempty"`
+	Job       *AgentJob         `json:"job,omitempty"`
+	Data      string            `json:"data,omitempty"`
+	Result    *JobResult        `json:"result,omitempty"`
+}
+
+// AgentJob - a stage to run on an agent, the agent checks out Commit of Scm itself with the repository's
+// Credential (fetching Refs first and merging Merge for pull requests) and runs the commands in Dir.
+// Restore and CacheData (the cache tarball, none on a miss) are put in the workspace before the commands run
+type AgentJob struct {
+	Run      string         `json:"run"`
+	Stage    int            `json:"stage"`
+	Name     string         `json:"name"`
+	Scm      string         `json:"scm,omitempty"`
+	Refs     []string       `json:"refs,omitempty"`
+	Commit   string         `json:"commit,omitempty"`
+	Merge    string         `json:"merge,omitempty"`
+	Dir      string         `json:"dir,omitempty"`
+	Checkout CheckoutDetail `json:"checkout"`
+	Exec     string         `json:"exec"`
+	Commands []string       `json:"commands"`
+	Env      []string       `json:"env,omitempty"`
+	Image    string         `json:"image,omitempty"`
+	Limits   *LimitsDetail  `json:"limits,omitempty"`
+	Sandbox  bool           `json:"sandbox,omitempty"`
+	// the credential of the repository only, never logged or stored by the agent
+	Credential *CredentialDetail `json:"credential,omitempty"`
+	Restore    []AgentFile       `json:"restore,omitempty"`
+	Artifacts  []string          `json:"artifacts,omitempty"`
+	Cache      *CacheDetail      `json:"cache,omitempty"`
+	CacheData  []byte            `json:"cacheData,omitempty"`
+}
+
+// AgentFile - an artifact sent with a job or its result, Name is relative to the job's directory
+type AgentFile struct {
+	Name string `json:"name"`
+	Data []byte `json:"data"`
+}
+
+// JobResult - Output is the stdout of the stage (stderr when it failed), Error is empty on success.
+// Artifacts are the files matching the job's artifacts and Cache the tarball of the cache paths (after a miss)
+type JobResult struct {
+	Agent     string            `json:"agent"`
+	Output    string            `json:"output"`
+	Error     string            `json:"error,omitempty"`
+	Outputs   map[string]string `json:"outputs,omitempty"`
+	Artifacts []AgentFile       `json:"artifacts,omitempty"`
+	Cache     []byte            `json:"cache,omitempty"`
+}
+
+// AgentDetail - a connected agent as listed by the api
+type AgentDetail struct {
+	Id     string            `json:"id"`
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels"`
+	Lease  string            `json:"lease,omitempty"`
+	Seen   int64             `json:"seen"`
+}
+
+// jobSource - where the agents check out the run from
+type jobSource struct {
+	Scm         string
+	Credentials string
+	Refs        []string
+	Commit      string
+	Merge       string
+	Dir         string
+	Checkout    CheckoutDetail
+}
+
+type agentConn struct {
+	id     string
+	name   string
+	labels map[string]string
+	conn   *websocket.Conn
+	wmu    sync.Mutex
+	lease  string
+	seen   time.Time
+}
+
+type agentLease struct {
+	id       string
+	agent    string
+	job      AgentJob
+	selector map[string]string
+	attempts int
+	// when the lease was (re)queued, AGENTWAIT counts from there
+	queued time.Time
+	result chan JobResult
+	log    func(string)
+}
+
+// Coordinator - hands the jobs out to the connected agents as leases, the lease of an agent
+// that stops sending heartbeats (or disconnects) goes back to the front of the queue
+type Coordinator struct {
+	mu      sync.Mutex
+	agents  map[string]*agentConn
+	leases  map[string]*agentLease
+	pending []*agentLease
+	ttl     time.Duration
+	seq     int
+	reaper  sync.Once
+}
+
+var coordinator = newCoordinator(agentTtl())
+
+// agentTtl - AGENT_LEASE_TTL (seconds, default 30), agents send heartbeats three times per ttl
+func agentTtl() time.Duration {
+	if n, err := strconv.Atoi(os.Getenv("AGENT_LEASE_TTL")); err == nil && n > 0 {
+		return time.Duration(n) * time.Second
+	}
+	return 30 * time.Second
+}
+
+func newCoordinator(ttl time.Duration) *Coordinator {
+	return &Coordinator{agents: map[string]*agentConn{}, leases: map[string]*agentLease{}, ttl: ttl}
+}
+
+func (a *agentConn) send(msg AgentMessage) error {
+	a.wmu.Lock()
+	defer a.wmu.Unlock()
+	a.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return a.conn.WriteJSON(msg)
+}
+
+// matchLabels - every key=value of the selector is a label of the agent
+func matchLabels(labels map[string]string, selector map[string]string) bool {
+	for k, v := range selector {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Dispatch - runs the job on an agent matching the selector, log receives the streamed output
+func (c *Coordinator) Dispatch(ctx context.Context, job AgentJob, selector map[string]string, log func(string), logger *Logger) (JobResult, error) {
+	c.mu.Lock()
+	c.seq++
+	l := &agentLease{id: job.Run + "-" + strconv.Itoa(job.Stage) + "-" + strconv.Itoa(c.seq), job: job, selector: selector, queued: time.Now(), result: make(chan JobResult, 1), log: log}
+	c.leases[l.id] = l
+	c.pending = append(c.pending, l)
+	c.schedule(logger)
+	c.mu.Unlock()
+
+	wait := time.NewTimer(AGENTWAIT)
+	defer wait.Stop()
+	for {
+		select {
+		case res := <-l.result:
+			if res.Agent == "" {
+				return res, errors.New(res.Error)
+			}
+			return res, nil
+		case <-wait.C:
+			c.mu.Lock()
+			queued, waited := l.agent == "", time.Since(l.queued)
+			c.mu.Unlock()
+			switch {
+			case queued && waited >= AGENTWAIT:
+				c.cancel(l, logger)
+				return JobResult{}, fmt.Errorf("no agent matching %v", selector)
+			case queued:
+				// requeued after its agent was lost
+				wait.Reset(AGENTWAIT - waited)
+			default:
+				wait.Reset(AGENTWAIT)
+			}
+		case <-ctx.Done():
+			c.cancel(l, logger)
+			return JobResult{}, ctx.Err()
+		}
+	}
+}
+
+// cancel - drops the lease, the agent running it is told to stop
+func (c *Coordinator) cancel(l *agentLease, logger *Logger) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.leases, l.id)
+	c.unqueue(l)
+	if a, ok := c.agents[l.agent]; ok && a.lease == l.id {
+		a.lease = ""
+		a.send(AgentMessage{Type: "cancel", Lease: l.id})
+		c.schedule(logger)
+	}
+}
+
+func (c *Coordinator) unqueue(l *agentLease) {
+	for x, p := range c.pending {
+		if p == l {
+			c.pending = append(c.pending[:x], c.pending[x+1:]...)
+			return
+		}
+	}
+}
+
+// schedule - assigns the queued leases to idle matching agents, in order (c.mu held)
+func (c *Coordinator) schedule(logger *Logger) {
+	ids := make([]string, 0, len(c.agents))
+	for id := range c.agents {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for x := 0; x < len(c.pending); {
+		l := c.pending[x]
+		assigned := false
+		for _, id := range ids {
+			a := c.agents[id]
+			if a.lease != "" || !matchLabels(a.labels, l.selector) {
+				continue
+			}
+			job := l.job
+			if err := a.send(AgentMessage{Type: "job", Lease: l.id, Job: &job}); err != nil {
+				logger.Warn("Agent : send job", "agent", a.id, "error", err)
+				continue
+			}
+			a.lease = l.id
+			l.agent = a.id
+			assigned = true
+			logger.Info("Agent : leased", "agent", a.id, "lease", l.id, "run", l.job.Run, "stage", l.job.Stage)
+			break
+		}
+		if assigned {
+			c.pending = append(c.pending[:x], c.pending[x+1:]...)
+		} else {
+			x++
+		}
+	}
+	agentQueueDepth.Set(float64(len(c.pending)))
+}
+
+// connect - registers the agent and starts the heartbeat reaper (once)
+func (c *Coordinator) connect(conn *websocket.Conn, name string, labels map[string]string, logger *Logger) *agentConn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	a := &agentConn{id: name + "#" + strconv.Itoa(c.seq), name: name, labels: labels, conn: conn, seen: time.Now()}
+	// registered goes out before any job
+	a.send(AgentMessage{Type: "registered", Name: a.id, Heartbeat: int((c.ttl / 3).Milliseconds())})
+	c.agents[a.id] = a
+	agentsConnected.Set(float64(len(c.agents)))
+	c.reaper.Do(func() {
+		go func() {
+			for range time.Tick(c.ttl / 3) {
+				c.reap(logger)
+			}
+		}()
+	})
+	logger.Info("Agent : connected", "agent", a.id, "labels", labels)
+	c.schedule(logger)
+	return a
+}
+
+// serve - reads the messages of the agent until it disconnects
+func (c *Coordinator) serve(a *agentConn, logger *Logger) {
+	for {
+		var msg AgentMessage
+		if err := a.conn.ReadJSON(&msg); err != nil {
+			c.lost(a, err.Error(), logger)
+			return
+		}
+		c.mu.Lock()
+		a.seen = time.Now()
+		l, ok := c.leases[msg.Lease]
+		current := ok && l.agent == a.id
+		switch {
+		case msg.Type == "log" && current && l.log != nil:
+			log := l.log
+			c.mu.Unlock()
+			log(msg.Data)
+			continue
+		case msg.Type == "result" && current && msg.Result != nil:
+			delete(c.leases, l.id)
+			a.lease = ""
+			res := *msg.Result
+			res.Agent = a.id
+			l.result <- res
+			logger.Info("Agent : finished", "agent", a.id, "lease", l.id, "error", res.Error)
+			c.schedule(logger)
+		}
+		c.mu.Unlock()
+	}
+}
+
+// lost - removes the agent, its lease is requeued (or failed after MAXATTEMPTS)
+func (c *Coordinator) lost(a *agentConn, reason string, logger *Logger) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.agents[a.id]; !ok {
+		return
+	}
+	delete(c.agents, a.id)
+	a.conn.Close()
+	agentsConnected.Set(float64(len(c.agents)))
+	logger.Warn("Agent : lost", "agent", a.id, "reason", reason)
+	if l, ok := c.leases[a.lease]; ok && l.agent == a.id {
+		l.agent = ""
+		l.attempts++
+		if l.attempts >= MAXATTEMPTS {
+			delete(c.leases, l.id)
+			l.result <- JobResult{Error: fmt.Sprintf("agent lost %d times, last %s", l.attempts, a.id)}
+		} else {
+			agentRequeues.Inc()
+			logger.Warn("Agent : requeued", "lease", l.id, "attempt", l.attempts+1)
+			l.queued = time.Now()
+			c.pending = append([]*agentLease{l}, c.pending...)
+		}
+	}
+	c.schedule(logger)
+}
+
+// reap - agents without a heartbeat for a whole ttl are lost
+func (c *Coordinator) reap(logger *Logger) {
+	var stale []*agentConn
+	c.mu.Lock()
+	for _, a := range c.agents {
+		if time.Since(a.seen) > c.ttl {
+			stale = append(stale, a)
+		}
+	}
+	c.mu.Unlock()
+	for _, a := range stale {
+		c.lost(a, "heartbeat timeout", logger)
+	}
+}
+
+// Agents - the connected agents
+func (c *Coordinator) Agents() []AgentDetail {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	list := []AgentDetail{}
+	for _, a := range c.agents {
+		list = append(list, AgentDetail{Id: a.id, Name: a.name, Labels: a.labels, Lease: a.lease, Seen: a.seen.Unix()})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+	return list
+}
+
+// AgentConnectHandler - the websocket the agents connect to, the first message registers the agent
+func AgentConnectHandler(w http.ResponseWriter, r *http.Request, logger *Logger) {
+	p := principal(r)
+	if p == nil {
+		var err error
+		if p, err = authenticate(r, authenticators); err != nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	if authorize(p, "", "agent") != nil {
+		logger.Warn("RBAC : denied", "user", p.Name, "action", "agent")
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	upgrader := websocket.Upgrader{ReadBufferSize: 1024, WriteBufferSize: 1024, CheckOrigin: allowedOrigin}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.Error("Agent : upgrade", "error", err)
+		return
+	}
+	var msg AgentMessage
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if err := conn.ReadJSON(&msg); err != nil || msg.Type != "register" || msg.Name == "" {
+		logger.Warn("Agent : registration", "remote", r.RemoteAddr, "error", err)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	a := coordinator.connect(conn, msg.Name, msg.Labels, logger)
+	recordAudit(p, r.RemoteAddr, AuditEntry{Action: "agent.connect", Target: a.id}, nil, msg.Labels, logger)
+	coordinator.serve(a, logger)
+}
+
+// AgentsHandler - the connected agents
+func AgentsHandler(w http.ResponseWriter, r *http.Request, logger *Logger) {
+	addHeaders(w, r)
+	if project, _ := readProject(); !canAny(principal(r), project, "view") {
+		forbidden(w, r, "view", logger)
+		return
+	}
+	agents := coordinator.Agents()
+	response := Response{Name: os.Getenv("NAME"), StatusCode: "200", Status: "OK", Message: fmt.Sprintf("Found %d agents", len(agents)), Payload: []Pipeline{}, Agents: agents}
+	w.WriteHeader(http.StatusOK)
+	b, _ := json.MarshalIndent(response, "", "	")
+	fmt.Fprint(w, string(b))
+}
+
+// AgentExecutor - runs the stage on an agent matching its runsOn labels
+type AgentExecutor struct {
+	run    *Run
+	stage  StageDetail
+	logger *Logger
+}
+
+// Execute - dispatches the stage with the repository's credential, the artifacts to restore and the cache, the
+// agent streams its output to out. Its outputs are written to spec.Output and its artifacts and cache stored
+// like a local stage's would
+func (a *AgentExecutor) Execute(ctx context.Context, spec ExecSpec, out io.Writer) (string, error) {
+	run, stage, logger := a.run, a.stage, a.logger
+	job := AgentJob{Run: run.Id, Stage: stage.Id, Name: stage.Name, Exec: spec.Exec, Commands: spec.Commands, Env: spec.Env, Image: spec.Image, Limits: spec.Limits, Sandbox: spec.Sandbox,
+		Artifacts: stage.Artifacts}
+	if src := run.source; src != nil {
+		job.Scm, job.Refs, job.Commit, job.Merge, job.Dir, job.Checkout = src.Scm, src.Refs, src.Commit, src.Merge, src.Dir, src.Checkout
+		if src.Credentials != "" {
+			cred, err := secretStore.Get(src.Credentials)
+			if err != nil {
+				return "", err
+			}
+			cred.Name = src.Credentials
+			job.Credential = &cred
+		}
+	}
+	artifacts, err := stageArtifacts(run, stage)
+	if err != nil {
+		return "", err
+	}
+	for _, artifact := range artifacts {
+		data, err := ioutil.ReadFile(artifactPath(artifact.Digest))
+		if err != nil {
+			return "", err
+		}
+		job.Restore = append(job.Restore, AgentFile{Name: artifact.Name, Data: data})
+	}
+	key := run.stageRun(stage.Id).CacheKey
+	if stage.Cache != nil && key != "" {
+		job.Cache = stage.Cache
+		if job.CacheData, err = readCache(key); err != nil {
+			logger.Error("Cache", "error", err)
+		}
+	}
+	res, err := coordinator.Dispatch(ctx, job, stage.RunsOn, func(data string) { io.WriteString(out, data) }, logger)
+	if err != nil {
+		return "", err
+	}
+	logger.Info("Agent : stage done", "agent", res.Agent)
+	if len(res.Outputs) > 0 {
+		var b strings.Builder
+		for k, v := range res.Outputs {
+			b.WriteString(k + "=" + v + "\n")
+		}
+		ioutil.WriteFile(spec.Output, []byte(b.String()), 0600)
+	}
+	if res.Error != "" {
+		return res.Output, errors.New(res.Error)
+	}
+	if err := storeArtifacts(run, stage, res.Artifacts, logger); err != nil {
+		logger.Error("Artifacts", "error", err)
+	}
+	if res.Cache != nil {
+		if err := writeCache(key, func(w io.Writer) error { _, err := w.Write(res.Cache); return err }, logger); err != nil {
+			logger.Error("Cache", "error", err)
+		}
+	}
+	return res.Output, nil
+}
+
+// Agent - the worker side, runs one job at a time
+type Agent struct {
+	Server  string
+	Token   string
+	Name    string
+	Labels  map[string]string
+	WorkDir string
+	Dialer  *websocket.Dialer
+}
+
+// agentLabels - os, arch, the tools found on the PATH and AGENT_LABELS (k=v,k=v)
+func agentLabels() map[string]string {
+	labels := map[string]string{"os": runtime.GOOS, "arch": runtime.GOARCH}
+	for _, tool := range []string{"git", "make", "go", "podman", "docker", "node", "java"} {
+		if _, err := exec.LookPath(tool); err == nil {
+			labels[tool] = "true"
+		}
+	}
+	for _, kv := range strings.Split(os.Getenv("AGENT_LABELS"), ",") {
+		if parts := strings.SplitN(strings.TrimSpace(kv), "=", 2); len(parts) == 2 {
+			labels[parts[0]] = parts[1]
+		}
+	}
+	return labels
+}
+
+// newAgent - AGENT_SERVER (ws://host:9000/api/v1/agents/connect), AGENT_TOKEN, AGENT_NAME (default hostname),
+// AGENT_LABELS and AGENT_WORKDIR (default agent)
+func newAgent() *Agent {
+	name := os.Getenv("AGENT_NAME")
+	if name == "" {
+		name, _ = os.Hostname()
+	}
+	dir := os.Getenv("AGENT_WORKDIR")
+	if dir == "" {
+		dir = "agent"
+	}
+	return &Agent{Server: os.Getenv("AGENT_SERVER"), Token: os.Getenv("AGENT_TOKEN"), Name: name, Labels: agentLabels(), WorkDir: dir}
+}
+
+// runAgent - the agent process, reconnects until interrupted
+func runAgent(logger *Logger) {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	a := newAgent()
+	for {
+		err := a.Run(ctx, logger)
+		if ctx.Err() != nil {
+			return
+		}
+		logger.Warn("Agent : disconnected, reconnecting", "server", a.Server, "error", err)
+		select {
+		case <-time.After(5 * time.Second):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Run - connects, registers and runs the jobs until the connection drops or ctx is done
+func (a *Agent) Run(ctx context.Context, logger *Logger) error {
+	dialer := a.Dialer
+	if dialer == nil {
+		dialer = websocket.DefaultDialer
+	}
+	header := http.Header{}
+	if a.Token != "" {
+		header.Set("Authorization", "Bearer "+a.Token)
+	}
+	conn, _, err := dialer.DialContext(ctx, a.Server, header)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var wmu sync.Mutex
+	send := func(msg AgentMessage) error {
+		wmu.Lock()
+		defer wmu.Unlock()
+		return conn.WriteJSON(msg)
+	}
+
+	if err := send(AgentMessage{Type: "register", Name: a.Name, Labels: a.Labels}); err != nil {
+		return err
+	}
+	var reg AgentMessage
+	if err := conn.ReadJSON(&reg); err != nil || reg.Type != "registered" {
+		return fmt.Errorf("agent registration %v", err)
+	}
+	logger = logger.With("agent", reg.Name)
+	logger.Info("Agent : registered", "labels", a.Labels)
+
+	actx, stop := context.WithCancel(ctx)
+	defer stop()
+	interval := time.Duration(reg.Heartbeat) * time.Millisecond
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				send(AgentMessage{Type: "heartbeat"})
+			case <-actx.Done():
+				conn.Close()
+				return
+			}
+		}
+	}()
+
+	var jobs sync.WaitGroup
+	defer jobs.Wait()
+	var mu sync.Mutex
+	cancels := map[string]context.CancelFunc{}
+	for {
+		var msg AgentMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			stop()
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		switch {
+		case msg.Type == "job" && msg.Job != nil:
+			jctx, cancel := context.WithCancel(actx)
+			mu.Lock()
+			cancels[msg.Lease] = cancel
+			mu.Unlock()
+			jobs.Add(1)
+			go func(lease string, job AgentJob) {
+				defer jobs.Done()
+				logger.Info("Agent : job", "lease", lease, "run", job.Run, "stage", job.Name)
+				res := a.runJob(jctx, lease, job, func(data string) {
+					send(AgentMessage{Type: "log", Lease: lease, Data: data})
+				}, logger)
+				mu.Lock()
+				delete(cancels, lease)
+				mu.Unlock()
+				if jctx.Err() == nil {
+					send(AgentMessage{Type: "result", Lease: lease, Result: &res})
+				}
+				cancel()
+			}(msg.Lease, *msg.Job)
+		case msg.Type == "cancel":
+			mu.Lock()
+			if cancel, ok := cancels[msg.Lease]; ok {
+				cancel()
+			}
+			mu.Unlock()
+		}
+	}
+}
+
+// runJob - checks out the job's commit in a workspace of its own and runs the commands
+func (a *Agent) runJob(ctx context.Context, lease string, job AgentJob, log func(string), logger *Logger) JobResult {
+	res := JobResult{Agent: a.Name}
+	dest, _ := filepath.Abs(filepath.Join(a.WorkDir, "jobs", lease))
+	os.MkdirAll(filepath.Dir(dest), os.ModePerm)
+	defer os.RemoveAll(dest)
+	if job.Scm != "" {
+		sum := sha256.Sum256([]byte(job.Scm))
+		clone, _ := filepath.Abs(filepath.Join(a.WorkDir, "repos", hex.EncodeToString(sum[:6])))
+		scm := newSourceProvider(job.Checkout)
+		if job.Credential != nil {
+			var err error
+			if scm, err = newCredentialSourceProvider(job.Scm, job.Checkout, job.Credential.Name, *job.Credential); err != nil {
+				logger.Error("Agent : credential", "error", err)
+				res.Error = err.Error()
+				return res
+			}
+		}
+		defer scm.Close()
+		var err error
+		if _, e := os.Stat(clone); os.IsNotExist(e) {
+			err = scm.Clone(job.Scm, clone)
+		} else {
+			err = scm.Fetch(clone)
+		}
+		if err == nil && len(job.Refs) > 0 {
+			err = scm.FetchRefs(clone, job.Refs)
+		}
+		if err == nil {
+			err = scm.Checkout(clone, dest, job.Commit)
+			defer scm.RemoveCheckout(clone, dest)
+		}
+		if err == nil && job.Merge != "" {
+			err = scm.Merge(dest, job.Merge)
+		}
+		if err != nil {
+			logger.Error("Agent : checkout", "error", err)
+			res.Error = err.Error()
+			return res
+		}
+	} else {
+		os.MkdirAll(dest, os.ModePerm)
+	}
+
+	dir := filepath.Join(dest, job.Dir)
+	for _, f := range job.Restore {
+		path, err := workspaceFile(dir, f.Name)
+		if err == nil {
+			os.MkdirAll(filepath.Dir(path), os.ModePerm)
+			err = ioutil.WriteFile(path, f.Data, 0755)
+		}
+		if err != nil {
+			res.Error = err.Error()
+			return res
+		}
+	}
+	var paths []string
+	if job.Cache != nil {
+		paths = cachePaths(job.Cache, dir)
+		if job.CacheData != nil {
+			if err := extractCache(bytes.NewReader(job.CacheData), paths); err != nil {
+				logger.Error("Agent : cache", "error", err)
+			}
+		}
+	}
+
+	outputFile, _ := newOutputFile()
+	defer os.Remove(outputFile)
+	env := append(job.Env, "CICD_OUTPUT="+outputFile)
+	spec := ExecSpec{Name: fmt.Sprintf(CONTAINERNAME, lease, job.Stage), Dir: dir, Exec: job.Exec, Commands: job.Commands, Env: env, Output: outputFile, Image: job.Image, Limits: job.Limits, Sandbox: job.Sandbox}
+	var exe Executor = HostExecutor{}
+	if job.Image != "" {
+		exe = &ContainerExecutor{Runtime: containerRuntime}
+	}
+	out, err := exe.Execute(ctx, spec, streamWriter(log))
+	res.Output = out
+	res.Outputs, _ = readOutputs(outputFile)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	err = walkArtifacts(dir, job.Artifacts, logger, func(name string, path string) error {
+		data, err := ioutil.ReadFile(path)
+		res.Artifacts = append(res.Artifacts, AgentFile{Name: name, Data: data})
+		return err
+	})
+	if err != nil {
+		logger.Error("Agent : artifacts", "error", err)
+	}
+	if job.Cache != nil && job.CacheData == nil {
+		var b bytes.Buffer
+		if err := archiveCache(&b, paths); err != nil {
+			logger.Error("Agent : cache", "error", err)
+		} else {
+			res.Cache = b.Bytes()
+		}
+	}
+	return res
+}
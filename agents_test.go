@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+func TestAgents(t *testing.T) {
+	tmp, _ := ioutil.TempDir("", "agents")
+	defer os.RemoveAll(tmp)
+	logger := NewLogger("error", "text", os.Stdout)
+	defer func(c *Coordinator, a *AuditLog) { coordinator, auditLog = c, a }(coordinator, auditLog)
+	coordinator = newCoordinator(600 * time.Millisecond)
+	auditLog = &AuditLog{file: filepath.Join(tmp, "audit.log")}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/api/v1/agents/connect", func(w http.ResponseWriter, req *http.Request) {
+		AgentConnectHandler(w, req, logger)
+	})
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/api/v1/agents/connect"
+
+	ctx, stop := context.WithCancel(context.Background())
+	var agents sync.WaitGroup
+	defer agents.Wait()
+	defer stop()
+	start := func(name string, labels map[string]string) {
+		agents.Add(1)
+		go func() {
+			defer agents.Done()
+			a := &Agent{Server: url, Name: name, Labels: labels, WorkDir: filepath.Join(tmp, name)}
+			a.Run(ctx, logger)
+		}()
+	}
+	waitFor := func(n int) {
+		for x := 0; x < 200 && len(coordinator.Agents()) != n; x++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	start("builder", map[string]string{"os": "linux", "podman": "true"})
+	start("small", map[string]string{"os": "linux"})
+	waitFor(2)
+
+	// upstream repository the agents check out
+	upstreamDir := filepath.Join(tmp, "upstream")
+	upstream, _ := git.PlainInit(upstreamDir, false)
+	sha := commitFile(t, upstream, upstreamDir, "version.txt", "1.0.4")
+
+	script := "echo building $CICD_STAGE_NAME; echo version=$(cat version.txt) >> $CICD_OUTPUT"
+	// create anonymous struct
+	tests := []struct {
+		Name     string
+		Job      AgentJob
+		Selector map[string]string
+		Agent    string
+		Output   string
+		ErrorMsg string
+	}{
+		{
+			"Test agents : label selector",
+			AgentJob{Run: "r1", Stage: 1, Exec: "/bin/sh", Commands: []string{"-c", "echo podman"}},
+			map[string]string{"podman": "true"},
+			"builder#",
+			"podman\n",
+			"Agent %s - got (%v) wanted (%v)",
+		},
+		{
+			"Test agents : checkout and outputs",
+			AgentJob{Run: "r2", Stage: 2, Scm: upstreamDir, Commit: sha, Exec: "/bin/sh", Commands: []string{"-c", script}, Env: []string{"CICD_STAGE_NAME=Build"}},
+			map[string]string{"os": "linux"},
+			"",
+			"building Build\n",
+			"Agent %s - got (%v) wanted (%v)",
+		},
+		{
+			"Test agents : failing command",
+			AgentJob{Run: "r3", Stage: 3, Exec: "/bin/sh", Commands: []string{"-c", "echo broken >&2; exit 3"}},
+			map[string]string{"os": "linux"},
+			"",
+			"broken\n",
+			"Agent %s - got (%v) wanted (%v)",
+		},
+	}
+
+	for _, tt := range tests {
+		fmt.Println(fmt.Sprintf("\nExecuting test : %s", tt.Name))
+		var mu sync.Mutex
+		streamed := ""
+		res, err := coordinator.Dispatch(ctx, tt.Job, tt.Selector, func(data string) {
+			mu.Lock()
+			streamed += data
+			mu.Unlock()
+		}, logger)
+		if err != nil {
+			t.Fatalf(tt.ErrorMsg, tt.Name, err, nil)
+		}
+		if !strings.HasPrefix(res.Agent, tt.Agent) || res.Output != tt.Output {
+			t.Errorf(tt.ErrorMsg, tt.Name, res.Agent+" "+res.Output, tt.Agent+" "+tt.Output)
+		}
+		mu.Lock()
+		if streamed != tt.Output {
+			t.Errorf(tt.ErrorMsg, tt.Name, "streamed "+streamed, tt.Output)
+		}
+		mu.Unlock()
+		if tt.Job.Scm != "" && res.Outputs["version"] != "1.0.4" {
+			t.Errorf(tt.ErrorMsg, tt.Name, res.Outputs, "version=1.0.4")
+		}
+		if strings.HasPrefix(tt.Name, "Test agents : failing") && res.Error == "" {
+			t.Errorf(tt.ErrorMsg, tt.Name, res.Error, "exit status 3")
+		}
+		fmt.Println("")
+	}
+
+	// restored artifacts and the cache go to the agent, its artifacts and the cache tarball come back
+	job := AgentJob{Run: "r6", Stage: 1, Exec: "/bin/sh", Commands: []string{"-c", "mkdir -p dist deps && cat in/lib.txt > dist/app.txt && echo dep > deps/a"},
+		Restore: []AgentFile{{Name: "in/lib.txt", Data: []byte("lib")}}, Artifacts: []string{"dist"}, Cache: &CacheDetail{Key: "deps", Paths: []string{"deps"}}}
+	res, err := coordinator.Dispatch(ctx, job, map[string]string{"os": "linux"}, nil, logger)
+	if err != nil || res.Error != "" || len(res.Artifacts) != 1 || res.Artifacts[0].Name != "dist/app.txt" || string(res.Artifacts[0].Data) != "lib" {
+		t.Errorf("Agent artifacts - got (%v %v) wanted (dist/app.txt lib)", res, err)
+	}
+	restored := filepath.Join(tmp, "restored")
+	if err := extractCache(bytes.NewReader(res.Cache), []string{restored}); err != nil {
+		t.Errorf("Agent cache - got (%v) wanted (a tarball)", err)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(restored, "a")); string(b) != "dep\n" {
+		t.Errorf("Agent cache - got (%q) wanted (dep)", b)
+	}
+	job.Run, job.CacheData, job.Commands = "r7", res.Cache, []string{"-c", "cat deps/a"}
+	if res, err = coordinator.Dispatch(ctx, job, map[string]string{"os": "linux"}, nil, logger); err != nil || res.Output != "dep\n" || res.Cache != nil {
+		t.Errorf("Agent cache hit - got (%v %v) wanted (dep)", res, err)
+	}
+
+	// nothing matches, the job waits until the run gives up
+	wctx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	if _, err := coordinator.Dispatch(wctx, AgentJob{Run: "r4", Stage: 1, Exec: "true"}, map[string]string{"os": "windows"}, nil, logger); err == nil {
+		t.Errorf("Agent no match - got (%v) wanted (deadline)", err)
+	}
+	cancel()
+
+	// an agent that takes the lease and then goes silent, the lease moves to the next matching agent
+	silent, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Agent dial %v", err)
+	}
+	defer silent.Close()
+	silent.WriteJSON(AgentMessage{Type: "register", Name: "silent", Labels: map[string]string{"gpu": "true"}})
+	waitFor(3)
+	done := make(chan JobResult, 1)
+	go func() {
+		res, _ := coordinator.Dispatch(ctx, AgentJob{Run: "r5", Stage: 1, Exec: "/bin/sh", Commands: []string{"-c", "echo recovered"}}, map[string]string{"gpu": "true"}, nil, logger)
+		done <- res
+	}()
+	var msg AgentMessage
+	for msg.Type != "job" {
+		if err := silent.ReadJSON(&msg); err != nil {
+			t.Fatalf("Agent silent read %v", err)
+		}
+	}
+	start("gpu", map[string]string{"gpu": "true"})
+	select {
+	case res := <-done:
+		if !strings.HasPrefix(res.Agent, "gpu#") || res.Output != "recovered\n" {
+			t.Errorf("Agent requeue - got (%v) wanted (gpu recovered)", res)
+		}
+	case <-time.After(10 * time.Second):
+		t.Errorf("Agent requeue - got (timeout) wanted (gpu recovered)")
+	}
+	for _, a := range coordinator.Agents() {
+		if a.Name == "silent" {
+			t.Errorf("Agent reaper - got (%v) wanted (silent agent removed)", a)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	approvals = struct {
+		sync.Mutex
+		pending map[string]chan ApprovalDetail
+	}{pending: map[string]chan ApprovalDetail{}}
+)
+
+func approvalKey(runId string, stageId int) string {
+	return runId + "/" + strconv.Itoa(stageId)
+}
+
+// approvalExpiry - the stage expiry or APPROVAL_EXPIRY (seconds, default 3600), a waiting run holds
+// its queue worker so it can't wait forever
+func approvalExpiry(stage StageDetail) time.Duration {
+	if stage.Expiry > 0 {
+		return time.Duration(stage.Expiry) * time.Second
+	}
+	if n, err := strconv.Atoi(os.Getenv("APPROVAL_EXPIRY")); err == nil && n > 0 {
+		return time.Duration(n) * time.Second
+	}
+	return time.Hour
+}
+
+// waitForApproval - pauses the run until a decision arrives or the expiry passes
+// returns an error if the stage was rejected or expired
+func waitForApproval(run *Run, stage StageDetail, logger *Logger) error {
+	ch := make(chan ApprovalDetail, 1)
+	key := approvalKey(run.Id, stage.Id)
+
+	approvals.Lock()
+	approvals.pending[key] = ch
+	approvals.Unlock()
+	defer func() {
+		approvals.Lock()
+		delete(approvals.pending, key)
+		approvals.Unlock()
+	}()
+
+	sr := run.stageRun(stage.Id)
+	expiry := approvalExpiry(stage)
+	expired := time.After(expiry)
+	sr.Approval = &ApprovalDetail{Decision: "waiting", Expires: time.Now().Add(expiry).Unix()}
+	run.Status = "waiting"
+	stageStatus(run, stage.Id, "waiting", logger)
+	logger.Info("Approval : waiting for approval")
+	if len(run.notify) > 0 {
+		cp := copyRun(run)
+		go notifyRun(&cp, []string{"approval"}, logger)
+	}
+
+	select {
+	case decision := <-ch:
+		decision.Expires = sr.Approval.Expires
+		sr.Approval = &decision
+	case <-expired:
+		sr.Approval = &ApprovalDetail{Decision: "expired", Expires: sr.Approval.Expires, Time: time.Now().Unix()}
+	}
+	run.Status = "running"
+	logger.Info("Approval : decided", "decision", sr.Approval.Decision, "approver", sr.Approval.Approver, "comment", sr.Approval.Comment)
+	if sr.Approval.Decision != "approved" {
+		return errors.New("stage " + stage.Name + " " + sr.Approval.Decision)
+	}
+	return nil
+}
+
+// decideApproval - delivers an approve/reject decision to a waiting run
+func decideApproval(runId string, stageId int, approve bool, approver string, comment string) error {
+	if approver == "" {
+		return errors.New("approver is mandatory")
+	}
+	approvals.Lock()
+	ch, ok := approvals.pending[approvalKey(runId, stageId)]
+	if ok {
+		delete(approvals.pending, approvalKey(runId, stageId))
+	}
+	approvals.Unlock()
+	if !ok {
+		return fmt.Errorf("run %s stage %d is not waiting for approval", runId, stageId)
+	}
+	decision := ApprovalDetail{Decision: "rejected", Approver: approver, Comment: comment, Time: time.Now().Unix()}
+	if approve {
+		decision.Decision = "approved"
+	}
+	ch <- decision
+	return nil
+}
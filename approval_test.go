@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestApprovals(t *testing.T) {
+	tmp, _ := ioutil.TempDir("", "approval")
+	defer os.RemoveAll(tmp)
+	defer func(s *RunStore) { runStore = s }(runStore)
+	runStore = &RunStore{runs: map[string]*Run{}, dir: filepath.Join(tmp, "runs")}
+	defer func(a *AuditLog) { auditLog = a }(auditLog)
+	auditLog = &AuditLog{file: filepath.Join(tmp, "audit.log")}
+	logger := NewLogger("error", "text", ioutil.Discard)
+	stage := StageDetail{Id: 0, Name: "Sign-off", Type: "approval"}
+
+	decide := func(runId string, decision string, approver string) int {
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/runs/"+runId+"/stages/0/"+decision, strings.NewReader(`{"approver":"`+approver+`","comment":"lgtm"}`))
+		r = mux.SetURLVars(r, map[string]string{"id": runId, "stageId": "0", "decision": decision})
+		r = r.WithContext(context.WithValue(r.Context(), principalKey{}, &Principal{Name: "anonymous", Method: "none"}))
+		w := httptest.NewRecorder()
+		ApprovalHandler(w, r, logger)
+		return w.Code
+	}
+
+	// create anonymous struct
+	tests := []struct {
+		Name     string
+		Decision string
+		Approver string
+		Expiry   int
+		Code     int
+		Repeat   int
+		Want     string
+		Err      string
+		ErrorMsg string
+	}{
+		{"Test approval : approve", "approve", "alice", 0, http.StatusOK, http.StatusBadRequest, "approved", "", "Approval %s - got (%v) wanted (%v)"},
+		{"Test approval : reject", "reject", "alice", 0, http.StatusOK, http.StatusBadRequest, "rejected", "stage Sign-off rejected", "Approval %s - got (%v) wanted (%v)"},
+		{"Test approval : no approver", "approve", "", 1, http.StatusBadRequest, 0, "expired", "stage Sign-off expired", "Approval %s - got (%v) wanted (%v)"},
+		{"Test approval : expiry", "", "", 1, 0, 0, "expired", "stage Sign-off expired", "Approval %s - got (%v) wanted (%v)"},
+	}
+
+	for x, tt := range tests {
+		fmt.Println(fmt.Sprintf("\nExecuting test : %s", tt.Name))
+		id := fmt.Sprintf("approval-%d", x)
+		run := runStore.Create(id, Repository{Id: "api"}, &Pipeline{Id: "1", Stages: []StageDetail{stage}}, "abc")
+		stage.Expiry = tt.Expiry
+		done := make(chan error, 1)
+		go func(stage StageDetail) { done <- waitForApproval(run, stage, logger) }(stage)
+		for y := 0; y < 200 && !waitingFor(id); y++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if tt.Decision != "" {
+			if code := decide(id, tt.Decision, tt.Approver); code != tt.Code {
+				t.Errorf(tt.ErrorMsg, tt.Name, code, tt.Code)
+			}
+		}
+		var err error
+		select {
+		case err = <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf(tt.ErrorMsg, tt.Name, "still waiting", tt.Want)
+		}
+		if (tt.Err == "" && err != nil) || (tt.Err != "" && (err == nil || err.Error() != tt.Err)) {
+			t.Errorf(tt.ErrorMsg, tt.Name, err, tt.Err)
+		}
+		if sr := run.stageRun(0); sr.Approval == nil || sr.Approval.Decision != tt.Want {
+			t.Errorf(tt.ErrorMsg, tt.Name, sr.Approval, tt.Want)
+		}
+		if tt.Want != "expired" && run.stageRun(0).Approval.Approver != tt.Approver {
+			t.Errorf(tt.ErrorMsg, tt.Name, run.stageRun(0).Approval.Approver, tt.Approver)
+		}
+		// a decision is taken once
+		if tt.Repeat != 0 {
+			if code := decide(id, "approve", "bob"); code != tt.Repeat {
+				t.Errorf(tt.ErrorMsg, tt.Name+" repeated", code, tt.Repeat)
+			}
+			if err := decideApproval(id, 0, true, "bob", ""); err == nil || err.Error() != "run "+id+" stage 0 is not waiting for approval" {
+				t.Errorf(tt.ErrorMsg, tt.Name+" repeated", err, "not waiting for approval")
+			}
+		}
+		fmt.Println("")
+	}
+}
+
+func waitingFor(runId string) bool {
+	approvals.Lock()
+	defer approvals.Unlock()
+	_, ok := approvals.pending[approvalKey(runId, 0)]
+	return ok
+}
+
+func TestApprovalExpiry(t *testing.T) {
+	defer os.Unsetenv("APPROVAL_EXPIRY")
+
+	// create anonymous struct
+	tests := []struct {
+		Name     string
+		Expiry   int
+		Env      string
+		Want     time.Duration
+		ErrorMsg string
+	}{
+		{"Test approval expiry : stage", 60, "120", time.Minute, "Approval %s - got (%v) wanted (%v)"},
+		{"Test approval expiry : envar", 0, "120", 2 * time.Minute, "Approval %s - got (%v) wanted (%v)"},
+		{"Test approval expiry : invalid envar", 0, "soon", time.Hour, "Approval %s - got (%v) wanted (%v)"},
+		{"Test approval expiry : default", 0, "", time.Hour, "Approval %s - got (%v) wanted (%v)"},
+	}
+
+	for _, tt := range tests {
+		fmt.Println(fmt.Sprintf("\nExecuting test : %s", tt.Name))
+		os.Setenv("APPROVAL_EXPIRY", tt.Env)
+		if got := approvalExpiry(StageDetail{Expiry: tt.Expiry}); got != tt.Want {
+			t.Errorf(tt.ErrorMsg, tt.Name, got, tt.Want)
+		}
+		fmt.Println("")
+	}
+}
+
+func TestApprovalRestart(t *testing.T) {
+	tmp, _ := ioutil.TempDir("", "restart")
+	defer os.RemoveAll(tmp)
+	defer func(s *RunStore) { runStore = s }(runStore)
+	runStore = &RunStore{runs: map[string]*Run{}, dir: filepath.Join(tmp, "runs")}
+
+	// runs left waiting (or finished) before the restart
+	waiting := runStore.Create("waiting", Repository{Id: "api"}, &Pipeline{Id: "1", Stages: []StageDetail{{Id: 0, Name: "Build"}, {Id: 1, Name: "Sign-off"}}}, "abc")
+	waiting.Status = "waiting"
+	waiting.Stages[0].Status = "success"
+	waiting.Stages[1].Status = "waiting"
+	waiting.Stages[1].Approval = &ApprovalDetail{Decision: "waiting"}
+	runStore.Save(waiting)
+	done := runStore.Create("done", Repository{Id: "api"}, &Pipeline{Id: "1"}, "abc")
+	done.Status = "success"
+	runStore.Save(done)
+
+	// the second load reads the file written by the first one
+	for _, store := range []*RunStore{{runs: map[string]*Run{}, dir: runStore.dir}, {runs: map[string]*Run{}, dir: runStore.dir}} {
+		if err := store.Load(); err != nil {
+			t.Fatalf("Approval restart - got (%v) wanted (nil)", err)
+		}
+		run, _ := store.Get("waiting")
+		if run.Status != "failed" || run.End == 0 || run.Stages[0].Status != "success" || run.Stages[1].Status != "rejected" || run.Stages[1].Approval.Decision != "expired" {
+			t.Errorf("Approval restart - got (%v %v %v) wanted (%v)", run.Status, run.Stages, run.Stages[1].Approval, "failed with an expired approval")
+		}
+		if run, _ := store.Get("done"); run.Status != "success" {
+			t.Errorf("Approval restart - got (%v) wanted (%v)", run.Status, "success")
+		}
+	}
+}
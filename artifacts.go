@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// artifactLock - a run's blobs are stored and the run saved under the read lock, pruneArtifacts takes the write
+// lock so it never sees a blob whose run isn't saved yet
+var artifactLock sync.RWMutex
+
+// artifactDir - root of the content addressed store, blobs live in <dir>/sha256/<xx>/<digest>
+func artifactDir() string {
+	if os.Getenv("ARTIFACT_DIR") != "" {
+		return os.Getenv("ARTIFACT_DIR")
+	}
+	return "artifacts"
+}
+
+func artifactPath(digest string) string {
+	return filepath.Join(artifactDir(), "sha256", digest[:2], digest)
+}
+
+// collectArtifacts - archives the files matching the stage artifact globs and attaches them to the run
+func collectArtifacts(run *Run, stage StageDetail, workDirPath string, logger *Logger) error {
+	artifactLock.RLock()
+	defer artifactLock.RUnlock()
+	err := walkArtifacts(workDirPath, stage.Artifacts, logger, func(name string, path string) error {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return addArtifact(run, stage, name, f, logger)
+	})
+	if err != nil {
+		return err
+	}
+	return runStore.Save(run)
+}
+
+// storeArtifacts - attaches the artifacts sent back by an agent to the run
+func storeArtifacts(run *Run, stage StageDetail, files []AgentFile, logger *Logger) error {
+	artifactLock.RLock()
+	defer artifactLock.RUnlock()
+	for _, f := range files {
+		if err := addArtifact(run, stage, f.Name, bytes.NewReader(f.Data), logger); err != nil {
+			return err
+		}
+	}
+	return runStore.Save(run)
+}
+
+// walkArtifacts - calls fn with the name (relative to workDirPath) and the path of every file matching the globs,
+// matches outside the workspace (../ patterns or symlinks) are skipped
+func walkArtifacts(workDirPath string, patterns []string, logger *Logger, fn func(name string, path string) error) error {
+	root, err := filepath.EvalSymlinks(workDirPath)
+	if err != nil {
+		// no workspace, nothing matches
+		root = filepath.Clean(workDirPath)
+	}
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(filepath.Join(workDirPath, pattern))
+		if err != nil {
+			return err
+		}
+		if len(matches) == 0 {
+			logger.Warn("Artifacts : pattern matched no files", "pattern", pattern)
+		}
+		for _, match := range matches {
+			err = filepath.Walk(match, func(path string, info os.FileInfo, err error) error {
+				if err != nil || info.IsDir() {
+					return err
+				}
+				name, _ := filepath.Rel(workDirPath, path)
+				if _, err := workspaceFile(workDirPath, name); err != nil {
+					logger.Warn("Artifacts : skipped", "pattern", pattern, "error", err)
+					return nil
+				}
+				if resolved, err := filepath.EvalSymlinks(path); err != nil || !strings.HasPrefix(resolved, root+string(os.PathSeparator)) {
+					logger.Warn("Artifacts : skipped, the link resolves outside the workspace", "pattern", pattern, "artifact", name)
+					return nil
+				}
+				return fn(filepath.ToSlash(name), path)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// addArtifact - stores the content of an artifact produced by the stage and attaches it to the run
+func addArtifact(run *Run, stage StageDetail, name string, r io.Reader, logger *Logger) error {
+	digest, size, err := storeArtifact(r)
+	if err != nil {
+		return err
+	}
+	run.Artifacts = append(run.Artifacts, ArtifactDetail{Name: name, Stage: stage.Name, Digest: digest, Size: size, Created: time.Now().Unix()})
+	logger.Info("Artifacts : stored", "artifact", name, "digest", "sha256:"+digest, "size", size)
+	return nil
+}
+
+// storeArtifact - copies the content into the store (once per digest)
+func storeArtifact(r io.Reader) (string, int64, error) {
+	os.MkdirAll(artifactDir(), os.ModePerm)
+	tmp, err := ioutil.TempFile(artifactDir(), ".upload")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), r)
+	tmp.Close()
+	if err != nil {
+		return "", 0, err
+	}
+	digest := hex.EncodeToString(h.Sum(nil))
+	if _, err := os.Stat(artifactPath(digest)); err == nil {
+		return digest, size, nil
+	}
+	os.MkdirAll(filepath.Dir(artifactPath(digest)), os.ModePerm)
+	return digest, size, os.Rename(tmp.Name(), artifactPath(digest))
+}
+
+// restoreArtifacts - copies the artifacts produced by the stages listed in restore into the stage working directory
+func restoreArtifacts(run *Run, stage StageDetail, workDirPath string, logger *Logger) error {
+	artifacts, err := stageArtifacts(run, stage)
+	if err != nil {
+		return err
+	}
+	for _, a := range artifacts {
+		dest, err := workspaceFile(workDirPath, a.Name)
+		if err != nil {
+			return err
+		}
+		if err := copyFile(artifactPath(a.Digest), dest); err != nil {
+			return err
+		}
+		logger.Debug("Artifacts : restored", "artifact", a.Name, "from", a.Stage)
+	}
+	return nil
+}
+
+// stageArtifacts - the artifacts of the stages listed in restore
+func stageArtifacts(run *Run, stage StageDetail) ([]ArtifactDetail, error) {
+	var artifacts []ArtifactDetail
+	for _, from := range stage.Restore {
+		found := false
+		for _, a := range run.Artifacts {
+			if strings.EqualFold(a.Stage, from) {
+				artifacts = append(artifacts, a)
+				found = true
+			}
+		}
+		if !found {
+			return nil, errors.New("no artifacts found for stage " + from)
+		}
+	}
+	return artifacts, nil
+}
+
+// workspaceFile - the path of the artifact name in the working directory, names can't escape it
+func workspaceFile(workDirPath string, name string) (string, error) {
+	dest := filepath.Join(workDirPath, filepath.FromSlash(name))
+	if !strings.HasPrefix(dest, filepath.Clean(workDirPath)+string(os.PathSeparator)) {
+		return "", errors.New("artifact " + name + " escapes the workspace")
+	}
+	return dest, nil
+}
+
+func copyFile(src string, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	os.MkdirAll(filepath.Dir(dest), os.ModePerm)
+	out, err := os.OpenFile(dest, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, in)
+	return err
+}
+
+// findArtifact - looks up an artifact of the run by name
+func findArtifact(run Run, name string) (ArtifactDetail, bool) {
+	for _, a := range run.Artifacts {
+		if a.Name == name {
+			return a, true
+		}
+	}
+	return ArtifactDetail{}, false
+}
+
+// pruneArtifacts - retention policy, drops artifacts of runs older than ARTIFACT_RETENTION_DAYS (default 30)
+// and removes blobs no longer referenced by any run
+func pruneArtifacts(logger *Logger) {
+	days := 30
+	if os.Getenv("ARTIFACT_RETENTION_DAYS") != "" {
+		n, err := strconv.Atoi(os.Getenv("ARTIFACT_RETENTION_DAYS"))
+		if err != nil || n < 0 {
+			logger.Error("Artifacts : invalid ARTIFACT_RETENTION_DAYS, keeping 30 days", "value", os.Getenv("ARTIFACT_RETENTION_DAYS"), "error", err)
+		} else {
+			days = n
+		}
+	}
+	artifactLock.Lock()
+	defer artifactLock.Unlock()
+	cutoff := time.Now().AddDate(0, 0, -days).Unix()
+	referenced := map[string]bool{}
+
+	for _, run := range runStore.List() {
+		if len(run.Artifacts) > 0 && run.End > 0 && run.End < cutoff {
+			logger.Info("Artifacts : expiring", "count", len(run.Artifacts), "run", run.Id)
+			run.Artifacts = nil
+			runStore.Save(&run)
+		}
+		for _, a := range run.Artifacts {
+			referenced[a.Digest] = true
+		}
+	}
+
+	filepath.Walk(filepath.Join(artifactDir(), "sha256"), func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		if !referenced[info.Name()] {
+			logger.Debug("Artifacts : removing blob", "digest", info.Name())
+			os.Remove(path)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestArtifacts(t *testing.T) {
+	tmp, _ := ioutil.TempDir("", "artifacts")
+	defer os.RemoveAll(tmp)
+	defer func(s *RunStore) { runStore = s }(runStore)
+	runStore = &RunStore{runs: map[string]*Run{}, dir: filepath.Join(tmp, "runs")}
+	os.Setenv("ARTIFACT_DIR", filepath.Join(tmp, "store"))
+	defer os.Unsetenv("ARTIFACT_DIR")
+	logger := NewLogger("error", "text", os.Stdout)
+
+	// the same content twice is stored once
+	work := filepath.Join(tmp, "work")
+	os.MkdirAll(filepath.Join(work, "dist"), os.ModePerm)
+	ioutil.WriteFile(filepath.Join(work, "dist", "a.txt"), []byte("same"), 0644)
+	ioutil.WriteFile(filepath.Join(work, "dist", "b.txt"), []byte("same"), 0644)
+	ioutil.WriteFile(filepath.Join(work, "dist", "c.txt"), []byte("other"), 0644)
+	run := runStore.Create("1", Repository{Id: "1"}, &Pipeline{Id: "1"}, "abc")
+	build := StageDetail{Name: "Build", Artifacts: []string{"dist"}}
+	if err := collectArtifacts(run, build, work, logger); err != nil || len(run.Artifacts) != 3 {
+		t.Fatalf("Artifacts collect - got (%v %v) wanted (3 artifacts)", run.Artifacts, err)
+	}
+	if run.Artifacts[0].Digest != run.Artifacts[1].Digest || run.Artifacts[0].Size != 4 {
+		t.Errorf("Artifacts dedup - got (%v) wanted (same digest)", run.Artifacts)
+	}
+	blobs := func() int {
+		n := 0
+		filepath.Walk(filepath.Join(tmp, "store", "sha256"), func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				n++
+			}
+			return nil
+		})
+		return n
+	}
+	if n := blobs(); n != 2 {
+		t.Errorf("Artifacts dedup - got (%v) wanted (%v)", n, 2)
+	}
+
+	// create anonymous struct
+	tests := []struct {
+		Name     string
+		Restore  []string
+		Want     string
+		Fails    bool
+		ErrorMsg string
+	}{
+		{"Test artifacts : restore", []string{"build"}, "same", false, "Artifacts %s - got (%v) wanted (%v)"},
+		{"Test artifacts : restore unknown stage", []string{"Test"}, "", true, "Artifacts %s - got (%v) wanted (%v)"},
+	}
+
+	for _, tt := range tests {
+		fmt.Println(fmt.Sprintf("\nExecuting test : %s", tt.Name))
+		dest := filepath.Join(tmp, "restore")
+		os.RemoveAll(dest)
+		err := restoreArtifacts(run, StageDetail{Name: "Deploy", Restore: tt.Restore}, dest, logger)
+		if (err != nil) != tt.Fails {
+			t.Errorf(tt.ErrorMsg, tt.Name, err, tt.Fails)
+		}
+		if b, _ := ioutil.ReadFile(filepath.Join(dest, "dist", "b.txt")); string(b) != tt.Want {
+			t.Errorf(tt.ErrorMsg, tt.Name, string(b), tt.Want)
+		}
+		fmt.Println("")
+	}
+	if _, err := workspaceFile(work, "../escape"); err == nil {
+		t.Errorf("Artifacts escape - got (%v) wanted (an error)", err)
+	}
+
+	// retention, a typo keeps the default 30 days
+	old := runStore.Create("2", Repository{Id: "1"}, &Pipeline{Id: "1"}, "def")
+	old.Artifacts = []ArtifactDetail{{Name: "old.txt", Stage: "Build", Digest: run.Artifacts[2].Digest}}
+	old.End = time.Now().AddDate(0, 0, -10).Unix()
+	runStore.Save(old)
+	run.Artifacts = run.Artifacts[:2]
+	run.End = time.Now().Unix()
+	runStore.Save(run)
+	os.Setenv("ARTIFACT_RETENTION_DAYS", "7d")
+	defer os.Unsetenv("ARTIFACT_RETENTION_DAYS")
+	pruneArtifacts(logger)
+	if r, _ := runStore.Get("2"); len(r.Artifacts) != 1 || blobs() != 2 {
+		t.Errorf("Artifacts retention typo - got (%v %v) wanted (kept)", r.Artifacts, blobs())
+	}
+	os.Setenv("ARTIFACT_RETENTION_DAYS", "7")
+	pruneArtifacts(logger)
+	if r, _ := runStore.Get("2"); len(r.Artifacts) != 0 || blobs() != 1 {
+		t.Errorf("Artifacts retention - got (%v %v) wanted (expired)", r.Artifacts, blobs())
+	}
+	if r, _ := runStore.Get("1"); len(r.Artifacts) != 2 {
+		t.Errorf("Artifacts retention - got (%v) wanted (recent run kept)", r.Artifacts)
+	}
+
+	// host files outside the workspace are never collected, through ../ or a symlink
+	ioutil.WriteFile(filepath.Join(tmp, "host.txt"), []byte("host"), 0644)
+	os.Symlink(filepath.Join(tmp, "host.txt"), filepath.Join(work, "dist", "link.txt"))
+	os.Symlink(tmp, filepath.Join(work, "up"))
+	ioutil.WriteFile(filepath.Join(work, "dist", "own.txt"), []byte("own"), 0644)
+	os.Symlink("own.txt", filepath.Join(work, "dist", "own-link.txt"))
+	escape := runStore.Create("3", Repository{Id: "1"}, &Pipeline{Id: "1"}, "abc")
+	if err := collectArtifacts(escape, StageDetail{Name: "Build", Artifacts: []string{"../host.txt", "up/host.txt", "dist/link.txt", "dist/own-link.txt"}}, work, logger); err != nil || len(escape.Artifacts) != 1 || escape.Artifacts[0].Name != "dist/own-link.txt" {
+		t.Errorf("Artifacts escape - got (%v %v) wanted (%v)", escape.Artifacts, err, "dist/own-link.txt only")
+	}
+}
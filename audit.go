@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AuditEntry - one state changing operation, Hash chains it to the entry before it (Prev)
+// so that edited, removed or reordered lines are detected by verifyAudit
+type AuditEntry struct {
+	Seq    int             `json:"seq"`
+	Time   int64           `json:"time"`
+	Actor  string          `json:"actor"`
+	Method string          `json:"method,omitempty"`
+	Source string          `json:"source,omitempty"`
+	Action string          `json:"action"`
+	Repo   string          `json:"repo,omitempty"`
+	Run    string          `json:"run,omitempty"`
+	Target string          `json:"target,omitempty"`
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+	Prev   string          `json:"prev"`
+	Hash   string          `json:"hash"`
+}
+
+// AuditFilter - query of the audit log, empty fields match everything
+type AuditFilter struct {
+	Actor  string
+	Action string
+	Since  int64
+	Until  int64
+}
+
+// AuditLog - append only json lines file
+type AuditLog struct {
+	mu   sync.Mutex
+	file string
+	seq  int
+	prev string
+	read bool
+}
+
+var auditLog = &AuditLog{file: auditFile()}
+
+// auditFile - AUDIT_FILE, default audit.log
+func auditFile() string {
+	if os.Getenv("AUDIT_FILE") != "" {
+		return os.Getenv("AUDIT_FILE")
+	}
+	return "audit.log"
+}
+
+// hash - sha256 of the previous hash and the entry (without its own hash)
+func (e AuditEntry) hash() string {
+	e.Hash = ""
+	data, _ := json.Marshal(e)
+	sum := sha256.Sum256(append([]byte(e.Prev), data...))
+	return hex.EncodeToString(sum[:])
+}
+
+// readAudit - all entries of the file, in order
+func readAudit(file string) ([]AuditEntry, error) {
+	var entries []AuditEntry
+	f, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return entries, nil
+		}
+		return entries, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return entries, fmt.Errorf("audit line %d %v", line, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// Append - chains the entry to the last one and writes it
+func (a *AuditLog) Append(e AuditEntry) (AuditEntry, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.read {
+		entries, err := readAudit(a.file)
+		if err != nil {
+			return e, err
+		}
+		if len(entries) > 0 {
+			a.seq = entries[len(entries)-1].Seq
+			a.prev = entries[len(entries)-1].Hash
+		}
+		a.read = true
+	}
+	e.Seq = a.seq + 1
+	if e.Time == 0 {
+		e.Time = time.Now().Unix()
+	}
+	e.Prev = a.prev
+	e.Hash = e.hash()
+	data, _ := json.Marshal(e)
+
+	f, err := os.OpenFile(a.file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return e, err
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return e, err
+	}
+	if err := f.Sync(); err != nil {
+		return e, err
+	}
+	a.seq = e.Seq
+	a.prev = e.Hash
+	return e, nil
+}
+
+// Query - the entries matching the filter, oldest first
+func (a *AuditLog) Query(filter AuditFilter) ([]AuditEntry, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	entries, err := readAudit(a.file)
+	if err != nil {
+		return nil, err
+	}
+	list := []AuditEntry{}
+	for _, e := range entries {
+		if (filter.Actor == "" || e.Actor == filter.Actor) && (filter.Action == "" || e.Action == filter.Action) &&
+			(filter.Since == 0 || e.Time >= filter.Since) && (filter.Until == 0 || e.Time <= filter.Until) {
+			list = append(list, e)
+		}
+	}
+	return list, nil
+}
+
+// verifyAudit - walks the chain, the error names the first entry that was tampered with
+func verifyAudit(file string) (int, error) {
+	entries, err := readAudit(file)
+	if err != nil {
+		return 0, err
+	}
+	prev := ""
+	for x, e := range entries {
+		if e.Seq != x+1 {
+			return x, fmt.Errorf("audit line %d sequence %d, wanted %d", x+1, e.Seq, x+1)
+		}
+		if e.Prev != prev {
+			return x, fmt.Errorf("audit line %d (seq %d) does not follow the entry before it", x+1, e.Seq)
+		}
+		if e.hash() != e.Hash {
+			return x, fmt.Errorf("audit line %d (seq %d) was modified", x+1, e.Seq)
+		}
+		prev = e.Hash
+	}
+	return len(entries), nil
+}
+
+// rawJson - the value for the before/after fields, nil stays empty
+func rawJson(v interface{}) json.RawMessage {
+	if v == nil {
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// recordAudit - appends the operation of the principal, failures are logged but never block the operation
+func recordAudit(p *Principal, source string, e AuditEntry, before interface{}, after interface{}, logger *Logger) {
+	e.Actor = "anonymous"
+	if p != nil {
+		e.Actor = p.Name
+		e.Method = p.Method
+	}
+	if host, _, err := net.SplitHostPort(source); err == nil {
+		source = host
+	}
+	e.Source = source
+	e.Before = rawJson(before)
+	e.After = rawJson(after)
+	if _, err := auditLog.Append(e); err != nil {
+		logger.Error("Audit", "action", e.Action, "error", err)
+	}
+}
+
+// auditRequest - recordAudit for the rest api, the principal and source ip come from the request
+func auditRequest(r *http.Request, e AuditEntry, before interface{}, after interface{}, logger *Logger) {
+	recordAudit(principal(r), r.RemoteAddr, e, before, after, logger)
+}
+
+// auditTime - unix seconds or RFC3339
+func auditTime(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	return t.Unix(), err
+}
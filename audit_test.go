@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAudit(t *testing.T) {
+	tmp, _ := ioutil.TempDir("", "audit")
+	defer os.RemoveAll(tmp)
+	file := filepath.Join(tmp, "audit.log")
+	logger := NewLogger("error", "text", os.Stdout)
+
+	audit := &AuditLog{file: file}
+	lmz := &Principal{Name: "lmz", Method: "token"}
+	bot := &Principal{Name: "ci-bot", Method: "token"}
+	entries := []struct {
+		Principal *Principal
+		Entry     AuditEntry
+	}{
+		{lmz, AuditEntry{Time: 100, Action: "force", Repo: "1"}},
+		{bot, AuditEntry{Time: 200, Action: "approve", Run: "r1", Target: "2"}},
+		{lmz, AuditEntry{Time: 300, Action: "project.update"}},
+	}
+	for _, e := range entries {
+		e.Entry.Actor = e.Principal.Name
+		e.Entry.Source = "127.0.0.1"
+		if _, err := audit.Append(e.Entry); err != nil {
+			t.Fatalf("Audit append %v", err)
+		}
+	}
+	// a new log (i.e. after a restart) continues the chain
+	defer func(a *AuditLog) { auditLog = a }(auditLog)
+	auditLog = &AuditLog{file: file}
+	recordAudit(lmz, "10.0.0.1:5000", AuditEntry{Time: 400, Action: "force", Repo: "2"}, Repository{Id: "2"}, Repository{Id: "2", Force: true}, logger)
+
+	// create anonymous struct
+	tests := []struct {
+		Name     string
+		Filter   AuditFilter
+		Want     string
+		ErrorMsg string
+	}{
+		{"Test audit : all", AuditFilter{}, "1 2 3 4", "Audit %s - got (%v) wanted (%v)"},
+		{"Test audit : actor", AuditFilter{Actor: "lmz"}, "1 3 4", "Audit %s - got (%v) wanted (%v)"},
+		{"Test audit : action", AuditFilter{Action: "force"}, "1 4", "Audit %s - got (%v) wanted (%v)"},
+		{"Test audit : time", AuditFilter{Since: 150, Until: 300}, "2 3", "Audit %s - got (%v) wanted (%v)"},
+	}
+
+	for _, tt := range tests {
+		fmt.Println(fmt.Sprintf("\nExecuting test : %s", tt.Name))
+		list, err := auditLog.Query(tt.Filter)
+		var seqs []string
+		for _, e := range list {
+			seqs = append(seqs, fmt.Sprint(e.Seq))
+		}
+		if err != nil || strings.Join(seqs, " ") != tt.Want {
+			t.Errorf(tt.ErrorMsg, tt.Name, seqs, tt.Want)
+		}
+		fmt.Println("")
+	}
+
+	list, _ := auditLog.Query(AuditFilter{Since: 400})
+	if len(list) != 1 || list[0].Source != "10.0.0.1" || string(list[0].After) == "" || list[0].Prev == "" {
+		t.Errorf("Audit record - got (%v) wanted (source 10.0.0.1 with before/after)", list)
+	}
+	if n, err := verifyAudit(file); n != 4 || err != nil {
+		t.Errorf("Audit verify - got (%d %v) wanted (4 nil)", n, err)
+	}
+
+	// tampering is detected at the first changed entry
+	data, _ := ioutil.ReadFile(file)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	edited := strings.Replace(lines[1], `"actor":"ci-bot"`, `"actor":"lmz"`, 1)
+	ioutil.WriteFile(file, []byte(strings.Join([]string{lines[0], edited, lines[2], lines[3]}, "\n")+"\n"), 0600)
+	if n, err := verifyAudit(file); n != 1 || err == nil {
+		t.Errorf("Audit verify edited - got (%d %v) wanted (1 error)", n, err)
+	}
+	ioutil.WriteFile(file, []byte(strings.Join([]string{lines[0], lines[2], lines[3]}, "\n")+"\n"), 0600)
+	if n, err := verifyAudit(file); n != 1 || err == nil {
+		t.Errorf("Audit verify removed - got (%d %v) wanted (1 error)", n, err)
+	}
+}
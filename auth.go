@@ -0,0 +1,410 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Principal - the authenticated caller
+type Principal struct {
+	Name   string   `json:"name"`
+	Groups []string `json:"groups,omitempty"`
+	Method string   `json:"method"`
+}
+
+// Authenticator - returns the principal of the request, nil (and no error) when the request
+// carries no credentials of this kind so that the next authenticator is tried
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// AuthUser - entry of the token (sha256 of the token, hex) and users (bcrypt hash of the password) files
+type AuthUser struct {
+	Name   string   `json:"name"`
+	Sha256 string   `json:"sha256,omitempty"`
+	Bcrypt string   `json:"bcrypt,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+}
+
+var (
+	errUnauthorized = errors.New("unauthorized")
+	authenticators  []Authenticator
+	// authOpen - paths that need no authentication (webhooks are verified with their own secret
+	// and stage callbacks with the run's callback token)
+	authOpen = []string{"/api/v2/sys/info/isalive", "/api/v2/web/", "/api/v1/webhooks/", "/api/v1/pipeline/"}
+)
+
+type principalKey struct{}
+
+// bearer - the bearer token of the request, websockets can't set headers from a browser
+// so the handshake may pass it as ?access_token=
+func bearer(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimPrefix(h, "Bearer ")
+	}
+	if websocketRequest(r) {
+		return r.URL.Query().Get("access_token")
+	}
+	return ""
+}
+
+func websocketRequest(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+func readAuthUsers(file string) ([]AuthUser, error) {
+	var users []AuthUser
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return users, err
+	}
+	err = json.Unmarshal(b, &users)
+	return users, err
+}
+
+// TokenAuthenticator - static api tokens, only their sha256 is kept on disk
+type TokenAuthenticator struct {
+	Users []AuthUser
+}
+
+func (a *TokenAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	token := bearer(r)
+	if token == "" || strings.Count(token, ".") == 2 {
+		// no token or a jwt
+		return nil, nil
+	}
+	sum := sha256.Sum256([]byte(token))
+	hash := hex.EncodeToString(sum[:])
+	for _, u := range a.Users {
+		if subtle.ConstantTimeCompare([]byte(strings.ToLower(u.Sha256)), []byte(hash)) == 1 {
+			return &Principal{Name: u.Name, Groups: u.Groups, Method: "token"}, nil
+		}
+	}
+	return nil, errUnauthorized
+}
+
+// BasicAuthenticator - http basic auth against bcrypt hashed passwords
+type BasicAuthenticator struct {
+	Users []AuthUser
+}
+
+func (a *BasicAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	name, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+	for _, u := range a.Users {
+		if u.Name == name && u.Bcrypt != "" {
+			if bcrypt.CompareHashAndPassword([]byte(u.Bcrypt), []byte(password)) != nil {
+				return nil, errUnauthorized
+			}
+			return &Principal{Name: u.Name, Groups: u.Groups, Method: "basic"}, nil
+		}
+	}
+	return nil, errUnauthorized
+}
+
+// JwtAuthenticator - oidc/jwt bearer tokens signed by a key of the jwks (file or url)
+type JwtAuthenticator struct {
+	Jwks        string
+	Issuer      string
+	Audience    string
+	NameClaim   string
+	GroupsClaim string
+	Client      *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]interface{}
+	fetched time.Time
+}
+
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// loadKeys - (re)reads the jwks at most once a minute, failed attempts included, so that
+// tokens with unknown key ids can't turn into a flood of fetches
+func (a *JwtAuthenticator) loadKeys(force bool) (map[string]interface{}, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.keys != nil && !force {
+		return a.keys, nil
+	}
+	if !a.fetched.IsZero() && time.Since(a.fetched) < time.Minute {
+		if a.keys == nil {
+			return nil, errors.New("jwks not loaded, next attempt in less than a minute")
+		}
+		return a.keys, nil
+	}
+	a.fetched = time.Now()
+	var b []byte
+	var err error
+	if u, e := url.Parse(a.Jwks); e == nil && (u.Scheme == "https" || u.Scheme == "http") {
+		client := a.Client
+		if client == nil {
+			client = &http.Client{Timeout: 10 * time.Second}
+		}
+		resp, e := client.Get(a.Jwks)
+		if e != nil {
+			return a.keys, e
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return a.keys, errors.New("jwks fetch returned " + resp.Status)
+		}
+		b, err = ioutil.ReadAll(resp.Body)
+	} else {
+		b, err = ioutil.ReadFile(a.Jwks)
+	}
+	if err != nil {
+		return a.keys, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err = json.Unmarshal(b, &set); err != nil {
+		return a.keys, err
+	}
+	keys := map[string]interface{}{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if key, err := k.publicKey(); err == nil {
+			keys[k.Kid] = key
+		}
+	}
+	a.keys = keys
+	return keys, nil
+}
+
+func (k jwk) publicKey() (interface{}, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		return new(big.Int).SetBytes(b), err
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, errors.New("unsupported curve " + k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, errors.New("unsupported key type " + k.Kty)
+}
+
+func (a *JwtAuthenticator) keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	keys, err := a.loadKeys(false)
+	if key, ok := keys[kid]; ok && err == nil {
+		return key, nil
+	}
+	// unknown kid, the keys may have been rotated
+	if keys, err = a.loadKeys(true); err != nil {
+		return nil, err
+	}
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, errors.New("unknown key id " + kid)
+}
+
+func (a *JwtAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	token := bearer(r)
+	if strings.Count(token, ".") != 2 {
+		return nil, nil
+	}
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(30 * time.Second),
+	}
+	if a.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(a.Issuer))
+	}
+	if a.Audience != "" {
+		opts = append(opts, jwt.WithAudience(a.Audience))
+	}
+	claims := jwt.MapClaims{}
+	if _, err := jwt.ParseWithClaims(token, claims, a.keyfunc, opts...); err != nil {
+		return nil, err
+	}
+	p := &Principal{Method: "jwt"}
+	for _, c := range []string{a.NameClaim, "preferred_username", "sub"} {
+		if name, ok := claims[c].(string); ok && name != "" {
+			p.Name = name
+			break
+		}
+	}
+	groupsClaim := a.GroupsClaim
+	if groupsClaim == "" {
+		groupsClaim = "groups"
+	}
+	if groups, ok := claims[groupsClaim].([]interface{}); ok {
+		for _, g := range groups {
+			if s, ok := g.(string); ok {
+				p.Groups = append(p.Groups, s)
+			}
+		}
+	}
+	return p, nil
+}
+
+// newAuthenticators - AUTH_TOKENS_FILE, AUTH_USERS_FILE and OIDC_JWKS (file or url, with OIDC_ISSUER,
+// OIDC_AUDIENCE, OIDC_NAME_CLAIM, OIDC_GROUPS_CLAIM) each enable an authenticator
+func newAuthenticators(logger *Logger) []Authenticator {
+	auths := []Authenticator{}
+	if file := os.Getenv("AUTH_TOKENS_FILE"); file != "" {
+		users, err := readAuthUsers(file)
+		if err != nil {
+			logger.Error("Auth : tokens", "file", file, "error", err)
+		}
+		auths = append(auths, &TokenAuthenticator{Users: users})
+	}
+	if file := os.Getenv("AUTH_USERS_FILE"); file != "" {
+		users, err := readAuthUsers(file)
+		if err != nil {
+			logger.Error("Auth : users", "file", file, "error", err)
+		}
+		auths = append(auths, &BasicAuthenticator{Users: users})
+	}
+	if jwks := os.Getenv("OIDC_JWKS"); jwks != "" {
+		auths = append(auths, &JwtAuthenticator{
+			Jwks:        jwks,
+			Issuer:      os.Getenv("OIDC_ISSUER"),
+			Audience:    os.Getenv("OIDC_AUDIENCE"),
+			NameClaim:   os.Getenv("OIDC_NAME_CLAIM"),
+			GroupsClaim: os.Getenv("OIDC_GROUPS_CLAIM"),
+		})
+	}
+	if len(auths) == 0 {
+		logger.Warn("Auth : no authenticator configured, the api and websocket are open")
+	}
+	return auths
+}
+
+// authenticate - the first authenticator that recognises the credentials decides,
+// with no authenticator configured everyone is anonymous
+func authenticate(r *http.Request, auths []Authenticator) (*Principal, error) {
+	if len(auths) == 0 {
+		return &Principal{Name: "anonymous", Method: "none"}, nil
+	}
+	for _, a := range auths {
+		p, err := a.Authenticate(r)
+		if err != nil {
+			return nil, errUnauthorized
+		}
+		if p != nil {
+			return p, nil
+		}
+	}
+	return nil, errUnauthorized
+}
+
+// authMiddleware - rejects unauthenticated requests (except authOpen and cors preflight)
+// and adds the principal to the request context
+func authMiddleware(logger *Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, p := range authOpen {
+				if r.URL.Path == p || (strings.HasSuffix(p, "/") && strings.HasPrefix(r.URL.Path, p)) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			if r.Method == http.MethodOptions {
+				next.ServeHTTP(w, r)
+				return
+			}
+			p, err := authenticate(r, authenticators)
+			if err != nil {
+				logger.Warn("Auth : rejected", "path", r.URL.Path, "remote", r.RemoteAddr)
+				addHeaders(w, r)
+				w.Header().Set("WWW-Authenticate", `Bearer realm="cicd"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(`{"statuscode":"401","status":"KO","message":"unauthorized"}`))
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+		})
+	}
+}
+
+// principal - the authenticated caller of the request (nil outside authMiddleware)
+func principal(r *http.Request) *Principal {
+	p, _ := r.Context().Value(principalKey{}).(*Principal)
+	return p
+}
+
+// approverName - the authenticated user approves, the name in the request only counts without authentication
+func approverName(p *Principal, claimed string) string {
+	if p == nil || p.Method == "none" {
+		return claimed
+	}
+	return p.Name
+}
+
+// allowedOrigin - ALLOWED_ORIGINS is a comma separated list of origins (scheme://host[:port]),
+// without it only same host origins are allowed, requests without an Origin (non browser) always are
+func allowedOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if os.Getenv("ALLOWED_ORIGINS") == "" {
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+	for _, o := range strings.Split(os.Getenv("ALLOWED_ORIGINS"), ",") {
+		if strings.TrimSpace(o) == "*" || strings.EqualFold(strings.TrimSuffix(strings.TrimSpace(o), "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
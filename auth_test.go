@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAuthenticators(t *testing.T) {
+	tmp, _ := ioutil.TempDir("", "auth")
+	defer os.RemoveAll(tmp)
+
+	// static token and bcrypt user
+	sum := sha256.Sum256([]byte("s3cret-token"))
+	hash, _ := bcrypt.GenerateFromPassword([]byte("passw0rd"), bcrypt.MinCost)
+	tokens := &TokenAuthenticator{Users: []AuthUser{{Name: "ci-bot", Sha256: hex.EncodeToString(sum[:]), Groups: []string{"bots"}}}}
+	users := &BasicAuthenticator{Users: []AuthUser{{Name: "lmz", Bcrypt: string(hash)}}}
+
+	// jwks with one rsa key
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	jwks := fmt.Sprintf(`{"keys":[{"kty":"RSA","kid":"k1","use":"sig","n":"%s","e":"%s"}]}`,
+		base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()))
+	ioutil.WriteFile(filepath.Join(tmp, "jwks.json"), []byte(jwks), 0600)
+	oidc := &JwtAuthenticator{Jwks: filepath.Join(tmp, "jwks.json"), Issuer: "https://idp.example.com", Audience: "cicd"}
+	sign := func(kid string, claims jwt.MapClaims) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = kid
+		s, _ := token.SignedString(key)
+		return s
+	}
+	valid := jwt.MapClaims{"iss": "https://idp.example.com", "aud": "cicd", "sub": "u1", "preferred_username": "alice", "groups": []string{"devs"}, "exp": time.Now().Add(time.Hour).Unix()}
+	expired := jwt.MapClaims{"iss": "https://idp.example.com", "aud": "cicd", "sub": "u1", "exp": time.Now().Add(-time.Hour).Unix()}
+	auths := []Authenticator{tokens, users, oidc}
+
+	// create anonymous struct
+	tests := []struct {
+		Name     string
+		Header   string
+		Value    string
+		Want     string
+		ErrorMsg string
+	}{
+		{"Test auth : static token", "Authorization", "Bearer s3cret-token", "ci-bot token [bots]", "Auth %s - got (%v) wanted (%v)"},
+		{"Test auth : wrong token", "Authorization", "Bearer nope", "unauthorized", "Auth %s - got (%v) wanted (%v)"},
+		{"Test auth : basic", "Authorization", "Basic " + base64.StdEncoding.EncodeToString([]byte("lmz:passw0rd")), "lmz basic []", "Auth %s - got (%v) wanted (%v)"},
+		{"Test auth : basic wrong password", "Authorization", "Basic " + base64.StdEncoding.EncodeToString([]byte("lmz:guess")), "unauthorized", "Auth %s - got (%v) wanted (%v)"},
+		{"Test auth : jwt", "Authorization", "Bearer " + sign("k1", valid), "alice jwt [devs]", "Auth %s - got (%v) wanted (%v)"},
+		{"Test auth : jwt expired", "Authorization", "Bearer " + sign("k1", expired), "unauthorized", "Auth %s - got (%v) wanted (%v)"},
+		{"Test auth : jwt unknown key", "Authorization", "Bearer " + sign("k2", valid), "unauthorized", "Auth %s - got (%v) wanted (%v)"},
+		{"Test auth : no credentials", "", "", "unauthorized", "Auth %s - got (%v) wanted (%v)"},
+	}
+
+	for _, tt := range tests {
+		fmt.Println(fmt.Sprintf("\nExecuting test : %s", tt.Name))
+		r := httptest.NewRequest("GET", "/api/v1/runs", nil)
+		if tt.Header != "" {
+			r.Header.Set(tt.Header, tt.Value)
+		}
+		got := ""
+		p, err := authenticate(r, auths)
+		if err != nil {
+			got = err.Error()
+		} else {
+			got = fmt.Sprintf("%s %s %v", p.Name, p.Method, p.Groups)
+		}
+		if got != tt.Want {
+			t.Errorf(tt.ErrorMsg, tt.Name, got, tt.Want)
+		}
+		fmt.Println("")
+	}
+
+	// middleware, open paths and the websocket access_token
+	authenticators = auths
+	defer func() { authenticators = nil }()
+	handler := authMiddleware(NewLogger("error", "text", ioutil.Discard))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, principal(r))
+	}))
+	for path, want := range map[string]int{"/api/v1/runs": 401, "/api/v2/sys/info/isalive": 200, "/api/v1/webhooks/1": 200} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != want {
+			t.Errorf("Auth middleware %s - got (%v) wanted (%v)", path, w.Code, want)
+		}
+	}
+	r := httptest.NewRequest("GET", "/api/v1/websocket/streamdata?access_token=s3cret-token", nil)
+	r.Header.Set("Upgrade", "websocket")
+	if p, err := authenticate(r, auths); err != nil || p.Name != "ci-bot" {
+		t.Errorf("Auth websocket - got (%v %v) wanted (%v)", p, err, "ci-bot")
+	}
+}
+
+func TestJwksRefresh(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	jwks := fmt.Sprintf(`{"keys":[{"kty":"RSA","kid":"k1","use":"sig","n":"%s","e":"%s"}]}`,
+		base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()))
+	var hits, up int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		if atomic.LoadInt32(&up) == 0 {
+			http.Error(w, "down", http.StatusBadGateway)
+			return
+		}
+		fmt.Fprint(w, jwks)
+	}))
+	defer srv.Close()
+	oidc := &JwtAuthenticator{Jwks: srv.URL, Issuer: "https://idp.example.com", Audience: "cicd"}
+	claims := jwt.MapClaims{"iss": "https://idp.example.com", "aud": "cicd", "sub": "u1", "exp": time.Now().Add(time.Hour).Unix()}
+	auth := func(kid string) error {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = kid
+		s, _ := token.SignedString(key)
+		r := httptest.NewRequest("GET", "/api/v1/runs", nil)
+		r.Header.Set("Authorization", "Bearer "+s)
+		_, err := oidc.Authenticate(r)
+		return err
+	}
+
+	// create anonymous struct
+	tests := []struct {
+		Name     string
+		Up       int32
+		Elapsed  time.Duration
+		Kid      string
+		Hits     int32
+		Authn    bool
+		ErrorMsg string
+	}{
+		{"Test jwks : failing endpoint", 0, 0, "k1", 1, false, "Jwks %s - got (%v) wanted (%v)"},
+		{"Test jwks : failure is not retried within a minute", 1, 0, "k1", 1, false, "Jwks %s - got (%v) wanted (%v)"},
+		{"Test jwks : retried after a minute", 1, 2 * time.Minute, "k1", 2, true, "Jwks %s - got (%v) wanted (%v)"},
+		{"Test jwks : unknown key ids within a minute", 1, 0, "rotated", 2, false, "Jwks %s - got (%v) wanted (%v)"},
+		{"Test jwks : unknown key id after a minute", 1, 2 * time.Minute, "rotated", 3, false, "Jwks %s - got (%v) wanted (%v)"},
+	}
+
+	for _, tt := range tests {
+		fmt.Println(fmt.Sprintf("\nExecuting test : %s", tt.Name))
+		atomic.StoreInt32(&up, tt.Up)
+		oidc.mu.Lock()
+		oidc.fetched = oidc.fetched.Add(-tt.Elapsed)
+		oidc.mu.Unlock()
+		// a flood of requests is at most one fetch
+		var err error
+		for x := 0; x < 20; x++ {
+			err = auth(tt.Kid)
+		}
+		if got := atomic.LoadInt32(&hits); got != tt.Hits || (err == nil) != tt.Authn {
+			t.Errorf(tt.ErrorMsg, tt.Name, fmt.Sprint(got, " ", err), tt.Hits)
+		}
+		fmt.Println("")
+	}
+}
+
+func TestAllowedOrigin(t *testing.T) {
+	defer os.Unsetenv("ALLOWED_ORIGINS")
+	r := httptest.NewRequest("GET", "http://cicd.example.com/api/v1/websocket/streamdata", nil)
+	for _, tt := range []struct {
+		Allowed string
+		Origin  string
+		Want    bool
+	}{
+		{"", "", true},
+		{"", "http://cicd.example.com", true},
+		{"", "http://evil.example.com", false},
+		{"https://dashboard.example.com, http://localhost:3000", "http://localhost:3000", true},
+		{"https://dashboard.example.com", "http://cicd.example.com", false},
+	} {
+		os.Setenv("ALLOWED_ORIGINS", tt.Allowed)
+		r.Header.Set("Origin", tt.Origin)
+		if got := allowedOrigin(r); got != tt.Want {
+			t.Errorf("Origin %s allowed %s - got (%v) wanted (%v)", tt.Origin, tt.Allowed, got, tt.Want)
+		}
+	}
+}
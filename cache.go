@@ -0,0 +1,309 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	hashFilesPattern = regexp.MustCompile(`\$\{\{\s*hashFiles\(([^)]*)\)\s*\}\}`)
+)
+
+// cacheDir - where the cache tarballs are kept (CACHE_DIR, default cache)
+func cacheDir() string {
+	if os.Getenv("CACHE_DIR") != "" {
+		return os.Getenv("CACHE_DIR")
+	}
+	return "cache"
+}
+
+// cacheMaxSize - total size of the cache before the least recently used entries are evicted (CACHE_MAX_SIZE, default 1GB)
+func cacheMaxSize() int64 {
+	if os.Getenv("CACHE_MAX_SIZE") != "" {
+		size, err := strconv.ParseInt(os.Getenv("CACHE_MAX_SIZE"), 10, 64)
+		if err == nil {
+			return size
+		}
+	}
+	return 1 << 30
+}
+
+// cacheKey - expands the key template, ${{ hashFiles('go.sum', '**/go.sum') }} is replaced by the sha256 of the matching files
+func cacheKey(template string, workDirPath string, vars map[string]string) (string, error) {
+	var err error
+	key := hashFilesPattern.ReplaceAllStringFunc(template, func(m string) string {
+		h := sha256.New()
+		for _, arg := range strings.Split(hashFilesPattern.FindStringSubmatch(m)[1], ",") {
+			pattern := strings.Trim(strings.TrimSpace(arg), `'"`)
+			matches, e := globFiles(workDirPath, pattern)
+			if e != nil {
+				err = e
+				return m
+			}
+			sort.Strings(matches)
+			for _, match := range matches {
+				data, e := ioutil.ReadFile(match)
+				if e != nil {
+					err = e
+					return m
+				}
+				h.Write(data)
+			}
+		}
+		return hex.EncodeToString(h.Sum(nil))
+	})
+	return interpolate(key, vars), err
+}
+
+// globFiles - the files matching the pattern under root, ** matches any number of directories (like the
+// pipeline paths)
+func globFiles(root string, pattern string) ([]string, error) {
+	if !strings.Contains(pattern, "**") {
+		return filepath.Glob(filepath.Join(root, pattern))
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	var matches []string
+	err := filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, _ := filepath.Rel(root, file)
+		if matchPath(filepath.ToSlash(pattern), filepath.ToSlash(rel)) {
+			matches = append(matches, file)
+		}
+		return nil
+	})
+	return matches, err
+}
+
+func cacheFile(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(cacheDir(), hex.EncodeToString(sum[:])+".tar.gz")
+}
+
+// cachePaths - relative paths are resolved against the workspace, absolute ones (i.e. $GOPATH/pkg/mod) are used as is
+func cachePaths(cache *CacheDetail, workDirPath string) []string {
+	var paths []string
+	for _, p := range cache.Paths {
+		p = os.ExpandEnv(p)
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(workDirPath, p)
+		}
+		paths = append(paths, p)
+	}
+	return paths
+}
+
+// restoreCache - extracts the tarball for the key if present, returns true on a hit
+func restoreCache(key string, paths []string, logger *Logger) (bool, error) {
+	file := cacheFile(key)
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	// mark as recently used
+	os.Chtimes(file, time.Now(), time.Now())
+	if err := extractCache(f, paths); err != nil {
+		return false, err
+	}
+	logger.Info("Cache : restored", "key", key)
+	return true, nil
+}
+
+// readCache - the tarball for the key (for the agents), nil when there is none
+func readCache(key string) ([]byte, error) {
+	file := cacheFile(key)
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err == nil {
+		os.Chtimes(file, time.Now(), time.Now())
+	}
+	return data, err
+}
+
+// extractCache - extracts a cache tarball into the paths. The tree is written with owner write access (over a
+// previous restore too) and the archived modes are applied at the end, i.e. the read-only go module cache
+func extractCache(r io.Reader, paths []string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	dirs := map[string]os.FileMode{}
+	defer func() {
+		names := make([]string, 0, len(dirs))
+		for dir := range dirs {
+			names = append(names, dir)
+		}
+		// deepest first
+		sort.Sort(sort.Reverse(sort.StringSlice(names)))
+		for _, dir := range names {
+			os.Chmod(dir, dirs[dir])
+		}
+	}()
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		// entries are named <index of path>/<relative name>
+		parts := strings.SplitN(hdr.Name, "/", 2)
+		idx, err := strconv.Atoi(parts[0])
+		if err != nil || idx >= len(paths) || len(parts) != 2 {
+			return errors.New("unexpected cache entry " + hdr.Name)
+		}
+		dest := filepath.Join(paths[idx], filepath.FromSlash(parts[1]))
+		if !strings.HasPrefix(dest, filepath.Clean(paths[idx])+string(os.PathSeparator)) {
+			return errors.New("cache entry " + hdr.Name + " escapes " + paths[idx])
+		}
+		mode := os.FileMode(hdr.Mode).Perm()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(dest, os.ModePerm); err != nil {
+				return err
+			}
+			if err := os.Chmod(dest, mode|0700); err != nil {
+				return err
+			}
+			dirs[dest] = mode
+		case tar.TypeReg:
+			os.MkdirAll(filepath.Dir(dest), os.ModePerm)
+			// a read-only file of a previous restore
+			os.Chmod(dest, mode|0600)
+			out, err := os.OpenFile(dest, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode|0600)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(out, tr)
+			out.Close()
+			if err == nil {
+				err = os.Chmod(dest, mode)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// saveCache - archives the paths under the key and evicts the least recently used entries
+func saveCache(key string, paths []string, logger *Logger) error {
+	return writeCache(key, func(w io.Writer) error { return archiveCache(w, paths) }, logger)
+}
+
+// writeCache - stores the tarball written by fn under the key and evicts the least recently used entries
+func writeCache(key string, fn func(io.Writer) error, logger *Logger) error {
+	os.MkdirAll(cacheDir(), os.ModePerm)
+	tmp, err := ioutil.TempFile(cacheDir(), ".save")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	err = fn(tmp)
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), cacheFile(key)); err != nil {
+		return err
+	}
+	logger.Info("Cache : saved", "key", key)
+	evictCache(logger)
+	return nil
+}
+
+// archiveCache - writes the tarball of the paths, missing paths are skipped
+func archiveCache(w io.Writer, paths []string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for idx, base := range paths {
+		err := filepath.Walk(base, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() && !info.Mode().IsRegular() {
+				return nil
+			}
+			rel, _ := filepath.Rel(base, path)
+			if rel == "." {
+				return nil
+			}
+			hdr, err := tar.FileInfoHeader(info, "")
+			if err != nil {
+				return err
+			}
+			hdr.Name = strconv.Itoa(idx) + "/" + filepath.ToSlash(rel)
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = io.Copy(tw, f)
+			return err
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// evictCache - removes the least recently used tarballs until the cache fits in CACHE_MAX_SIZE
+func evictCache(logger *Logger) {
+	var total int64
+	files, err := ioutil.ReadDir(cacheDir())
+	if err != nil {
+		return
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().After(files[j].ModTime()) })
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".tar.gz") {
+			continue
+		}
+		total += f.Size()
+		if total > cacheMaxSize() {
+			logger.Debug("Cache : evicting", "file", f.Name())
+			os.Remove(filepath.Join(cacheDir(), f.Name()))
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	tmp, _ := ioutil.TempDir("", "cache")
+	defer os.RemoveAll(tmp)
+	os.Setenv("CACHE_DIR", filepath.Join(tmp, "cache"))
+	defer os.Unsetenv("CACHE_DIR")
+	logger := NewLogger("error", "text", os.Stdout)
+
+	work := filepath.Join(tmp, "work")
+	os.MkdirAll(filepath.Join(work, "tools", "lint"), os.ModePerm)
+	ioutil.WriteFile(filepath.Join(work, "go.sum"), []byte("root"), 0644)
+	ioutil.WriteFile(filepath.Join(work, "tools", "lint", "go.sum"), []byte("lint"), 0644)
+	vars := map[string]string{"branch": "master"}
+	root, _ := cacheKey("${{ hashFiles('go.sum') }}", work, vars)
+
+	// create anonymous struct
+	tests := []struct {
+		Name     string
+		Template string
+		Change   string
+		Same     bool
+		ErrorMsg string
+	}{
+		{"Test cache key : variables", "gomod-${{ branch }}", "", true, "Cache key %s - got (%v) wanted (%v)"},
+		{"Test cache key : nested file", "gomod-${{ hashFiles('go.sum') }}", "tools/lint/go.sum", true, "Cache key %s - got (%v) wanted (%v)"},
+		{"Test cache key : recursive pattern", "gomod-${{ hashFiles('**/go.sum') }}", "tools/lint/go.sum", false, "Cache key %s - got (%v) wanted (%v)"},
+		{"Test cache key : recursive pattern root", "gomod-${{ hashFiles('**/go.sum') }}", "go.sum", false, "Cache key %s - got (%v) wanted (%v)"},
+		{"Test cache key : two patterns", "gomod-${{ hashFiles('go.sum', 'tools/*/go.sum') }}", "tools/lint/go.sum", false, "Cache key %s - got (%v) wanted (%v)"},
+	}
+
+	for _, tt := range tests {
+		fmt.Println(fmt.Sprintf("\nExecuting test : %s", tt.Name))
+		before, err := cacheKey(tt.Template, work, vars)
+		if err != nil || strings.Contains(before, "${{") || !strings.HasPrefix(before, "gomod-") {
+			t.Errorf(tt.ErrorMsg, tt.Name, before, "an expanded key")
+		}
+		if tt.Change != "" {
+			ioutil.WriteFile(filepath.Join(work, tt.Change), []byte(tt.Name), 0644)
+		}
+		after, _ := cacheKey(tt.Template, work, vars)
+		if (before == after) != tt.Same {
+			t.Errorf(tt.ErrorMsg, tt.Name, after, before)
+		}
+		fmt.Println("")
+	}
+	if got, _ := cacheKey("${{ hashFiles('go.sum') }}", work, vars); got == root {
+		t.Errorf("Cache key - got (%v) wanted (a new key after go.sum changed)", got)
+	}
+
+	// save and restore a read-only tree (the go module cache), twice over the same paths
+	mod := filepath.Join(tmp, "mod")
+	os.MkdirAll(filepath.Join(mod, "example.com", "lib@v1"), os.ModePerm)
+	ioutil.WriteFile(filepath.Join(mod, "example.com", "lib@v1", "lib.go"), []byte("package lib"), 0444)
+	os.Chmod(filepath.Join(mod, "example.com", "lib@v1"), 0555)
+	if err := saveCache("gomod", []string{mod}, logger); err != nil {
+		t.Fatalf("Cache save - got (%v) wanted (nil)", err)
+	}
+	dest := filepath.Join(tmp, "restored")
+	for x := 0; x < 2; x++ {
+		if hit, err := restoreCache("gomod", []string{dest}, logger); !hit || err != nil {
+			t.Errorf("Cache restore %d - got (%v %v) wanted (hit)", x, hit, err)
+		}
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(dest, "example.com", "lib@v1", "lib.go")); string(b) != "package lib" {
+		t.Errorf("Cache restore - got (%q) wanted (package lib)", b)
+	}
+	if info, err := os.Stat(filepath.Join(dest, "example.com", "lib@v1")); err != nil || info.Mode().Perm() != 0555 {
+		t.Errorf("Cache restore mode - got (%v %v) wanted (0555)", info, err)
+	}
+	if hit, err := restoreCache("nope", []string{dest}, logger); hit || err != nil {
+		t.Errorf("Cache miss - got (%v %v) wanted (miss)", hit, err)
+	}
+	filepath.Walk(tmp, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			os.Chmod(path, 0755)
+		}
+		return nil
+	})
+
+	// least recently used entries go first
+	for _, key := range []string{"a", "b", "c"} {
+		ioutil.WriteFile(filepath.Join(work, "data"), []byte(strings.Repeat(key, 4096)), 0644)
+		saveCache(key, []string{work}, logger)
+	}
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(cacheFile("a"), old, old)
+	os.Chtimes(cacheFile("b"), old.Add(time.Minute), old.Add(time.Minute))
+	os.Chtimes(cacheFile("gomod"), old, old)
+	restoreCache("a", []string{filepath.Join(tmp, "a")}, logger)
+	info, _ := os.Stat(cacheFile("a"))
+	os.Setenv("CACHE_MAX_SIZE", fmt.Sprint(info.Size()*2+info.Size()/2))
+	defer os.Unsetenv("CACHE_MAX_SIZE")
+	evictCache(logger)
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true, "gomod": false} {
+		if _, err := os.Stat(cacheFile(key)); (err == nil) != want {
+			t.Errorf("Cache eviction %s - got (%v) wanted (%v)", key, err == nil, want)
+		}
+	}
+}
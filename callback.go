@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StageReport - status (and log lines) of a stage reported by an external system
+type StageReport struct {
+	Status string
+	Log    string
+}
+
+// StageEvent - json event broadcast to the dashboards for reported stage logs
+type StageEvent struct {
+	Event  string `json:"event"`
+	Run    string `json:"run"`
+	Stage  int    `json:"stage"`
+	Status string `json:"status"`
+	Log    string `json:"log,omitempty"`
+}
+
+var (
+	callbacks = struct {
+		sync.Mutex
+		pending map[string]callbackWait
+	}{pending: map[string]callbackWait{}}
+
+	// reported statuses, failure and failed are errors too
+	callbackStatuses = map[string]string{"pending": "pending", "running": "running", "success": "success", "error": "error", "failure": "error", "failed": "error"}
+
+	errNotWaiting = errors.New("stage is not waiting for a callback")
+)
+
+type callbackWait struct {
+	ch chan StageReport
+}
+
+// newCallbackToken - the per run secret the stages pass on to the external systems
+func newCallbackToken() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// callbackUrl - where the stage status is reported, POST <url>/<status> with the log as body
+func callbackUrl(run *Run, stage StageDetail) string {
+	return strings.TrimSuffix(os.Getenv("PUBLIC_URL"), "/") + "/api/v1/pipeline/" + run.RepoId + "/" + run.Id + "/" + strconv.Itoa(stage.Id)
+}
+
+// waitForCallback - keeps a callback stage open until a success or error report arrives or the (optional) expiry
+// passes, the reports are recorded on the run, appended to the stage log and broadcast
+func waitForCallback(run *Run, stage StageDetail, logger *Logger) error {
+	var expired <-chan time.Time
+	ch := make(chan StageReport, 16)
+	key := approvalKey(run.Id, stage.Id)
+
+	callbacks.Lock()
+	callbacks.pending[key] = callbackWait{ch: ch}
+	callbacks.Unlock()
+	defer func() {
+		callbacks.Lock()
+		delete(callbacks.pending, key)
+		callbacks.Unlock()
+	}()
+
+	if stage.Expiry > 0 {
+		expired = time.After(time.Duration(stage.Expiry) * time.Second)
+	}
+	logger.Info("Callback : waiting for status")
+	for {
+		select {
+		case report := <-ch:
+			if report.Log != "" {
+				appendStageLog(run.Id, stage.Id, report.Log)
+			}
+			b, _ := json.Marshal(StageEvent{Event: "stage.callback", Run: run.Id, Stage: stage.Id, Status: report.Status, Log: report.Log})
+			broadcastRepo(run.RepoId, "logs", string(b), logger)
+			logger.Info("Callback : reported", "status", report.Status)
+			switch report.Status {
+			case "success":
+				return nil
+			case "error":
+				return errors.New("stage " + stage.Name + " reported error")
+			default:
+				stageStatus(run, stage.Id, report.Status, logger)
+			}
+		case <-expired:
+			appendStageLog(run.Id, stage.Id, "callback expired\n")
+			return errors.New("stage " + stage.Name + " callback expired")
+		}
+	}
+}
+
+// checkCallbackToken - the token is the run's callback token
+func checkCallbackToken(run Run, token string) error {
+	if token == "" || run.callback == "" || subtle.ConstantTimeCompare([]byte(token), []byte(run.callback)) != 1 {
+		return errUnauthorized
+	}
+	return nil
+}
+
+// reportCallback - delivers the report to the waiting stage when the token is the run's callback token, the token
+// is checked first so that callers without it can't tell which stage is waiting
+func reportCallback(run Run, stageId int, token string, report StageReport) error {
+	if err := checkCallbackToken(run, token); err != nil {
+		return err
+	}
+	status, ok := callbackStatuses[report.Status]
+	if !ok {
+		return fmt.Errorf("unknown status %s", report.Status)
+	}
+	report.Status = status
+	callbacks.Lock()
+	wait, ok := callbacks.pending[approvalKey(run.Id, stageId)]
+	callbacks.Unlock()
+	if !ok {
+		return errNotWaiting
+	}
+	select {
+	case wait.ch <- report:
+		return nil
+	default:
+		return errors.New("too many pending reports")
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestCallbacks(t *testing.T) {
+	tmp, _ := ioutil.TempDir("", "runs")
+	defer os.RemoveAll(tmp)
+	defer func(s *RunStore) { runStore = s }(runStore)
+	runStore = &RunStore{runs: map[string]*Run{}, dir: tmp}
+	defer func(a *AuditLog) { auditLog = a }(auditLog)
+	auditLog = &AuditLog{file: tmp + "/audit.log"}
+	logger := NewLogger("error", "text", os.Stdout)
+
+	run := runStore.Create("callback-test", Repository{Id: "1"}, &Pipeline{Id: "api", Stages: []StageDetail{{Id: 1, Name: "Build"}, {Id: 2, Name: "Deploy", Type: "callback"}}}, "abc123")
+	run.callback = newCallbackToken()
+	runStore.Save(run)
+	defer os.Remove(LOGSDIR)
+	defer os.RemoveAll(LOGSDIR + "/" + run.Id)
+	done := make(chan error, 1)
+	go func() { done <- waitForCallback(run, StageDetail{Id: 2, Name: "Deploy", Type: "callback"}, logger) }()
+	for {
+		callbacks.Lock()
+		_, ok := callbacks.pending[approvalKey(run.Id, 2)]
+		callbacks.Unlock()
+		if ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/api/v1/pipeline/{repo}/{run}/{stage}/{status}", func(w http.ResponseWriter, req *http.Request) {
+		PipelineStatusHandler(w, req, logger)
+	}).Methods("POST")
+
+	// create anonymous struct
+	tests := []struct {
+		Name     string
+		Path     string
+		Token    string
+		Log      string
+		Want     int
+		ErrorMsg string
+	}{
+		{"Test callback : wrong token", "/1/callback-test/2/running", "nope", "", http.StatusUnauthorized, "Callback %s - got (%v) wanted (%v)"},
+		{"Test callback : no token for a stage not waiting", "/1/callback-test/1/running", "", "", http.StatusUnauthorized, "Callback %s - got (%v) wanted (%v)"},
+		{"Test callback : no token for an unknown stage", "/1/callback-test/Test/running", "nope", "", http.StatusUnauthorized, "Callback %s - got (%v) wanted (%v)"},
+		{"Test callback : no token for an unknown run", "/1/nope/2/running", "nope", "", http.StatusUnauthorized, "Callback %s - got (%v) wanted (%v)"},
+		{"Test callback : stage not waiting", "/1/callback-test/1/running", run.callback, "", http.StatusConflict, "Callback %s - got (%v) wanted (%v)"},
+		{"Test callback : wrong repository", "/2/callback-test/2/running", run.callback, "", http.StatusNotFound, "Callback %s - got (%v) wanted (%v)"},
+		{"Test callback : unknown stage", "/1/callback-test/Test/running", run.callback, "", http.StatusNotFound, "Callback %s - got (%v) wanted (%v)"},
+		{"Test callback : unknown status", "/1/callback-test/2/done", run.callback, "", http.StatusBadRequest, "Callback %s - got (%v) wanted (%v)"},
+		{"Test callback : stage not waiting", "/1/callback-test/Build/running", run.callback, "", http.StatusConflict, "Callback %s - got (%v) wanted (%v)"},
+		{"Test callback : running by stage name", "/1/callback-test/deploy/running", run.callback, "rolling out 1/3\n", http.StatusAccepted, "Callback %s - got (%v) wanted (%v)"},
+		{"Test callback : success", "/1/callback-test/2/success", run.callback, "rolled out 3/3\n", http.StatusAccepted, "Callback %s - got (%v) wanted (%v)"},
+	}
+
+	for _, tt := range tests {
+		fmt.Println(fmt.Sprintf("\nExecuting test : %s", tt.Name))
+		req := httptest.NewRequest("POST", "/api/v1/pipeline"+tt.Path, strings.NewReader(tt.Log))
+		req.Header.Set("Authorization", "Bearer "+tt.Token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tt.Want {
+			t.Errorf(tt.ErrorMsg, tt.Name, w.Code, tt.Want)
+		}
+		if tt.Want == http.StatusAccepted && strings.HasSuffix(tt.Path, "running") {
+			// applied in order by the waiting stage
+			for x := 0; x < 100; x++ {
+				if got, _ := runStore.Get(run.Id); got.Stages[1].Status == "running" {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if got, _ := runStore.Get(run.Id); got.Stages[1].Status != "running" {
+				t.Errorf(tt.ErrorMsg, tt.Name, got.Stages[1].Status, "running")
+			}
+		}
+		fmt.Println("")
+	}
+
+	if err := <-done; err != nil {
+		t.Errorf("Callback wait - got (%v) wanted (nil)", err)
+	}
+	if b, _ := ioutil.ReadFile(stageLogPath(run.Id, 2)); string(b) != "rolling out 1/3\nrolled out 3/3\n" {
+		t.Errorf("Callback log - got (%q) wanted (both reports)", string(b))
+	}
+	if err := reportCallback(*run, 2, run.callback, StageReport{Status: "error"}); err != errNotWaiting {
+		t.Errorf("Callback after success - got (%v) wanted (%v)", err, errNotWaiting)
+	}
+	if err := reportCallback(*run, 2, "nope", StageReport{Status: "error"}); err != errUnauthorized {
+		t.Errorf("Callback after success without the token - got (%v) wanted (%v)", err, errUnauthorized)
+	}
+}
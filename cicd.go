@@ -2,7 +2,9 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -12,80 +14,77 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
-	"github.com/microlib/simple"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 var (
-	logger *simple.Logger
-	mu     sync.Mutex
+	mu      sync.Mutex
+	clients = struct {
+		sync.Mutex
+		conns map[*websocket.Conn]*Principal
+	}{conns: map[*websocket.Conn]*Principal{}}
+	polling int32
 )
 
-func main() {
-
-	if os.Getenv("LOG_LEVEL") == "" {
-		logger = &simple.Logger{Level: "trace"}
-	} else {
-		logger = &simple.Logger{Level: os.Getenv("LOG_LEVEL")}
-	}
-
-	err := ValidateEnvars(logger)
+// StreamDataHandler - the dashboard websocket, the handshake is authenticated like the rest api
+func StreamDataHandler(w http.ResponseWriter, r *http.Request, logger *Logger) {
+	p, err := authenticate(r, authenticators)
 	if err != nil {
-		os.Exit(1)
+		logger.Warn("Auth : websocket rejected", "remote", r.RemoteAddr)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
 	}
-
 	upgrader := websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
+		CheckOrigin:     allowedOrigin,
 	}
-
-	http.HandleFunc("/api/v1/websocket/streamdata", func(w http.ResponseWriter, r *http.Request) {
-		upgrader.CheckOrigin = func(r *http.Request) bool { return true }
-		conn, _ := upgrader.Upgrade(w, r, nil)
-		defer conn.Close()
-		logger.Trace(fmt.Sprintf("Websocket connection %v", conn))
-		execProjects(conn, logger)
-	})
-
-	logger.Info("Starting websocket on 8080")
-	http.ListenAndServe(":8080", nil)
-
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.Error("Websocket upgrade", "error", err)
+		return
+	}
+	defer conn.Close()
+	logger.Trace("Websocket connection", "remote", conn.RemoteAddr().String(), "user", p.Name)
+	addClient(conn, p)
+	defer removeClient(conn)
+	execProjects(conn, p, logger)
 }
 
-func execProjects(conn *websocket.Conn, logger *simple.Logger) {
-	var project ProjectDetail
-	var force bool = false
-
+func execProjects(conn *websocket.Conn, p *Principal, logger *Logger) {
 	for {
 		_, message, err := conn.ReadMessage()
 		if err != nil {
-			logger.Error(fmt.Sprintf("Reading websocket message  %v", err))
+			logger.Error("Reading websocket message", "error", err)
 			return
 		} else {
-			force = (strings.Index(string(message), "force") > 0)
-			if string(message) == "poll" || force {
-				data, _ := ioutil.ReadFile("project.json")
-				err := json.Unmarshal([]byte(data), &project)
-				if err != nil {
-					logger.Error(fmt.Sprintf("Converting project.json  %v", err))
+			force := (strings.Index(string(message), "force") > 0)
+			if strings.HasPrefix(string(message), "{") {
+				execWebsocketCommand(conn, p, message, logger)
+			} else if string(message) == "poll" || force {
+				forceId := ""
+				if force {
+					forceId = strings.Split(string(message), "-")[0]
 				}
-				logger.Info(fmt.Sprintf("Read project file : %s ", string(data)))
-				// TODO:create lightweight go threads
-				for i, _ := range project.Repositories {
-					if !project.Repositories[i].Skip {
-						if force {
-							id := strings.Split(string(message), "-")
-							if id[0] == project.Repositories[i].Id {
-								project.Repositories[i].Force = true
-							}
-						}
-						executePipeline(conn, project.Repositories[i], logger)
-					} else {
-						logger.Warn(fmt.Sprintf("Skipping : Project : %s ", project.Repositories[i].Name))
-					}
+				if project, _ := readProject(); (forceId == "" && !canAny(p, project, "trigger")) || (forceId != "" && !can(p, project, forceId, "trigger")) {
+					logger.Warn("RBAC : denied", "user", p.Name, "action", "trigger", "repo", forceId)
+					send(conn, forceId+":trigger-forbidden", logger)
+					continue
 				}
+				// pipelines run in the background so that this connection can still send commands (i.e. approvals)
+				if !atomic.CompareAndSwapInt32(&polling, 0, 1) {
+					logger.Warn("Poll : pipelines already running, ignoring message")
+					continue
+				}
+				recordAudit(p, conn.RemoteAddr().String(), AuditEntry{Action: "poll", Repo: forceId}, nil, nil, logger)
+				go func() {
+					defer atomic.StoreInt32(&polling, 0)
+					pollProjects(forceId, nil, logger)
+				}()
 			} else {
 				id := strings.Split(string(message), "-")
 				execTest(conn, id[0], logger)
@@ -94,23 +93,99 @@ func execProjects(conn *websocket.Conn, logger *simple.Logger) {
 	}
 }
 
+// pollProjects - checks each repository for changes, forceId (optional) forces that repository with the given parameters
+func pollProjects(forceId string, parameters map[string]string, logger *Logger) {
+	var project ProjectDetail
+
+	data, _ := ioutil.ReadFile("project.json")
+	err := json.Unmarshal([]byte(data), &project)
+	if err != nil {
+		logger.Error("Converting project.json", "error", err)
+	}
+	logger.Debug("Read project file", "project", string(data))
+	for i, _ := range project.Repositories {
+		if !project.Repositories[i].Skip {
+			if forceId != "" && forceId == project.Repositories[i].Id {
+				project.Repositories[i].Force = true
+				if parameters != nil {
+					project.Repositories[i].Parameters = parameters
+				}
+			}
+			checkRepository(project.Repositories[i], logger)
+		} else {
+			logger.Warn("Skipping : project", "repo", project.Repositories[i].Id, "name", project.Repositories[i].Name)
+		}
+	}
+}
+
+// execWebsocketCommand - handles json commands sent from the dashboard
+func execWebsocketCommand(conn *websocket.Conn, p *Principal, message []byte, logger *Logger) {
+	var cmd WebsocketCommand
+	var err error
+
+	if err = json.Unmarshal(message, &cmd); err != nil {
+		logger.Error("Converting websocket command", "error", err)
+		return
+	}
+	switch cmd.Command {
+	case "approve", "reject":
+		cmd.Repo = runRepo(cmd.Run)
+		if authorize(p, cmd.Repo, "approve") != nil {
+			err = errForbidden
+			break
+		}
+		err = decideApproval(cmd.Run, cmd.Stage, cmd.Command == "approve", approverName(p, cmd.Approver), cmd.Comment)
+	case "force":
+		if authorize(p, cmd.Repo, "trigger") != nil {
+			err = errForbidden
+			break
+		}
+		if !atomic.CompareAndSwapInt32(&polling, 0, 1) {
+			err = errors.New("pipelines already running")
+			break
+		}
+		go func() {
+			defer atomic.StoreInt32(&polling, 0)
+			pollProjects(cmd.Repo, cmd.Parameters, logger)
+		}()
+	default:
+		err = errors.New("unknown command " + cmd.Command)
+	}
+	if err == nil {
+		recordAudit(p, conn.RemoteAddr().String(), AuditEntry{Action: cmd.Command, Repo: cmd.Repo, Run: cmd.Run, Target: strconv.Itoa(cmd.Stage)}, nil, cmd, logger)
+	}
+	if err != nil {
+		logger.Error("Websocket command", "command", cmd.Command, "error", err)
+		send(conn, cmd.Run+"-"+strconv.Itoa(cmd.Stage)+":"+cmd.Command+"-failed", logger)
+	}
+}
+
 // utilities
 
-func executePipeline(conn *websocket.Conn, repo Repository, logger *simple.Logger) {
-	var pipeline *Pipeline
+// checkRepository - clones/fetches the repository and queues a run when origin/master moved (or the repository is forced)
+// and for every new or updated pull request head when pull request polling is enabled
+func checkRepository(repo Repository, logger *Logger) {
+	ctx, span := startSpan(context.Background(), "poll "+repo.Name, attribute.String("cicd.repo", repo.Id))
+	defer span.End()
+	logger = logger.With("repo", repo.Id)
 
+	scm, e := newRepoSourceProvider(repo)
+	if e != nil {
+		logger.Error("Credentials", "error", e)
+		return
+	}
+	defer scm.Close()
+	unlock := cloneLocks.lock(repo.Id)
+	defer unlock()
 	workDirPath := repo.WorkDir + "/" + repo.Path
-	logger.Info(fmt.Sprintf("Scanning : Project : %s - %s", repo.Name, repo.Path))
+	logger.Info("Scanning : project", "name", repo.Name, "path", repo.Path)
 	_, errStat := os.Stat(workDirPath)
 	if os.IsNotExist(errStat) {
-		args := []string{
-			"-c",
-			"git clone " + repo.Scm,
-		}
-		res, e := execOS(repo.WorkDir, args, false)
+		_, gs := startSpan(ctx, "git clone")
+		e := scm.Clone(repo.Scm, workDirPath)
+		endSpan(gs, e)
 		if e != nil {
-			logger.Error(fmt.Sprintf("Std err : %s", res))
-			logger.Error(fmt.Sprintf("Command : "+strings.Join(args, " ")+" %v", e))
+			logger.Error("Git", "error", e)
 			return
 		}
 		logger.Info("Git : clone completed")
@@ -119,135 +194,389 @@ func executePipeline(conn *websocket.Conn, repo Repository, logger *simple.Logge
 	}
 
 	// we first fetch from master
-	args := []string{
-		"-c",
-		"git fetch origin",
-	}
-	res, e := execOS(workDirPath, args, false)
+	start := time.Now()
+	_, gs := startSpan(ctx, "git fetch")
+	e = scm.Fetch(workDirPath)
+	endSpan(gs, e)
 	if e != nil {
-		logger.Error(fmt.Sprintf("Std err : %s", res))
-		logger.Error(fmt.Sprintf("Command : "+strings.Join(args, " ")+" %v", e))
+		logger.Error("Git", "error", e)
 		return
 	}
+	gitFetchDuration.WithLabelValues(repo.Id).Observe(time.Since(start).Seconds())
 	logger.Info("Completed : git fetch")
 
-	// check local HEAD hash
-	args = []string{
-		"-c",
-		"git rev-parse --short HEAD",
-	}
-
-	hashLocal, e := execOS(workDirPath, args, true)
+	// check the last built hash
+	hashLocal, e := lastBuilt(scm, workDirPath)
 	if e != nil {
-		logger.Error(fmt.Sprintf("Std err : %s", hashLocal))
-		logger.Error(fmt.Sprintf("Command : "+strings.Join(args, " ")+"%s %v", e))
+		logger.Error("Git", "error", e)
 		return
 	}
-	logger.Info(fmt.Sprintf("Result : local hash %s", hashLocal))
+	logger.Info("Result : local hash", "sha", hashLocal)
 
 	// check remote HEAD hash
-	args = []string{
-		"-c",
-		"git rev-parse --short origin/master",
-	}
-	hashRemote, e := execOS(workDirPath, args, true)
+	_, gs = startSpan(ctx, "git rev-parse", attribute.String("cicd.ref", "origin/master"))
+	hashRemote, e := scm.ResolveRef(workDirPath, "origin/master")
+	endSpan(gs, e)
 	if e != nil {
-		logger.Error(fmt.Sprintf("Std err : %s", hashRemote))
-		logger.Error(fmt.Sprintf("Command : "+strings.Join(args, " ")+" %v", e))
+		logger.Error("Git", "error", e)
 		return
 	}
-	logger.Info(fmt.Sprintf("Result : remote hash %s", hashRemote))
+	logger.Info("Result : remote hash", "sha", hashRemote)
 
 	if (hashLocal != hashRemote) || repo.Force == true {
-
+		trigger := Trigger{Event: "push", Sha: hashRemote, Previous: hashLocal, Ref: BUILTREF}
 		if repo.Force {
 			logger.Info("Force : repo force flag == true")
+			trigger.Force = true
+			trigger.Parameters = repo.Parameters
 		}
-		// check out lates from master
-		args = []string{
-			"-c",
-			"git pull origin",
+		if e := enqueue(ctx, repo, trigger, logger); e != nil {
+			logger.Error("Queue", "error", e)
 		}
-		res, e := execOS(workDirPath, args, false)
+	} else {
+		logger.Info("Hashes are equal")
+	}
+
+	if repo.PullRequests != "" {
+		if e := pollPullRequests(ctx, scm, repo, workDirPath, logger); e != nil {
+			logger.Error("Pull requests", "error", e)
+		}
+	}
+}
+
+// executePipeline - builds the commit of the trigger (merged into the target branch for pull requests)
+// with every pipeline of the repository affected by the changed files
+func executePipeline(ctx context.Context, repo Repository, trigger Trigger, logger *Logger) {
+	logger = logger.With("repo", repo.Id, "commit", trigger.Sha)
+	scm, e := newRepoSourceProvider(repo)
+	if e != nil {
+		logger.Error("Credentials", "error", e)
+		return
+	}
+	defer scm.Close()
+	workDirPath := repo.WorkDir + "/" + repo.Path
+	base := trigger.Sha
+
+	if trigger.PullRequest != nil {
+		pr := trigger.PullRequest
+		logger.Info("Pull request", "pr", pr.Number, "source", pr.Source, "target", pr.Target, "sha", pr.Sha)
+		unlock := cloneLocks.lock(repo.Id)
+		_, gs := startSpan(ctx, "git fetch", attribute.String("cicd.ref", pr.Ref))
+		e = scm.FetchRefs(workDirPath, []string{"+" + pr.Ref + ":refs/remotes/origin/pr/" + strconv.Itoa(pr.Number), "+refs/heads/" + pr.Target + ":refs/remotes/origin/" + pr.Target})
+		endSpan(gs, e)
+		if e == nil {
+			_, gs = startSpan(ctx, "git rev-parse", attribute.String("cicd.ref", "origin/"+pr.Target))
+			base, e = scm.ResolveRef(workDirPath, "origin/"+pr.Target)
+			endSpan(gs, e)
+		}
+		unlock()
 		if e != nil {
-			logger.Error(fmt.Sprintf("Std err : %s", hashRemote))
-			logger.Error(fmt.Sprintf("Command : "+strings.Join(args, " ")+" %v", e))
+			logger.Error("Git", "error", e)
 			return
 		}
-		time.Sleep(2 * time.Second)
-		logger.Info(fmt.Sprintf("Result : git pull origin %s", res))
+	}
 
-		file, _ := ioutil.ReadFile(workDirPath + "/cicd.json")
-		err := json.Unmarshal([]byte(file), &pipeline)
-		if err != nil {
-			logger.Error(fmt.Sprintf("Converting cicd.json %v", err))
+	// only the pipelines whose paths changed are run (all of them when forced or on the first build)
+	from := trigger.Previous
+	if trigger.PullRequest != nil {
+		from = base
+	}
+	var changed []string
+	if !trigger.Force && from != "" {
+		_, gs := startSpan(ctx, "git diff")
+		changed, e = scm.ChangedFiles(workDirPath, from, trigger.Sha)
+		endSpan(gs, e)
+		if e != nil {
+			logger.Error("Git", "error", e)
 			return
 		}
-		logger.Trace(fmt.Sprintf("Schema : %v", pipeline))
-		logger.Debug(fmt.Sprintf("Path : %s", repo.Path))
-
-		// we can now start the actual pipeline
-		logger.Info("[Start Pipeline]\n")
-		removeContents("console/" + repo.Path)
-		str := pipeline.Id + "-" + ":clear"
-		send(conn, str, logger)
-		time.Sleep(2 * time.Second)
-		var wait sync.WaitGroup
-
-		for x, _ := range pipeline.Stages {
-			if !pipeline.Stages[x].Skip {
-				outLog := fmt.Sprintf("Executing : pipeline stage [%d] : %s", pipeline.Stages[x].Id, pipeline.Stages[x].Name)
-				str := pipeline.Id + "-" + strconv.Itoa(pipeline.Stages[x].Id) + ":pending"
-				se := send(conn, str, logger)
-				if se != nil {
-					logger.Error(fmt.Sprintf("Websocket send : %s", se))
-				}
-				logger.Info(outLog)
-				time.Sleep(time.Duration(pipeline.Stages[x].Wait) * 1 * time.Second)
-				if pipeline.Stages[x].Name == "Deploy" {
-					logger.Info(fmt.Sprintf("Envars : pipeline stage [%s] : %s", pipeline.Stages[x].Name, pipeline.Stages[x].Envars))
-					for k, _ := range pipeline.Stages[x].Envars {
-						os.Setenv(pipeline.Stages[x].Envars[k].Name, pipeline.Stages[x].Envars[k].Value)
-					}
-				}
-				wait.Add(1)
-				res, e := execCommand(workDirPath, pipeline.Stages[x].Exec, pipeline.Stages[x].Commands, false)
-				if e != nil {
-					logger.Error(fmt.Sprintf("Std err : %s", res))
-					logger.Error(fmt.Sprintf("Command : "+strings.Join(pipeline.Stages[x].Commands, " ")+" %v", e))
-					consoleLog(repo.Path+"/"+strings.ToLower(pipeline.Stages[x].Name), outLog+"\n"+res)
-					str := pipeline.Id + "-" + strconv.Itoa(pipeline.Stages[x].Id) + ":error"
-					se := send(conn, str, logger)
-					if se != nil {
-						logger.Error(fmt.Sprintf("Websocket send : %s", se))
-					}
-					break
-				}
-				logger.Info(fmt.Sprintf("Result : %s", res))
-				consoleLog(repo.Path+"/"+strings.ToLower(pipeline.Stages[x].Name), outLog+"\n"+res)
-				str = pipeline.Id + "-" + strconv.Itoa(pipeline.Stages[x].Id) + ":success"
-				se = send(conn, str, logger)
-				if se != nil {
-					logger.Error(fmt.Sprintf("Websocket send : %s", se))
-				}
-				time.Sleep(time.Duration(pipeline.Stages[x].Wait) * 1 * time.Second)
-			} else {
-				logger.Warn(fmt.Sprintf("Skipping : pipeline stage [%d] : %s", pipeline.Stages[x].Id, pipeline.Stages[x].Name))
-				str := pipeline.Id + "-" + strconv.Itoa(pipeline.Stages[x].Id) + ":skipping"
-				send(conn, str, logger)
-				time.Sleep(2 * time.Second)
+		logger.Debug("Changed", "files", changed)
+	}
+	defs := selectPipelines(repo, changed, trigger.Force || from == "")
+	if len(defs) == 0 {
+		logger.Info("Pipelines : no paths changed")
+	}
+	for _, def := range defs {
+		runPipeline(ctx, scm, repo, trigger, def, base, logger)
+	}
+	unlock := cloneLocks.lock(repo.Id)
+	if e := scm.UpdateRef(workDirPath, trigger.Ref, trigger.Sha); e != nil {
+		logger.Error("Git : update", "ref", trigger.Ref, "error", e)
+	}
+	gcWorktrees(scm, workDirPath, repo, logger)
+	unlock()
+	pruneArtifacts(logger)
+}
+
+// runPipeline - runs one pipeline of the repository in its own worktree checked out at base
+// (with the pull request merged in)
+func runPipeline(ctx context.Context, scm SourceProvider, repo Repository, trigger Trigger, def PipelineDetail, base string, logger *Logger) {
+	var pipeline *Pipeline
+
+	workDirPath := repo.WorkDir + "/" + repo.Path
+
+	// check out the exact commit in a run scoped worktree
+	runId := newRunId()
+	ctx, span := startSpan(ctx, "run", attribute.String("cicd.run.id", runId), attribute.String("cicd.pipeline", def.Name))
+	defer span.End()
+	logger = logger.With("run", runId)
+	workspace, e := runWorkspace(repo, runId)
+	if e != nil {
+		logger.Error("Worktree", "error", e)
+		return
+	}
+	release := useWorkspace(workspace)
+	defer release()
+	_, gs := startSpan(ctx, "git checkout", attribute.String("cicd.commit", base))
+	e = createWorktree(scm, workDirPath, workspace, base)
+	endSpan(gs, e)
+	if e != nil {
+		logger.Error("Worktree", "error", e)
+		return
+	}
+	logger.Info("Result : worktree", "path", workspace, "sha", base)
+	if trigger.PullRequest != nil {
+		// build the merge result against the target branch
+		_, gs := startSpan(ctx, "git merge", attribute.String("cicd.commit", trigger.Sha))
+		e = scm.Merge(workspace, trigger.Sha)
+		endSpan(gs, e)
+		if e != nil {
+			logger.Error("Git : merge of pull request", "pr", trigger.PullRequest.Number, "error", e)
+			run := runStore.Create(runId, repo, &Pipeline{Id: repo.Id}, trigger.Sha)
+			run.Event = trigger.Event
+			run.PullRequest = trigger.PullRequest
+			attachReporter(run, repo, logger)
+			attachNotifications(run, repo, nil)
+			finishRun(run, "failed", logger)
+			return
+		}
+	}
+
+	// the stages of a monorepo pipeline run in its sub-directory
+	buildPath := filepath.Join(workspace, def.Dir)
+	consolePath := repo.Path
+	if def.Name != "" {
+		consolePath += "/" + def.Name
+	}
+	file, _ := ioutil.ReadFile(filepath.Join(workspace, def.File))
+	err := json.Unmarshal([]byte(file), &pipeline)
+	if err != nil {
+		logger.Error("Converting pipeline", "file", def.File, "error", err)
+		return
+	}
+	logger.Trace("Schema", "pipeline", pipeline)
+	// stages without runsOn inherit the pipeline's (none runs them on this server)
+	for x := range pipeline.Stages {
+		if pipeline.Stages[x].RunsOn == nil {
+			pipeline.Stages[x].RunsOn = pipeline.RunsOn
+		}
+	}
+	logger.Debug("Path", "path", buildPath)
+
+	// we can now start the actual pipeline
+	logger.Info("[Start Pipeline]")
+	run := runStore.Create(runId, repo, pipeline, trigger.Sha)
+	run.Event = trigger.Event
+	run.PullRequest = trigger.PullRequest
+	logger.Info("Run : created", "pipeline", pipeline.Id)
+	values := map[string]string{}
+	if trigger.Force {
+		values = trigger.Parameters
+	}
+	attachReporter(run, repo, logger)
+	attachNotifications(run, repo, pipeline)
+	run.callback = newCallbackToken()
+	run.source = &jobSource{Scm: repo.Scm, Credentials: repo.Credentials, Commit: base, Dir: def.Dir}
+	if repo.Checkout != nil {
+		run.source.Checkout = *repo.Checkout
+	}
+	if pr := trigger.PullRequest; pr != nil {
+		run.source.Refs = []string{"+" + pr.Ref + ":refs/remotes/origin/pr/" + strconv.Itoa(pr.Number)}
+		run.source.Merge = trigger.Sha
+	}
+	run.Previous = trigger.Previous
+	if trigger.PullRequest != nil {
+		run.Previous = base
+	}
+	if run.Head, e = scm.Commit(workDirPath, trigger.Sha); e != nil {
+		logger.Error("Git", "error", e)
+	}
+	if run.Previous != trigger.Sha {
+		if run.Commits, e = scm.Log(workDirPath, run.Previous, trigger.Sha); e != nil {
+			logger.Error("Git", "error", e)
+		}
+	}
+	logger.Info("Result : commit", "author", run.Head.Author, "subject", run.Head.Subject, "commits", len(run.Commits))
+	run.Parameters, err = resolveParameters(pipeline.Parameters, values)
+	if err != nil {
+		logger.Error("Parameters", "error", err)
+		finishRun(run, "failed", logger)
+		return
+	}
+	if err = validateStages(pipeline.Stages); err != nil {
+		logger.Error("Stages", "error", err)
+		finishRun(run, "failed", logger)
+		return
+	}
+	runStore.Save(run)
+	broadcastEvent("run.started", run, logger)
+	reportStatus(run, "", "pending", logger)
+	removeContents("console/" + consolePath)
+	broadcastRepo(run.RepoId, "view", pipeline.Id+"-"+":clear", logger)
+	sleep(ctx, 2*time.Second, "clear")
+	status := "success"
+
+	for x, _ := range pipeline.Stages {
+		if !pipeline.Stages[x].Skip && stageWhen(pipeline.Stages[x], run) {
+			if e := runStage(ctx, run, pipeline.Stages[x], buildPath, consolePath, logger); e != nil {
+				status = "failed"
+				break
 			}
+		} else {
+			logger.ForStage(pipeline.Stages[x]).Warn("Skipping : pipeline stage")
+			stageStatus(run, pipeline.Stages[x].Id, "skipping", logger)
+			sleep(ctx, 2*time.Second, "skipping")
 		}
-		logger.Info("[End Pipeline]")
-		wait.Wait()
-	} else {
-		logger.Info("Hashes are equal")
 	}
+	span.SetAttributes(attribute.String("cicd.status", status))
+	finishRun(run, status, logger)
+	logger.Info("[End Pipeline]")
+}
+
+// runStage - runs the stage in buildPath, the stage status is set here (an error means the run failed)
+func runStage(ctx context.Context, run *Run, stage StageDetail, buildPath string, consolePath string, logger *Logger) (err error) {
+	ctx, span := startSpan(ctx, "stage "+stage.Name, attribute.Int("cicd.stage.id", stage.Id), attribute.String("cicd.stage.type", stage.Type))
+	defer func() { endSpan(span, err) }()
+	logger = logger.ForStage(stage)
+
+	st, err := stageExecutor(stage.Type)
+	if err != nil {
+		logger.Error("Stage type", "error", err)
+		stageStatus(run, stage.Id, "error", logger)
+		return err
+	}
+	if gate, ok := st.(GateStage); ok {
+		// no workspace
+		_, err = gate.Execute(ctx, StageContext{Run: run, Stage: stage, Logger: logger})
+		if err != nil {
+			logger.Error("Gate", "type", stage.Type, "error", err)
+			stageStatus(run, stage.Id, gate.FailStatus(), logger)
+			return err
+		}
+		stageStatus(run, stage.Id, "success", logger)
+		return nil
+	}
+	outLog := fmt.Sprintf("Executing : pipeline stage [%d] : %s", stage.Id, stage.Name)
+	stageStatus(run, stage.Id, "pending", logger)
+	logger.Info("Executing : pipeline stage")
+	sleep(ctx, time.Duration(stage.Wait)*time.Second, "wait")
+	// the agents restore, collect and cache against their own workspace (AgentExecutor)
+	remote := len(stage.RunsOn) > 0
+	if !remote {
+		_, as := startSpan(ctx, "artifacts restore", attribute.StringSlice("cicd.artifacts", stage.Restore))
+		err = restoreArtifacts(run, stage, buildPath, logger)
+		endSpan(as, err)
+		if err != nil {
+			logger.Error("Artifacts : restore", "error", err)
+			stageStatus(run, stage.Id, "error", logger)
+			return err
+		}
+	}
+	vars := runVars(run)
+	var paths []string
+	if stage.Cache != nil {
+		sr := run.stageRun(stage.Id)
+		paths = cachePaths(stage.Cache, buildPath)
+		key, e := cacheKey(stage.Cache.Key, buildPath, vars)
+		_, cs := startSpan(ctx, "cache restore", attribute.String("cicd.cache.key", key))
+		hit := false
+		if e == nil && remote {
+			// extracted by the agent
+			_, se := os.Stat(cacheFile(key))
+			hit = se == nil
+		} else if e == nil {
+			hit, e = restoreCache(key, paths, logger)
+		}
+		cs.SetAttributes(attribute.Bool("cicd.cache.hit", hit))
+		endSpan(cs, e)
+		sr.CacheKey = key
+		switch {
+		case e != nil:
+			logger.Error("Cache", "error", e)
+			sr.Cache = "error"
+		case hit:
+			sr.Cache = "hit"
+		default:
+			sr.Cache = "miss"
+		}
+		runStore.Save(run)
+	}
+	execPath := interpolate(stage.Exec, vars)
+	commands := interpolateCommands(execPath, stage.Commands, vars)
+	// stages run once, every attempt is a span of its own
+	actx, attempt := startSpan(ctx, "attempt", attribute.Int("cicd.attempt", 1))
+	outputFile, _ := newOutputFile()
+	env := append(runEnv(run), "CICD_OUTPUT="+outputFile, "TRACEPARENT="+traceparent(actx),
+		"CICD_CALLBACK_URL="+callbackUrl(run, stage), "CICD_CALLBACK_TOKEN="+run.callback)
+	for _, v := range stage.Envars {
+		env = append(env, v.Name+"="+interpolate(v.Value, vars))
+	}
+	// the output goes to the stage log and the dashboards as it is written
+	stage.With = interpolateWith(stage.With, vars)
+	if len(stage.RunsOn) > 0 {
+		attempt.SetAttributes(attribute.String("cicd.runs_on", fmt.Sprint(stage.RunsOn)))
+	}
+	if stage.Image != "" {
+		attempt.SetAttributes(attribute.String("cicd.image", stage.Image))
+	}
+	appendStageLog(run.Id, stage.Id, outLog+"\n")
+	spec := ExecSpec{Name: fmt.Sprintf(CONTAINERNAME, run.Id, stage.Id), Dir: buildPath, Exec: execPath, Commands: commands,
+		Env: env, Output: outputFile, Image: interpolate(stage.Image, vars), Limits: stage.Limits, Sandbox: stage.Sandbox}
+	res, e := st.Execute(actx, StageContext{Run: run, Stage: stage, Spec: spec, Out: stageLogWriter(run, stage, logger), Logger: logger})
+	endSpan(attempt, e)
+	if outputs, oe := readOutputs(outputFile); oe == nil && len(outputs) > 0 {
+		run.stageRun(stage.Id).Outputs = outputs
+		logger.Debug("Outputs", "outputs", outputs)
+	}
+	os.Remove(outputFile)
+	if e != nil {
+		logger.Error("Command", "command", strings.Join(stage.Commands, " "), "stderr", res, "error", e)
+		consoleLog(consolePath+"/"+strings.ToLower(stage.Name), outLog+"\n"+res)
+		if reason := limitReason(e); reason != "" {
+			// killed for going over a limit, not a failing command
+			appendStageLog(run.Id, stage.Id, e.Error()+"\n")
+			stageLimits.WithLabelValues(run.RepoId, strings.TrimPrefix(reason, "limit:")).Inc()
+			run.stageRun(stage.Id).Reason = reason
+		}
+		stageStatus(run, stage.Id, "error", logger)
+		return e
+	}
+	logger.Info("Result", "stdout", res)
+	consoleLog(consolePath+"/"+strings.ToLower(stage.Name), outLog+"\n"+res)
+	if !remote {
+		_, as := startSpan(ctx, "artifacts collect", attribute.StringSlice("cicd.artifacts", stage.Artifacts))
+		e = collectArtifacts(run, stage, buildPath, logger)
+		endSpan(as, e)
+		if e != nil {
+			logger.Error("Artifacts", "error", e)
+		}
+	}
+	if sr := run.stageRun(stage.Id); sr.Cache == "miss" && !remote {
+		_, cs := startSpan(ctx, "cache save", attribute.String("cicd.cache.key", sr.CacheKey))
+		e = saveCache(sr.CacheKey, paths, logger)
+		endSpan(cs, e)
+		if e != nil {
+			logger.Error("Cache", "error", e)
+		}
+	}
+	stageStatus(run, stage.Id, "success", logger)
+	sleep(ctx, time.Duration(stage.Wait)*time.Second, "wait")
+	return nil
 }
 
 // test for front end
-func execTest(conn *websocket.Conn, id string, logger *simple.Logger) {
-	logger.Info(fmt.Sprintf("Simulate test from FE %s", id))
+func execTest(conn *websocket.Conn, id string, logger *Logger) {
+	logger.Info("Simulate test from FE", "id", id)
 	str := id + "-:clear"
 	send(conn, str, logger)
 
@@ -289,38 +618,54 @@ func execTest(conn *websocket.Conn, id string, logger *simple.Logger) {
 }
 
 // mutex on websocket wrtite
-func send(conn *websocket.Conn, str string, logger *simple.Logger) error {
+func send(conn *websocket.Conn, str string, logger *Logger) error {
 	mu.Lock()
 	defer mu.Unlock()
-	logger.Trace(fmt.Sprintf("Sending websocket message %s ", str))
-	return conn.WriteMessage(1, []byte(str))
+	logger.Trace("Sending websocket message", "message", str)
+	if err := conn.WriteMessage(1, []byte(str)); err != nil {
+		websocketMessages.WithLabelValues("dropped").Inc()
+		return err
+	}
+	websocketMessages.WithLabelValues("sent").Inc()
+	return nil
 }
 
-func execCommand(path string, c string, params []string, trim bool) (string, error) {
-	var stdout, stderr bytes.Buffer
-	var out string = ""
-	cmd := exec.Command(c, params...)
-	cmd.Dir = path
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-	err := cmd.Run()
-	outStr, errStr := string(stdout.Bytes()), string(stderr.Bytes())
-	if err != nil {
-		return errStr, err
-	}
-	if trim {
-		out = outStr[:len(outStr)-1]
-	} else {
-		out = outStr
+// broadcastRepo - sends the message to the dashboards whose user can do action on the repository
+// (i.e. stage logs only go to users with the logs permission, run events and stage status to its viewers)
+func broadcastRepo(repoId string, action string, str string, logger *Logger) {
+	project, _ := readProject()
+	clients.Lock()
+	defer clients.Unlock()
+	for conn, p := range clients.conns {
+		if !can(p, project, repoId, action) {
+			continue
+		}
+		if err := send(conn, str, logger); err != nil {
+			logger.Error("Websocket send", "error", err)
+		}
 	}
-	return out, nil
 }
 
-func execOS(path string, params []string, trim bool) (string, error) {
+func addClient(conn *websocket.Conn, p *Principal) {
+	clients.Lock()
+	defer clients.Unlock()
+	clients.conns[conn] = p
+	websocketClients.Set(float64(len(clients.conns)))
+}
+
+func removeClient(conn *websocket.Conn) {
+	clients.Lock()
+	defer clients.Unlock()
+	delete(clients.conns, conn)
+	websocketClients.Set(float64(len(clients.conns)))
+}
+
+func execCommand(path string, c string, params []string, env []string, trim bool) (string, error) {
 	var stdout, stderr bytes.Buffer
 	var out string = ""
-	cmd := exec.Command("/bin/bash", params...)
+	cmd := exec.Command(c, params...)
 	cmd.Dir = path
+	cmd.Env = append(os.Environ(), env...)
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 	err := cmd.Run()
@@ -340,7 +685,7 @@ func consoleLog(path string, data string) error {
 	os.MkdirAll("console/"+path, os.ModePerm)
 	err := ioutil.WriteFile("console/"+path+"/out.txt", []byte(data), 0755)
 	if err != nil {
-		logger.Error(fmt.Sprintf("Writing log file %v", err))
+		logger.Error("Writing log file", "error", err)
 		return err
 	}
 	return nil
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"golang.org/x/crypto/ssh"
+)
+
+// validateCredential - checks the mandatory fields per type
+func validateCredential(cred CredentialDetail) error {
+	switch cred.Type {
+	case "ssh":
+		if cred.PrivateKey == "" {
+			return errors.New("ssh credential needs a privatekey")
+		}
+		// host keys are always pinned, we never fall back to trust on first use
+		if cred.KnownHosts == "" {
+			return errors.New("ssh credential needs knownhosts")
+		}
+	case "https":
+		if cred.Token == "" && cred.Password == "" {
+			return errors.New("https credential needs a token or password")
+		}
+	case "token":
+		if cred.Token == "" {
+			return errors.New("token credential needs a token")
+		}
+	default:
+		return errors.New("unknown credential type " + cred.Type)
+	}
+	return nil
+}
+
+// credentialFiles - key and known_hosts written to a private temp dir (never the workspace)
+// removed by the provider Close, a key with a passphrase is written decrypted as the ssh binary can't prompt for it
+func credentialFiles(cred CredentialDetail) (string, error) {
+	key := []byte(cred.PrivateKey)
+	if cred.Passphrase != "" {
+		raw, err := ssh.ParseRawPrivateKeyWithPassphrase(key, []byte(cred.Passphrase))
+		if err != nil {
+			return "", errors.New("ssh credential privatekey can not be decrypted with its passphrase : " + err.Error())
+		}
+		block, err := ssh.MarshalPrivateKey(raw, "")
+		if err != nil {
+			return "", err
+		}
+		key = pem.EncodeToMemory(block)
+	}
+	dir, err := ioutil.TempDir("", "cicd-cred")
+	if err != nil {
+		return "", err
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "id"), key, 0600); err == nil {
+		err = ioutil.WriteFile(filepath.Join(dir, "known_hosts"), []byte(cred.KnownHosts), 0600)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// gitEnv - envars applied to the git binary for this repository only, the auth header is scoped to the
+// repository url so submodule and lfs remotes on other hosts never see it
+func gitEnv(cred CredentialDetail, dir string, scm string) []string {
+	switch cred.Type {
+	case "ssh":
+		return []string{
+			"GIT_SSH_COMMAND=ssh -i " + filepath.Join(dir, "id") + " -o IdentitiesOnly=yes -o StrictHostKeyChecking=yes -o UserKnownHostsFile=" + filepath.Join(dir, "known_hosts"),
+		}
+	case "https", "token":
+		user, pass := httpsUser(cred)
+		return []string{
+			"GIT_TERMINAL_PROMPT=0",
+			"GIT_CONFIG_COUNT=1",
+			"GIT_CONFIG_KEY_0=http." + strings.TrimSuffix(scm, "/") + ".extraHeader",
+			"GIT_CONFIG_VALUE_0=Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass)),
+		}
+	}
+	return []string{}
+}
+
+// gitAuth - auth method for the native client
+func gitAuth(cred CredentialDetail, dir string) (transport.AuthMethod, error) {
+	switch cred.Type {
+	case "ssh":
+		auth, err := gitssh.NewPublicKeys("git", []byte(cred.PrivateKey), cred.Passphrase)
+		if err != nil {
+			return nil, err
+		}
+		auth.HostKeyCallback, err = gitssh.NewKnownHostsCallback(filepath.Join(dir, "known_hosts"))
+		return auth, err
+	case "https", "token":
+		user, pass := httpsUser(cred)
+		return &githttp.BasicAuth{Username: user, Password: pass}, nil
+	}
+	return nil, nil
+}
+
+func httpsUser(cred CredentialDetail) (string, string) {
+	if cred.Token != "" {
+		user := cred.Username
+		if user == "" {
+			user = "x-access-token"
+		}
+		return user, cred.Token
+	}
+	return cred.Username, cred.Password
+}
+
+// newRepoSourceProvider - the provider with the repository checkout options and credentials (if any) applied
+func newRepoSourceProvider(repo Repository) (SourceProvider, error) {
+	opts := CheckoutDetail{}
+	if repo.Checkout != nil {
+		opts = *repo.Checkout
+	}
+	if repo.Credentials == "" {
+		return newSourceProvider(opts), nil
+	}
+	cred, err := secretStore.Get(repo.Credentials)
+	if err != nil {
+		return nil, err
+	}
+	return newCredentialSourceProvider(repo.Scm, opts, repo.Credentials, cred)
+}
+
+// newCredentialSourceProvider - the provider for scm with the credential (name is only used in errors) applied,
+// agents get the credential of the repository with their job
+func newCredentialSourceProvider(scm string, opts CheckoutDetail, name string, cred CredentialDetail) (SourceProvider, error) {
+	err := validateCredential(cred)
+	if err != nil {
+		return nil, err
+	}
+	if cred.Type == "ssh" && strings.HasPrefix(scm, "http") || cred.Type != "ssh" && !strings.HasPrefix(scm, "http") {
+		return nil, errors.New("credential " + name + " of type " + cred.Type + " does not match scm " + scm)
+	}
+	dir := ""
+	if cred.Type == "ssh" {
+		if dir, err = credentialFiles(cred); err != nil {
+			return nil, err
+		}
+	}
+	if os.Getenv("SCM_PROVIDER") == "cli" {
+		return &CliSourceProvider{Env: gitEnv(cred, dir, scm), Options: opts, credDir: dir}, nil
+	}
+	auth, err := gitAuth(cred, dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return &GitSourceProvider{Auth: auth, Env: gitEnv(cred, dir, scm), Options: opts, credDir: dir}, nil
+}
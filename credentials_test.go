@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestGitEnv(t *testing.T) {
+	cred := CredentialDetail{Type: "token", Token: "s3cret"}
+	env := gitEnv(cred, "", "https://git.example.com/org/repo.git/")
+	header := "Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte("x-access-token:s3cret"))
+	want := []string{"GIT_TERMINAL_PROMPT=0", "GIT_CONFIG_COUNT=1", "GIT_CONFIG_KEY_0=http.https://git.example.com/org/repo.git.extraHeader", "GIT_CONFIG_VALUE_0=" + header}
+	if fmt.Sprint(env) != fmt.Sprint(want) {
+		t.Errorf("Git env - got (%v) wanted (%v)", env, want)
+	}
+	if _, err := exec.LookPath("git"); err != nil {
+		return
+	}
+
+	// create anonymous struct
+	tests := []struct {
+		Name     string
+		Url      string
+		Want     string
+		ErrorMsg string
+	}{
+		{"Test git env : repository", "https://git.example.com/org/repo.git/info/refs", header, "Git env %s - got (%v) wanted (%v)"},
+		{"Test git env : submodule on another host", "https://cdn.example.org/org/repo.git/info/refs", "", "Git env %s - got (%v) wanted (%v)"},
+		{"Test git env : other repository on the host", "https://git.example.com/org/other.git/info/refs", "", "Git env %s - got (%v) wanted (%v)"},
+	}
+
+	for _, tt := range tests {
+		fmt.Println(fmt.Sprintf("\nExecuting test : %s", tt.Name))
+		// what git resolves for a request to the url
+		cmd := exec.Command("git", "config", "--get-urlmatch", "http.extraHeader", tt.Url)
+		cmd.Env = append(os.Environ(), env...)
+		out, _ := cmd.Output()
+		if got := strings.TrimSpace(string(out)); got != tt.Want {
+			t.Errorf(tt.ErrorMsg, tt.Name, got, tt.Want)
+		}
+		fmt.Println("")
+	}
+}
+
+func TestCredentialFiles(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	plain, _ := ssh.MarshalPrivateKey(key, "")
+	encrypted, _ := ssh.MarshalPrivateKeyWithPassphrase(key, "", []byte("open sesame"))
+	public, _ := ssh.NewPublicKey(key.Public())
+
+	// create anonymous struct
+	tests := []struct {
+		Name       string
+		PrivateKey string
+		Passphrase string
+		Err        string
+		ErrorMsg   string
+	}{
+		{"Test credential files : plain key", string(pem.EncodeToMemory(plain)), "", "", "Credential files %s - got (%v) wanted (%v)"},
+		{"Test credential files : passphrase", string(pem.EncodeToMemory(encrypted)), "open sesame", "", "Credential files %s - got (%v) wanted (%v)"},
+		{"Test credential files : wrong passphrase", string(pem.EncodeToMemory(encrypted)), "guess", "ssh credential privatekey can not be decrypted with its passphrase : x509: decryption password incorrect", "Credential files %s - got (%v) wanted (%v)"},
+	}
+
+	for _, tt := range tests {
+		fmt.Println(fmt.Sprintf("\nExecuting test : %s", tt.Name))
+		dir, err := credentialFiles(CredentialDetail{Type: "ssh", PrivateKey: tt.PrivateKey, Passphrase: tt.Passphrase, KnownHosts: "git.example.com ssh-ed25519 AAAA"})
+		if tt.Err != "" {
+			if err == nil || err.Error() != tt.Err {
+				t.Errorf(tt.ErrorMsg, tt.Name, err, tt.Err)
+			}
+			continue
+		}
+		// the ssh binary reads the key without a passphrase
+		b, _ := ioutil.ReadFile(filepath.Join(dir, "id"))
+		if signer, e := ssh.ParsePrivateKey(b); err != nil || e != nil || string(signer.PublicKey().Marshal()) != string(public.Marshal()) {
+			t.Errorf(tt.ErrorMsg, tt.Name, fmt.Sprint(err, e), "the decrypted key")
+		}
+		os.RemoveAll(dir)
+		fmt.Println("")
+	}
+}
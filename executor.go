@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	WORKSPACE     = "/workspace"
+	CONTAINEROUT  = "/cicd/output"
+	CONTAINERNAME = "cicd-%s-%d"
+)
+
+// ExecSpec - a stage's command as it is handed to an executor
+type ExecSpec struct {
+	Name     string
+	Dir      string
+	Exec     string
+	Commands []string
+	Env      []string
+	Output   string
+	Image    string
+	Limits   *LimitsDetail
+	Sandbox  bool
+}
+
+// Executor - runs the commands of a stage, the output is written to out as the commands produce it and
+// (like execCommand) stdout is returned on success, stderr on failure
+type Executor interface {
+	Execute(ctx context.Context, spec ExecSpec, out io.Writer) (string, error)
+}
+
+// HostExecutor - runs the commands directly on the host in the stage's directory
+type HostExecutor struct{}
+
+// ContainerExecutor - runs the commands in the stage's image with the workspace bind mounted
+type ContainerExecutor struct {
+	Runtime ContainerRuntime
+}
+
+// ContainerSpec - what the runtime starts, Mounts maps host paths to container paths
+type ContainerSpec struct {
+	Name    string
+	Image   string
+	Workdir string
+	Mounts  map[string]string
+	Env     []string
+	Cmd     []string
+	Cpus    float64
+	Memory  int64
+	Procs   int
+}
+
+// ContainerRuntime - starts a container, waits for it to exit and removes it
+type ContainerRuntime interface {
+	Run(ctx context.Context, c ContainerSpec, stdout io.Writer, stderr io.Writer) error
+}
+
+// cliRuntime - podman or docker through their command line
+type cliRuntime struct {
+	bin string
+}
+
+var containerRuntime ContainerRuntime = newContainerRuntime()
+
+// newContainerRuntime - CONTAINER_RUNTIME (podman or docker, default podman)
+func newContainerRuntime() ContainerRuntime {
+	if os.Getenv("CONTAINER_RUNTIME") != "" {
+		return cliRuntime{bin: os.Getenv("CONTAINER_RUNTIME")}
+	}
+	return cliRuntime{bin: "podman"}
+}
+
+// executorFor - the agents for stages with runsOn, a container for stages with an image, otherwise the host
+func executorFor(run *Run, stage StageDetail, logger *Logger) Executor {
+	switch {
+	case len(stage.RunsOn) > 0:
+		return &AgentExecutor{run: run, stage: stage, logger: logger}
+	case stage.Image != "":
+		return &ContainerExecutor{Runtime: containerRuntime}
+	default:
+		return HostExecutor{}
+	}
+}
+
+// Execute - execStream in the stage's directory, execLimited for stages with limits or a sandbox
+func (HostExecutor) Execute(ctx context.Context, spec ExecSpec, out io.Writer) (string, error) {
+	if spec.Limits != nil || spec.Sandbox {
+		return execLimited(ctx, spec, out)
+	}
+	return execStream(ctx, spec.Dir, spec.Exec, spec.Commands, spec.Env, out)
+}
+
+// Execute - the workspace is mounted at /workspace and the output file at /cicd/output, only the stage's
+// env is passed on (not the server's)
+func (c *ContainerExecutor) Execute(ctx context.Context, spec ExecSpec, out io.Writer) (string, error) {
+	container := ContainerSpec{Name: spec.Name, Image: spec.Image, Workdir: WORKSPACE, Mounts: map[string]string{spec.Dir: WORKSPACE}}
+	for _, kv := range spec.Env {
+		if strings.HasPrefix(kv, "CICD_OUTPUT=") {
+			continue
+		}
+		container.Env = append(container.Env, kv)
+	}
+	if spec.Output != "" {
+		container.Mounts[spec.Output] = CONTAINEROUT
+		container.Env = append(container.Env, "CICD_OUTPUT="+CONTAINEROUT)
+	}
+	if spec.Exec != "" {
+		container.Cmd = append([]string{spec.Exec}, spec.Commands...)
+	}
+	if l := spec.Limits; l != nil {
+		memory, err := parseBytes(l.Memory)
+		if err != nil {
+			return "", err
+		}
+		container.Cpus, container.Memory, container.Procs = l.Cpus, memory, l.Procs
+	}
+	var stdout, stderr bytes.Buffer
+	out = &syncWriter{w: out}
+	err := c.Runtime.Run(ctx, container, io.MultiWriter(&stdout, out), io.MultiWriter(&stderr, out))
+	if err != nil {
+		return stderr.String(), err
+	}
+	return stdout.String(), nil
+}
+
+// Run - `<bin> run --rm` in the foreground, the env values are passed through the client's environment
+// so they don't show up in the process list
+func (r cliRuntime) Run(ctx context.Context, c ContainerSpec, stdout io.Writer, stderr io.Writer) error {
+	if c.Image == "" {
+		return errors.New("no image")
+	}
+	args := []string{"run", "--rm", "--name", c.Name, "--workdir", c.Workdir}
+	hosts := make([]string, 0, len(c.Mounts))
+	for host := range c.Mounts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		args = append(args, "--volume", host+":"+c.Mounts[host])
+	}
+	for _, kv := range c.Env {
+		args = append(args, "--env", strings.SplitN(kv, "=", 2)[0])
+	}
+	if c.Cpus > 0 {
+		args = append(args, "--cpus", strconv.FormatFloat(c.Cpus, 'f', -1, 64))
+	}
+	if c.Memory > 0 {
+		args = append(args, "--memory", strconv.FormatInt(c.Memory, 10))
+	}
+	if c.Procs > 0 {
+		args = append(args, "--pids-limit", strconv.Itoa(c.Procs))
+	}
+	args = append(append(args, c.Image), c.Cmd...)
+
+	cmd := exec.CommandContext(ctx, r.bin, args...)
+	cmd.Env = append(os.Environ(), c.Env...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		// killing the client leaves the container running
+		exec.Command(r.bin, "rm", "--force", c.Name).Run()
+	}
+	return err
+}
+
+// parseBytes - 512, 64k, 512m, 2g (powers of 1024), empty is no limit
+func parseBytes(str string) (int64, error) {
+	s := strings.ToLower(strings.TrimSpace(str))
+	if s == "" {
+		return 0, nil
+	}
+	unit := int64(1)
+	for suffix, size := range map[string]int64{"k": 1 << 10, "m": 1 << 20, "g": 1 << 30} {
+		if strings.HasSuffix(s, suffix) || strings.HasSuffix(s, suffix+"b") {
+			s, unit = strings.TrimSuffix(strings.TrimSuffix(s, "b"), suffix), size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %s", str)
+	}
+	return n * unit, nil
+}
+
+// stageLogWriter - appends to the stage log and broadcasts every write as a stage.log event (to the users
+// allowed to read the logs)
+func stageLogWriter(run *Run, stage StageDetail, logger *Logger) io.Writer {
+	return streamWriter(func(data string) {
+		appendStageLog(run.Id, stage.Id, data)
+		b, _ := json.Marshal(StageEvent{Event: "stage.log", Run: run.Id, Stage: stage.Id, Status: "running", Log: data})
+		broadcastRepo(run.RepoId, "logs", string(b), logger)
+	})
+}
+
+// streamWriter - passes every write on to fn
+type streamWriter func(string)
+
+func (s streamWriter) Write(p []byte) (int, error) {
+	s(string(p))
+	return len(p), nil
+}
+
+// syncWriter - serializes the writes of the stdout and stderr copies to the same writer
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
+
+// execStream - execCommand that also streams stdout and stderr to out as the command writes them
+func execStream(ctx context.Context, path string, c string, params []string, env []string, out io.Writer) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c, params...)
+	cmd.Dir = path
+	cmd.Env = append(os.Environ(), env...)
+	out = &syncWriter{w: out}
+	cmd.Stdout = io.MultiWriter(&stdout, out)
+	cmd.Stderr = io.MultiWriter(&stderr, out)
+	if err := cmd.Run(); err != nil {
+		return stderr.String(), err
+	}
+	return stdout.String(), nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeRuntime - records the container and plays the part of the image's shell
+type fakeRuntime struct {
+	spec   ContainerSpec
+	stdout string
+	stderr string
+	output string
+	err    error
+}
+
+func (f *fakeRuntime) Run(ctx context.Context, c ContainerSpec, stdout io.Writer, stderr io.Writer) error {
+	f.spec = c
+	for host, path := range c.Mounts {
+		if path == CONTAINEROUT && f.output != "" {
+			ioutil.WriteFile(host, []byte(f.output), 0600)
+		}
+	}
+	io.WriteString(stdout, f.stdout)
+	io.WriteString(stderr, f.stderr)
+	return f.err
+}
+
+func TestExecutors(t *testing.T) {
+	tmp, _ := ioutil.TempDir("", "executors")
+	defer os.RemoveAll(tmp)
+	outputFile := filepath.Join(tmp, "output")
+	ioutil.WriteFile(outputFile, nil, 0600)
+
+	// create anonymous struct
+	tests := []struct {
+		Name     string
+		Runtime  *fakeRuntime
+		Spec     ExecSpec
+		Want     string
+		Streamed string
+		Outputs  map[string]string
+		Fails    bool
+		ErrorMsg string
+	}{
+		{
+			"Test executor : container",
+			&fakeRuntime{stdout: "ok\n", stderr: "warning\n", output: "version=1.0.4\n"},
+			ExecSpec{Name: "cicd-1-1", Dir: tmp, Exec: "/bin/sh", Commands: []string{"-c", "make"}, Env: []string{"CICD_RUN=1", "CICD_OUTPUT=" + outputFile}, Output: outputFile,
+				Image: "golang:1.21", Limits: &LimitsDetail{Cpus: 1.5, Memory: "512m", Procs: 64}},
+			"ok\n",
+			"ok\nwarning\n",
+			map[string]string{"version": "1.0.4"},
+			false,
+			"Executor %s - got (%v) wanted (%v)",
+		},
+		{
+			"Test executor : container failure",
+			&fakeRuntime{stdout: "compiling\n", stderr: "undefined: x\n", err: errors.New("exit status 2")},
+			ExecSpec{Name: "cicd-1-2", Dir: tmp, Exec: "/bin/sh", Commands: []string{"-c", "make"}, Image: "golang:1.21"},
+			"undefined: x\n",
+			"compiling\nundefined: x\n",
+			map[string]string{},
+			true,
+			"Executor %s - got (%v) wanted (%v)",
+		},
+		{
+			"Test executor : invalid memory limit",
+			&fakeRuntime{},
+			ExecSpec{Name: "cicd-1-3", Dir: tmp, Exec: "/bin/sh", Image: "golang:1.21", Limits: &LimitsDetail{Memory: "lots"}},
+			"",
+			"",
+			map[string]string{},
+			true,
+			"Executor %s - got (%v) wanted (%v)",
+		},
+	}
+
+	for _, tt := range tests {
+		fmt.Println(fmt.Sprintf("\nExecuting test : %s", tt.Name))
+		ioutil.WriteFile(outputFile, nil, 0600)
+		var streamed strings.Builder
+		res, err := (&ContainerExecutor{Runtime: tt.Runtime}).Execute(context.Background(), tt.Spec, &streamed)
+		if res != tt.Want || streamed.String() != tt.Streamed {
+			t.Errorf(tt.ErrorMsg, tt.Name, res+" "+streamed.String(), tt.Want+" "+tt.Streamed)
+		}
+		if (err != nil) != tt.Fails {
+			t.Errorf(tt.ErrorMsg, tt.Name, err, tt.Fails)
+		}
+		if outputs, _ := readOutputs(outputFile); fmt.Sprint(outputs) != fmt.Sprint(tt.Outputs) {
+			t.Errorf(tt.ErrorMsg, tt.Name, outputs, tt.Outputs)
+		}
+		fmt.Println("")
+	}
+
+	// the first container got the workspace, the limits and only the stage env
+	c := tests[0].Runtime.spec
+	if c.Mounts[tmp] != WORKSPACE || c.Mounts[outputFile] != CONTAINEROUT || c.Workdir != WORKSPACE {
+		t.Errorf("Executor mounts - got (%v %v) wanted (workspace and output)", c.Mounts, c.Workdir)
+	}
+	if strings.Join(c.Env, " ") != "CICD_RUN=1 CICD_OUTPUT="+CONTAINEROUT {
+		t.Errorf("Executor env - got (%v) wanted (stage env only)", c.Env)
+	}
+	if c.Cpus != 1.5 || c.Memory != 512<<20 || c.Procs != 64 {
+		t.Errorf("Executor limits - got (%v %v %v) wanted (1.5 512m 64)", c.Cpus, c.Memory, c.Procs)
+	}
+	if strings.Join(c.Cmd, " ") != "/bin/sh -c make" || c.Image != "golang:1.21" {
+		t.Errorf("Executor command - got (%v %v) wanted (golang:1.21 /bin/sh -c make)", c.Image, c.Cmd)
+	}
+
+	// the cli runtime passes the env values through its own environment, not on the command line
+	bin := filepath.Join(tmp, "podman")
+	ioutil.WriteFile(bin, []byte("#!/bin/sh\necho \"$@\"\necho \"CICD_RUN=$CICD_RUN\"\n"), 0755)
+	var out strings.Builder
+	err := cliRuntime{bin: bin}.Run(context.Background(), c, &out, &out)
+	want := "run --rm --name cicd-1-1 --workdir /workspace --volume " + tmp + ":/workspace --volume " + outputFile + ":/cicd/output" +
+		" --env CICD_RUN --env CICD_OUTPUT --cpus 1.5 --memory 536870912 --pids-limit 64 golang:1.21 /bin/sh -c make\nCICD_RUN=1\n"
+	if err != nil || out.String() != want {
+		t.Errorf("Executor cli runtime - got (%v %q) wanted (%q)", err, out.String(), want)
+	}
+
+	// the host executor streams both and keeps execCommand's result
+	out.Reset()
+	res, err := HostExecutor{}.Execute(context.Background(), ExecSpec{Dir: tmp, Exec: "/bin/sh", Commands: []string{"-c", "echo out; echo err >&2"}}, &out)
+	if err != nil || res != "out\n" || !strings.Contains(out.String(), "err\n") {
+		t.Errorf("Executor host - got (%v %q %q) wanted (out)", err, res, out.String())
+	}
+}
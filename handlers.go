@@ -3,14 +3,17 @@ package main
 import (
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"path"
 	"strconv"
+	"strings"
+	"sync/atomic"
 
 	"github.com/gorilla/mux"
-	"github.com/microlib/simple"
 )
 
 const (
@@ -22,10 +25,14 @@ var (
 	payload ProjectDetail
 )
 
-func JsonHandler(w http.ResponseWriter, r *http.Request, logger *simple.Logger) {
+func JsonHandler(w http.ResponseWriter, r *http.Request, logger *Logger) {
 	var response Response
 
 	addHeaders(w, r)
+	if project, _ := readProject(); !canAny(principal(r), project, "view") {
+		forbidden(w, r, "view", logger)
+		return
+	}
 
 	pipelines, err := buildSchema(logger)
 	if err != nil {
@@ -37,11 +44,11 @@ func JsonHandler(w http.ResponseWriter, r *http.Request, logger *simple.Logger)
 	}
 
 	b, _ := json.MarshalIndent(response, "", "	")
-	logger.Debug(fmt.Sprintf("JsonHandler response : %s", string(b)))
-	fmt.Fprintf(w, string(b))
+	logger.Debug("JsonHandler response", "response", string(b))
+	fmt.Fprint(w, string(b))
 }
 
-func ForcePipelineHandler(w http.ResponseWriter, r *http.Request, logger *simple.Logger) {
+func ForcePipelineHandler(w http.ResponseWriter, r *http.Request, logger *Logger) {
 	var response Response
 	var project ProjectDetail
 	vars := mux.Vars(r)
@@ -50,78 +57,369 @@ func ForcePipelineHandler(w http.ResponseWriter, r *http.Request, logger *simple
 
 	id, _ := strconv.Atoi(vars["id"])
 	flag, _ := strconv.ParseBool(vars["flag"])
+	// optional run parameters i.e. {"version":"1.0.4","env":"staging"}, they force a single run
+	var parameters map[string]string
+	body, _ := ioutil.ReadAll(r.Body)
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &parameters); err != nil {
+			logger.Error("Unmarshalling parameters", "error", err)
+			response = Response{Name: os.Getenv("NAME"), StatusCode: "400", Status: "KO", Message: "Error unmarshalling parameters", Payload: []Pipeline{}}
+			w.WriteHeader(http.StatusBadRequest)
+			b, _ := json.MarshalIndent(response, "", "	")
+			fmt.Fprint(w, string(b))
+			return
+		}
+	}
 
 	file, err := ioutil.ReadFile("project.json")
 	if err != nil {
-		logger.Error(fmt.Sprintf("Reading project.json %v", err))
+		logger.Error("Reading project.json", "error", err)
 		response = Response{Name: os.Getenv("NAME"), StatusCode: "500", Status: "KO", Message: "Error reading project.json file ", Payload: []Pipeline{}}
 		w.WriteHeader(http.StatusInternalServerError)
 		b, _ := json.MarshalIndent(response, "", "	")
-		fmt.Fprintf(w, string(b))
+		fmt.Fprint(w, string(b))
 		return
 	}
 	err = json.Unmarshal(file, &project)
 	if err != nil {
-		logger.Error(fmt.Sprintf("Unmarshalling project.json %v", err))
+		logger.Error("Unmarshalling project.json", "error", err)
 		response = Response{Name: os.Getenv("NAME"), StatusCode: "500", Status: "KO", Message: "Error unmarshalling project.json file", Payload: []Pipeline{}}
 		w.WriteHeader(http.StatusInternalServerError)
 		b, _ := json.MarshalIndent(response, "", "	")
-		fmt.Fprintf(w, string(b))
+		fmt.Fprint(w, string(b))
+		return
+	} else if id < 0 || id >= len(project.Repositories) {
+		response = Response{Name: os.Getenv("NAME"), StatusCode: "404", Status: "KO", Message: fmt.Sprintf("Repository %d not found", id), Payload: []Pipeline{}}
+		w.WriteHeader(http.StatusNotFound)
+	} else if !can(principal(r), project, project.Repositories[id].Id, "trigger") {
+		forbidden(w, r, "trigger", logger)
 		return
+	} else if parameters != nil {
+		// parameters only apply to this run, the repository is polled now instead of flagged in project.json
+		repo := project.Repositories[id]
+		if !atomic.CompareAndSwapInt32(&polling, 0, 1) {
+			response = Response{Name: os.Getenv("NAME"), StatusCode: "409", Status: "KO", Message: "Pipelines already running", Payload: []Pipeline{}}
+			w.WriteHeader(http.StatusConflict)
+		} else {
+			go func() {
+				defer atomic.StoreInt32(&polling, 0)
+				pollProjects(repo.Id, parameters, logger)
+			}()
+			auditRequest(r, AuditEntry{Action: "force", Repo: repo.Id}, nil, parameters, logger)
+			response = Response{Name: os.Getenv("NAME"), StatusCode: "200", Status: "OK", Message: fmt.Sprintf("Repository %d forced with parameters", id), Payload: []Pipeline{}}
+			w.WriteHeader(http.StatusOK)
+		}
 	} else {
+		before := project.Repositories[id]
 		project.Repositories[id].Force = flag
 		data, _ := json.MarshalIndent(project, "", "  ")
 		ioutil.WriteFile("project.json", data, 0755)
+		auditRequest(r, AuditEntry{Action: "force", Repo: before.Id}, before, project.Repositories[id], logger)
 		response = Response{Name: os.Getenv("NAME"), StatusCode: "200", Status: "OK", Message: fmt.Sprintf("Repository %d force flag set to %t ", id, flag), Payload: []Pipeline{}}
 		w.WriteHeader(http.StatusOK)
 	}
 
 	b, _ := json.MarshalIndent(response, "", "	")
-	logger.Debug(fmt.Sprintf("JsonHandler response : %s", string(b)))
-	fmt.Fprintf(w, string(b))
+	logger.Debug("JsonHandler response", "response", string(b))
+	fmt.Fprint(w, string(b))
 }
 
-func PipelineStatusHandler(w http.ResponseWriter, r *http.Request, logger *simple.Logger) {
+// PipelineStatusHandler - status (and log, the request body) of a callback stage reported by an external system,
+// authenticated with the run's callback token (Authorization: Bearer, CICD_CALLBACK_TOKEN in the stage env)
+// {stage} is the stage id or name
+func PipelineStatusHandler(w http.ResponseWriter, r *http.Request, logger *Logger) {
 	var response Response
-	var stage StageDetail
 	vars := mux.Vars(r)
 
 	addHeaders(w, r)
 
-	repo := vars["repo"]
-	name := vars["name"]
 	status := vars["status"]
 	body, _ := ioutil.ReadAll(r.Body)
-	stage = StageDetail{Name: name, Status: status, Log: string(body)}
-	response = Response{
-		Name:       os.Getenv("NAME"),
-		StatusCode: "200",
-		Status:     "OK",
-		Message:    fmt.Sprintf("Pipeline for stage %s status %s ", name, status),
-		MetaInfo:   repo,
-		Stage:      stage,
-		Payload:    []Pipeline{},
+	stage := StageDetail{Name: vars["stage"], Status: status, Log: string(body)}
+	// nothing is told about the run (or its stages) without its token
+	run, err := runStore.Get(vars["run"])
+	if err != nil {
+		err = errUnauthorized
+	} else if err = checkCallbackToken(run, bearer(r)); err == nil && run.RepoId != vars["repo"] {
+		err = errors.New("run " + run.Id + " is not a run of repository " + vars["repo"])
+	}
+	if err == nil {
+		stage.Id = -1
+		for _, sr := range run.Stages {
+			if strconv.Itoa(sr.Id) == vars["stage"] || strings.EqualFold(sr.Name, vars["stage"]) {
+				stage.Id = sr.Id
+				stage.Name = sr.Name
+			}
+		}
+		if stage.Id < 0 {
+			err = errors.New("stage " + vars["stage"] + " not found")
+		}
 	}
+	if err == errUnauthorized {
+		logger.Warn("Callback", "run", vars["run"], "error", err)
+		response = Response{Name: os.Getenv("NAME"), StatusCode: "401", Status: "KO", Message: err.Error(), MetaInfo: vars["repo"], Payload: []Pipeline{}}
+		w.WriteHeader(http.StatusUnauthorized)
+	} else if err != nil {
+		response = Response{Name: os.Getenv("NAME"), StatusCode: "404", Status: "KO", Message: err.Error(), MetaInfo: vars["repo"], Payload: []Pipeline{}}
+		w.WriteHeader(http.StatusNotFound)
+	} else if err = reportCallback(run, stage.Id, bearer(r), StageReport{Status: status, Log: string(body)}); err != nil {
+		logger.Warn("Callback", "run", run.Id, "stage", stage.Id, "status", status, "error", err)
+		code := http.StatusBadRequest
+		switch err {
+		case errUnauthorized:
+			code = http.StatusUnauthorized
+		case errNotWaiting:
+			code = http.StatusConflict
+		}
+		response = Response{Name: os.Getenv("NAME"), StatusCode: strconv.Itoa(code), Status: "KO", Message: err.Error(), MetaInfo: vars["repo"], Payload: []Pipeline{}}
+		w.WriteHeader(code)
+	} else {
+		recordAudit(&Principal{Name: "callback", Method: "callback"}, r.RemoteAddr, AuditEntry{Action: "stage." + status, Repo: run.RepoId, Run: run.Id, Target: strconv.Itoa(stage.Id)}, nil, nil, logger)
+		response = Response{
+			Name:       os.Getenv("NAME"),
+			StatusCode: "202",
+			Status:     "OK",
+			Message:    fmt.Sprintf("Run %s stage %s status %s", run.Id, stage.Name, status),
+			MetaInfo:   vars["repo"],
+			Stage:      stage,
+			Payload:    []Pipeline{},
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+
+	b, _ := json.MarshalIndent(response, "", "	")
+	logger.Debug("PipelineStatusHandler response", "response", string(b))
+	fmt.Fprint(w, string(b))
+}
+
+func RunsHandler(w http.ResponseWriter, r *http.Request, logger *Logger) {
+	var response Response
+
+	addHeaders(w, r)
+
+	// only the runs of the repositories the caller can view
+	project, _ := readProject()
+	runs := []Run{}
+	for _, run := range runStore.List() {
+		if can(principal(r), project, run.RepoId, "view") {
+			runs = append(runs, run)
+		}
+	}
+	response = Response{Name: os.Getenv("NAME"), StatusCode: "200", Status: "OK", Message: fmt.Sprintf("Found %d runs", len(runs)), Payload: []Pipeline{}, Runs: runs}
 	w.WriteHeader(http.StatusOK)
 
 	b, _ := json.MarshalIndent(response, "", "	")
-	logger.Debug(fmt.Sprintf("JsonHandler response : %s", string(b)))
-	fmt.Fprintf(w, string(b))
+	logger.Debug("RunsHandler response", "response", string(b))
+	fmt.Fprint(w, string(b))
+}
+
+func RunHandler(w http.ResponseWriter, r *http.Request, logger *Logger) {
+	var response Response
+	vars := mux.Vars(r)
+
+	addHeaders(w, r)
+
+	run, err := runStore.Get(vars["id"])
+	if err != nil {
+		response = Response{Name: os.Getenv("NAME"), StatusCode: "404", Status: "KO", Message: err.Error(), Payload: []Pipeline{}}
+		w.WriteHeader(http.StatusNotFound)
+	} else if authorize(principal(r), run.RepoId, "view") != nil {
+		forbidden(w, r, "view", logger)
+		return
+	} else {
+		response = Response{Name: os.Getenv("NAME"), StatusCode: "200", Status: "OK", Message: "Run " + run.Id, Payload: []Pipeline{}, Runs: []Run{run}}
+		w.WriteHeader(http.StatusOK)
+	}
+
+	b, _ := json.MarshalIndent(response, "", "	")
+	logger.Debug("RunHandler response", "response", string(b))
+	fmt.Fprint(w, string(b))
+}
+
+func ArtifactHandler(w http.ResponseWriter, r *http.Request, logger *Logger) {
+	var response Response
+	vars := mux.Vars(r)
+
+	run, err := runStore.Get(vars["id"])
+	if err == nil && authorize(principal(r), run.RepoId, "view") != nil {
+		addHeaders(w, r)
+		forbidden(w, r, "view", logger)
+		return
+	}
+	if err == nil {
+		if artifact, ok := findArtifact(run, vars["name"]); ok {
+			w.Header().Set(CONTENTTYPE, "application/octet-stream")
+			w.Header().Set("Content-Disposition", "attachment; filename=\""+path.Base(artifact.Name)+"\"")
+			w.Header().Set("Digest", "sha-256="+artifact.Digest)
+			http.ServeFile(w, r, artifactPath(artifact.Digest))
+			return
+		}
+		err = errors.New("artifact " + vars["name"] + " not found")
+	}
+
+	addHeaders(w, r)
+	logger.Error("ArtifactHandler", "run", vars["id"], "error", err)
+	response = Response{Name: os.Getenv("NAME"), StatusCode: "404", Status: "KO", Message: err.Error(), Payload: []Pipeline{}}
+	w.WriteHeader(http.StatusNotFound)
+	b, _ := json.MarshalIndent(response, "", "	")
+	fmt.Fprint(w, string(b))
+}
+
+func ApprovalHandler(w http.ResponseWriter, r *http.Request, logger *Logger) {
+	var response Response
+	var approval ApprovalDetail
+	vars := mux.Vars(r)
+
+	addHeaders(w, r)
+
+	stageId, _ := strconv.Atoi(vars["stageId"])
+	body, _ := ioutil.ReadAll(r.Body)
+	json.Unmarshal(body, &approval)
+
+	if run, err := runStore.Get(vars["id"]); err == nil && authorize(principal(r), run.RepoId, "approve") != nil {
+		forbidden(w, r, "approve", logger)
+		return
+	}
+	approval.Approver = approverName(principal(r), approval.Approver)
+	err := decideApproval(vars["id"], stageId, vars["decision"] == "approve", approval.Approver, approval.Comment)
+	if err != nil {
+		logger.Error("Approval", "run", vars["id"], "stage", stageId, "error", err)
+		response = Response{Name: os.Getenv("NAME"), StatusCode: "400", Status: "KO", Message: err.Error(), Payload: []Pipeline{}}
+		w.WriteHeader(http.StatusBadRequest)
+	} else {
+		auditRequest(r, AuditEntry{Action: vars["decision"], Repo: runRepo(vars["id"]), Run: vars["id"], Target: vars["stageId"]}, nil, approval, logger)
+		response = Response{Name: os.Getenv("NAME"), StatusCode: "200", Status: "OK", Message: fmt.Sprintf("Run %s stage %d %s by %s", vars["id"], stageId, vars["decision"], approval.Approver), Payload: []Pipeline{}}
+		w.WriteHeader(http.StatusOK)
+	}
+
+	b, _ := json.MarshalIndent(response, "", "	")
+	logger.Debug("ApprovalHandler response", "response", string(b))
+	fmt.Fprint(w, string(b))
 }
 
-func buildSchema(logger *simple.Logger) ([]Pipeline, error) {
+// WebhookHandler - pull/merge request events from github, gitlab or gitea for the repository {id}
+func WebhookHandler(w http.ResponseWriter, r *http.Request, logger *Logger) {
+	var response Response
+	vars := mux.Vars(r)
+
+	addHeaders(w, r)
+
+	body, _ := ioutil.ReadAll(r.Body)
+	repo, err := findRepository(vars["id"])
+	status := http.StatusBadRequest
+	if err == nil {
+		// the route is open, only events signed with the repository's webhook secret are trusted
+		var cred CredentialDetail
+		if repo.Webhook == "" {
+			err = errors.New("no webhook secret configured")
+		} else if cred, err = secretStore.Get(repo.Webhook); err == nil {
+			err = verifyWebhook(r, body, cred.Token)
+		}
+		if err != nil {
+			status = http.StatusUnauthorized
+		}
+	}
+	var pr *PullRequestDetail
+	if err == nil {
+		pr, err = parseWebhook(r, body)
+	}
+	if err == nil && pr != nil {
+		recordAudit(&Principal{Name: "webhook", Method: "webhook"}, r.RemoteAddr, AuditEntry{Action: "trigger", Repo: repo.Id, Target: pr.Ref}, nil, pr, logger)
+		err = enqueue(r.Context(), repo, Trigger{Event: "pull_request", Sha: pr.Sha, Ref: builtPullRequestRef(pr.Number), PullRequest: pr}, logger)
+	}
+
+	if err != nil {
+		logger.Error("Webhook", "repo", vars["id"], "error", err)
+		response = Response{Name: os.Getenv("NAME"), StatusCode: strconv.Itoa(status), Status: "KO", Message: err.Error(), Payload: []Pipeline{}}
+		w.WriteHeader(status)
+	} else if pr == nil {
+		response = Response{Name: os.Getenv("NAME"), StatusCode: "200", Status: "OK", Message: "Event ignored", Payload: []Pipeline{}}
+		w.WriteHeader(http.StatusOK)
+	} else {
+		response = Response{Name: os.Getenv("NAME"), StatusCode: "202", Status: "OK", Message: fmt.Sprintf("Pull request #%d queued", pr.Number), Payload: []Pipeline{}}
+		w.WriteHeader(http.StatusAccepted)
+	}
+
+	b, _ := json.MarshalIndent(response, "", "	")
+	fmt.Fprint(w, string(b))
+}
+
+func CredentialsHandler(w http.ResponseWriter, r *http.Request, logger *Logger) {
+	var response Response
+
+	addHeaders(w, r)
+	if err := authorize(principal(r), "", "secrets"); err != nil {
+		forbidden(w, r, "secrets", logger)
+		return
+	}
+
+	creds, err := secretStore.List()
+	if err != nil {
+		logger.Error("Listing credentials", "error", err)
+		response = Response{Name: os.Getenv("NAME"), StatusCode: "500", Status: "KO", Message: err.Error(), Payload: []Pipeline{}}
+		w.WriteHeader(http.StatusInternalServerError)
+	} else {
+		response = Response{Name: os.Getenv("NAME"), StatusCode: "200", Status: "OK", Message: fmt.Sprintf("Found %d credentials", len(creds)), Payload: []Pipeline{}, Credentials: creds}
+		w.WriteHeader(http.StatusOK)
+	}
+
+	b, _ := json.MarshalIndent(response, "", "	")
+	fmt.Fprint(w, string(b))
+}
+
+// UpdateCredentialHandler - PUT stores the credential, DELETE removes it
+// the secret values are never returned
+func UpdateCredentialHandler(w http.ResponseWriter, r *http.Request, logger *Logger) {
+	var response Response
+	var cred CredentialDetail
+	vars := mux.Vars(r)
+
+	addHeaders(w, r)
+	if err := authorize(principal(r), "", "secrets"); err != nil {
+		forbidden(w, r, "secrets", logger)
+		return
+	}
+
+	var err error
+	if r.Method == http.MethodDelete {
+		err = secretStore.Delete(vars["name"])
+	} else {
+		body, _ := ioutil.ReadAll(r.Body)
+		if err = json.Unmarshal(body, &cred); err == nil {
+			if err = validateCredential(cred); err == nil {
+				cred.Name = ""
+				err = secretStore.Put(vars["name"], cred)
+			}
+		}
+	}
+	if err != nil {
+		logger.Error("Credential", "name", vars["name"], "error", err)
+		response = Response{Name: os.Getenv("NAME"), StatusCode: "400", Status: "KO", Message: err.Error(), Payload: []Pipeline{}}
+		w.WriteHeader(http.StatusBadRequest)
+	} else {
+		// the secret values are never audited
+		auditRequest(r, AuditEntry{Action: "credential." + strings.ToLower(r.Method), Target: vars["name"]}, nil, nil, logger)
+		response = Response{Name: os.Getenv("NAME"), StatusCode: "200", Status: "OK", Message: fmt.Sprintf("Credential %s updated", vars["name"]), Payload: []Pipeline{}}
+		w.WriteHeader(http.StatusOK)
+	}
+
+	b, _ := json.MarshalIndent(response, "", "	")
+	fmt.Fprint(w, string(b))
+}
+
+func buildSchema(logger *Logger) ([]Pipeline, error) {
 	var pipeline Pipeline
 	var pipelines []Pipeline
 
 	file, err := ioutil.ReadFile("project.json")
 	if err != nil {
-		logger.Error(fmt.Sprintf("Reading project.json %v", err))
+		logger.Error("Reading project.json", "error", err)
 		return pipelines, err
 	}
 	err = json.Unmarshal(file, &payload)
-	logger.Debug(fmt.Sprintf("Payload %v", payload))
+	logger.Debug("Payload", "payload", payload)
 	if err != nil {
-		logger.Error(fmt.Sprintf("Unmarshalling project.json %v", err))
+		logger.Error("Unmarshalling project.json", "error", err)
 		return pipelines, err
 	}
 
@@ -131,24 +429,27 @@ func buildSchema(logger *simple.Logger) ([]Pipeline, error) {
 	httpClient := &http.Client{Transport: tr}
 
 	for x, _ := range payload.Repositories {
-		logger.Debug(fmt.Sprintf("Payload %v", payload))
+		logger.Debug("Payload", "payload", payload)
 		req, _ := http.NewRequest("GET", payload.Repositories[x].RawUrl, nil)
 		req.Header.Set("X-Api-Key", os.Getenv("APIKEY"))
 		req.Header.Set("Content-Type", "application/json")
 		resp, err := httpClient.Do(req)
 		if err != nil {
-			logger.Error(fmt.Sprintf("Http request %v", err))
+			logger.Error("Http request", "url", payload.Repositories[x].RawUrl, "error", err)
+			schemaFetchErrors.WithLabelValues(payload.Repositories[x].RawUrl).Inc()
 			continue
 		}
 		defer resp.Body.Close()
 		body, e := ioutil.ReadAll(resp.Body)
 		if e != nil {
-			logger.Error(fmt.Sprintf("Could not read cicd.json file %v", e))
+			logger.Error("Could not read cicd.json file", "url", payload.Repositories[x].RawUrl, "error", e)
+			schemaFetchErrors.WithLabelValues(payload.Repositories[x].RawUrl).Inc()
 			continue
 		}
 		err = json.Unmarshal(body, &pipeline)
 		if err != nil {
-			logger.Error(fmt.Sprintf("Unmarshalling project.json %v", err))
+			logger.Error("Unmarshalling cicd.json", "url", payload.Repositories[x].RawUrl, "error", err)
+			schemaFetchErrors.WithLabelValues(payload.Repositories[x].RawUrl).Inc()
 			continue
 		}
 		pipelines = append(pipelines, pipeline)
@@ -157,13 +458,138 @@ func buildSchema(logger *simple.Logger) ([]Pipeline, error) {
 }
 
 func IsAlive(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "{ \"version\" : \""+os.Getenv("VERSION")+"\" , \"name\": \""+os.Getenv("NAME")+"\" }")
+	fmt.Fprint(w, "{ \"version\" : \""+os.Getenv("VERSION")+"\" , \"name\": \""+os.Getenv("NAME")+"\" }")
 }
 
 // headers (with cors) utility
 func addHeaders(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set(CONTENTTYPE, APPLICATIONJSON)
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if origin := r.Header.Get("Origin"); origin != "" && allowedOrigin(r) {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Vary", "Origin")
+	}
 	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
 	w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
 }
+
+// StageLogHandler - the output of a stage of the run as text
+func StageLogHandler(w http.ResponseWriter, r *http.Request, logger *Logger) {
+	var response Response
+	vars := mux.Vars(r)
+
+	run, err := runStore.Get(vars["id"])
+	if err == nil && authorize(principal(r), run.RepoId, "logs") != nil {
+		addHeaders(w, r)
+		forbidden(w, r, "logs", logger)
+		return
+	}
+	if err == nil {
+		stageId, _ := strconv.Atoi(vars["stageId"])
+		var data []byte
+		if data, err = ioutil.ReadFile(stageLogPath(run.Id, stageId)); err == nil {
+			w.Header().Set(CONTENTTYPE, "text/plain; charset=utf-8")
+			w.WriteHeader(http.StatusOK)
+			w.Write(data)
+			return
+		}
+		err = fmt.Errorf("no log for stage %d of run %s", stageId, run.Id)
+	}
+
+	addHeaders(w, r)
+	response = Response{Name: os.Getenv("NAME"), StatusCode: "404", Status: "KO", Message: err.Error(), Payload: []Pipeline{}}
+	w.WriteHeader(http.StatusNotFound)
+	b, _ := json.MarshalIndent(response, "", "	")
+	fmt.Fprint(w, string(b))
+}
+
+// ProjectHandler - GET returns project.json, PUT replaces it (admin only)
+func ProjectHandler(w http.ResponseWriter, r *http.Request, logger *Logger) {
+	var response Response
+	var project ProjectDetail
+
+	addHeaders(w, r)
+	action := "view"
+	if r.Method == http.MethodPut {
+		action = "project"
+	}
+	current, err := readProject()
+	if (action == "view" && !canAny(principal(r), current, action)) || (action == "project" && authorize(principal(r), "", action) != nil) {
+		forbidden(w, r, action, logger)
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		body, _ := ioutil.ReadAll(r.Body)
+		if err = json.Unmarshal(body, &project); err == nil {
+			if err = validateProject(project); err == nil {
+				data, _ := json.MarshalIndent(project, "", "  ")
+				if err = ioutil.WriteFile("project.json", data, 0755); err == nil {
+					auditRequest(r, AuditEntry{Action: "project.update"}, current, project, logger)
+				}
+			}
+		}
+	} else {
+		project = current
+	}
+	if err != nil {
+		logger.Error("Project", "error", err)
+		response = Response{Name: os.Getenv("NAME"), StatusCode: "400", Status: "KO", Message: err.Error(), Payload: []Pipeline{}}
+		w.WriteHeader(http.StatusBadRequest)
+		b, _ := json.MarshalIndent(response, "", "	")
+		fmt.Fprint(w, string(b))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	b, _ := json.MarshalIndent(project, "", "  ")
+	fmt.Fprint(w, string(b))
+}
+
+// PermissionsHandler - the roles and allowed actions of the caller
+func PermissionsHandler(w http.ResponseWriter, r *http.Request, logger *Logger) {
+	addHeaders(w, r)
+
+	project, err := readProject()
+	if err != nil {
+		logger.Error("Reading project.json", "error", err)
+	}
+	perms := permissions(principal(r), project)
+	response := Response{Name: os.Getenv("NAME"), StatusCode: "200", Status: "OK", Message: "Permissions of " + perms.User, Payload: []Pipeline{}, Permissions: &perms}
+	w.WriteHeader(http.StatusOK)
+
+	b, _ := json.MarshalIndent(response, "", "	")
+	fmt.Fprint(w, string(b))
+}
+
+// AuditHandler - the audit log filtered by ?actor=, ?action=, ?since= and ?until= (unix seconds or RFC3339)
+func AuditHandler(w http.ResponseWriter, r *http.Request, logger *Logger) {
+	var response Response
+
+	addHeaders(w, r)
+	if err := authorize(principal(r), "", "audit"); err != nil {
+		forbidden(w, r, "audit", logger)
+		return
+	}
+
+	filter := AuditFilter{Actor: r.URL.Query().Get("actor"), Action: r.URL.Query().Get("action")}
+	since, err := auditTime(r.URL.Query().Get("since"))
+	if err == nil {
+		filter.Since = since
+		filter.Until, err = auditTime(r.URL.Query().Get("until"))
+	}
+	var entries []AuditEntry
+	if err == nil {
+		entries, err = auditLog.Query(filter)
+	}
+	if err != nil {
+		logger.Error("Audit", "error", err)
+		response = Response{Name: os.Getenv("NAME"), StatusCode: "400", Status: "KO", Message: err.Error(), Payload: []Pipeline{}}
+		w.WriteHeader(http.StatusBadRequest)
+	} else {
+		response = Response{Name: os.Getenv("NAME"), StatusCode: "200", Status: "OK", Message: fmt.Sprintf("Found %d audit entries", len(entries)), Payload: []Pipeline{}, Audit: entries}
+		w.WriteHeader(http.StatusOK)
+	}
+
+	b, _ := json.MarshalIndent(response, "", "	")
+	fmt.Fprint(w, string(b))
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// LimitError - the stage was stopped because it went over one of its limits
+// Limit is one of cpu_time, memory, memory_likely (a guess without a cgroup), procs, output or wall_time
+type LimitError struct {
+	Limit string
+	Max   string
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s limit exceeded (%s)", e.Limit, e.Max)
+}
+
+// limitReason - the stage failure reason for limit violations (limit:<name>), empty for other errors
+func limitReason(err error) string {
+	var le *LimitError
+	if errors.As(err, &le) {
+		return "limit:" + le.Limit
+	}
+	return ""
+}
+
+// outputLimit - the bytes stdout and stderr may write together, the command is killed at the first byte over
+type outputLimit struct {
+	mu       sync.Mutex
+	max      int64
+	n        int64
+	exceeded bool
+	kill     func()
+}
+
+type limitedWriter struct {
+	l *outputLimit
+	w io.Writer
+}
+
+func (lw limitedWriter) Write(p []byte) (int, error) {
+	l := lw.l
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.exceeded {
+		return len(p), nil
+	}
+	if l.max > 0 && l.n+int64(len(p)) > l.max {
+		lw.w.Write(p[:l.max-l.n])
+		l.n, l.exceeded = l.max, true
+		l.kill()
+		return len(p), nil
+	}
+	l.n += int64(len(p))
+	return lw.w.Write(p)
+}
+
+// execLimited - execStream with the stage's limits, wall time and output are enforced here, cpu time, memory
+// and processes (and the sandbox) by limitCommand
+func execLimited(ctx context.Context, spec ExecSpec, out io.Writer) (string, error) {
+	var l LimitsDetail
+	if spec.Limits != nil {
+		l = *spec.Limits
+	}
+	memory, err := parseBytes(l.Memory)
+	if err != nil {
+		return "", err
+	}
+	output, err := parseBytes(l.Output)
+	if err != nil {
+		return "", err
+	}
+	lctx, cancel := context.WithCancel(ctx)
+	if l.Wall > 0 {
+		lctx, cancel = context.WithTimeout(ctx, time.Duration(l.Wall)*time.Second)
+	}
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	limit := &outputLimit{max: output, kill: cancel}
+	cmd := exec.CommandContext(lctx, spec.Exec, spec.Commands...)
+	cmd.Dir = spec.Dir
+	cmd.Env = append(os.Environ(), spec.Env...)
+	cmd.Stdout = limitedWriter{l: limit, w: io.MultiWriter(&stdout, out)}
+	cmd.Stderr = limitedWriter{l: limit, w: io.MultiWriter(&stderr, out)}
+	// the commands' children hold on to the pipes after a kill
+	cmd.WaitDelay = 5 * time.Second
+	exceeded, err := limitCommand(cmd, spec, l, memory)
+	if err != nil {
+		return "", err
+	}
+	err = cmd.Run()
+	reason := exceeded(cmd.ProcessState)
+
+	limit.mu.Lock()
+	defer limit.mu.Unlock()
+	switch {
+	case limit.exceeded:
+		err = &LimitError{Limit: "output", Max: l.Output}
+	case l.Wall > 0 && ctx.Err() == nil && lctx.Err() == context.DeadlineExceeded:
+		err = &LimitError{Limit: "wall_time", Max: (time.Duration(l.Wall) * time.Second).String()}
+	case err != nil && reason == "cpu_time":
+		err = &LimitError{Limit: reason, Max: (time.Duration(l.CpuTime) * time.Second).String()}
+	case err != nil && (reason == "memory" || reason == "memory_likely"):
+		err = &LimitError{Limit: reason, Max: l.Memory}
+	case err != nil && reason == "procs":
+		err = &LimitError{Limit: reason, Max: fmt.Sprint(l.Procs)}
+	}
+	if err != nil {
+		return stderr.String(), err
+	}
+	return stdout.String(), nil
+}
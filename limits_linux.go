@@ -0,0 +1,305 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// RLIMIT_NPROC - missing from the syscall package
+const RLIMIT_NPROC = 0x6
+
+// sandboxConfig - what the sandbox-exec helper applies before it runs the command, passed in CICD_SANDBOX
+type sandboxConfig struct {
+	CpuTime    int   `json:"cpuTime,omitempty"`
+	Memory     int64 `json:"memory,omitempty"`
+	Procs      int   `json:"procs,omitempty"`
+	Namespaces bool  `json:"namespaces,omitempty"`
+	Uid        int   `json:"uid,omitempty"`
+	Gid        int   `json:"gid,omitempty"`
+}
+
+// cgroup - the stage's child of the (delegated, v2) CICD_CGROUP cgroup
+type cgroup struct {
+	dir string
+	fd  int
+}
+
+// limitCommand - runs cmd in its own process group (killed as a whole) and, when the stage has cpu, memory or
+// process limits or is sandboxed, through the sandbox-exec helper. Memory and processes go to a cgroup when
+// CICD_CGROUP is set, rlimits otherwise. The returned func tells which limit (if any) the finished command hit
+func limitCommand(cmd *exec.Cmd, spec ExecSpec, l LimitsDetail, memory int64) (func(*os.ProcessState) string, error) {
+	attr := &syscall.SysProcAttr{Setpgid: true}
+	cmd.SysProcAttr = attr
+	cmd.Cancel = func() error { return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL) }
+
+	cfg := sandboxConfig{CpuTime: l.CpuTime, Memory: memory, Procs: l.Procs, Namespaces: spec.Sandbox}
+	group, err := newCgroup(spec.Name, memory, l.Procs)
+	if err != nil {
+		return nil, err
+	}
+	if group != nil {
+		cfg.Memory, cfg.Procs = 0, 0
+		attr.UseCgroupFD, attr.CgroupFD = true, group.fd
+	}
+	if spec.Sandbox {
+		attr.Cloneflags = syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNET | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS
+		if os.Getuid() != 0 {
+			// unprivileged servers get the namespaces through a user namespace where their user is root, the
+			// helper would lose the capabilities it needs for the mounts on exec as any other uid
+			attr.Cloneflags |= syscall.CLONE_NEWUSER
+			attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}}
+			attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}}
+		}
+		if cfg.Uid, cfg.Gid, err = sandboxUser(); err == nil && cfg.Uid != 0 {
+			err = sandboxOwn(spec, cfg.Uid, cfg.Gid)
+		}
+		if err != nil {
+			group.remove()
+			return nil, err
+		}
+	}
+	if cfg != (sandboxConfig{}) {
+		self, err := os.Executable()
+		if err != nil {
+			group.remove()
+			return nil, err
+		}
+		b, _ := json.Marshal(cfg)
+		cmd.Path = self
+		cmd.Args = append([]string{self, "sandbox-exec", spec.Exec}, spec.Commands...)
+		cmd.Env = append(cmd.Env, "CICD_SANDBOX="+string(b))
+	}
+
+	return func(ps *os.ProcessState) string {
+		defer group.remove()
+		if ps == nil {
+			return ""
+		}
+		if reason := group.exceeded(); reason != "" {
+			return reason
+		}
+		// SIGXCPU, passed on as an exit code by the helper in a sandbox
+		if ws, ok := ps.Sys().(syscall.WaitStatus); ok && l.CpuTime > 0 && (ws.Signal() == syscall.SIGXCPU || ws.ExitStatus() == 128+int(syscall.SIGXCPU)) {
+			return "cpu_time"
+		}
+		ru, ok := ps.SysUsage().(*syscall.Rusage)
+		if !ok {
+			return ""
+		}
+		// rusage covers the helper and the children it waited for, SIGKILL at the hard limit
+		cpu := time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+		if l.CpuTime > 0 && cpu >= time.Duration(l.CpuTime)*time.Second {
+			return "cpu_time"
+		}
+		// without a cgroup there is no oom event, a peak rss close to RLIMIT_AS is only a hint
+		if cfg.Memory > 0 && ru.Maxrss*1024 >= cfg.Memory*9/10 {
+			return "memory_likely"
+		}
+		return ""
+	}, nil
+}
+
+// sandboxUser - SANDBOX_USER (a user name or uid[:gid]) the sandboxed commands run as, none keeps the server's.
+// Only a root server can switch users, the user namespace of an unprivileged one maps its own user only
+func sandboxUser() (int, int, error) {
+	name := os.Getenv("SANDBOX_USER")
+	if name == "" {
+		return 0, 0, nil
+	}
+	if os.Getuid() != 0 {
+		return 0, 0, errors.New("SANDBOX_USER needs a server running as root")
+	}
+	ids := strings.SplitN(name, ":", 2)
+	if uid, err := strconv.Atoi(ids[0]); err == nil {
+		gid := uid
+		if len(ids) == 2 {
+			if gid, err = strconv.Atoi(ids[1]); err != nil {
+				return 0, 0, fmt.Errorf("invalid SANDBOX_USER %s", name)
+			}
+		}
+		return uid, gid, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+	return uid, gid, nil
+}
+
+// sandboxOwn - hands the stage directory and the output file over to the sandbox user
+func sandboxOwn(spec ExecSpec, uid int, gid int) error {
+	err := filepath.Walk(spec.Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, uid, gid)
+	})
+	if err == nil && spec.Output != "" {
+		err = os.Chown(spec.Output, uid, gid)
+	}
+	return err
+}
+
+// newCgroup - creates <CICD_CGROUP>/<name> with memory.max and pids.max, nil without CICD_CGROUP
+func newCgroup(name string, memory int64, procs int) (*cgroup, error) {
+	root := os.Getenv("CICD_CGROUP")
+	if root == "" || (memory == 0 && procs == 0) {
+		return nil, nil
+	}
+	dir := filepath.Join(root, name)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return nil, err
+	}
+	var err error
+	if memory > 0 {
+		err = ioutil.WriteFile(filepath.Join(dir, "memory.max"), []byte(strconv.FormatInt(memory, 10)), 0644)
+		// no swapping around the limit (absent without swap accounting)
+		ioutil.WriteFile(filepath.Join(dir, "memory.swap.max"), []byte("0"), 0644)
+	}
+	if err == nil && procs > 0 {
+		err = ioutil.WriteFile(filepath.Join(dir, "pids.max"), []byte(strconv.Itoa(procs)), 0644)
+	}
+	fd := -1
+	if err == nil {
+		fd, err = syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	}
+	if err != nil {
+		os.Remove(dir)
+		return nil, fmt.Errorf("cgroup %s : %v", dir, err)
+	}
+	return &cgroup{dir: dir, fd: fd}, nil
+}
+
+// exceeded - memory when the oom killer ran in the cgroup, procs when a fork hit pids.max
+func (g *cgroup) exceeded() string {
+	if g == nil {
+		return ""
+	}
+	if cgroupEvent(filepath.Join(g.dir, "memory.events"), "oom_kill") > 0 {
+		return "memory"
+	}
+	if cgroupEvent(filepath.Join(g.dir, "pids.events"), "max") > 0 {
+		return "procs"
+	}
+	return ""
+}
+
+// remove - kills what is left in the cgroup and removes it
+func (g *cgroup) remove() {
+	if g == nil {
+		return
+	}
+	syscall.Close(g.fd)
+	ioutil.WriteFile(filepath.Join(g.dir, "cgroup.kill"), []byte("1"), 0644)
+	for x := 0; x < 50; x++ {
+		if err := os.Remove(g.dir); err == nil || os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// cgroupEvent - the counter of key in a cgroup events file
+func cgroupEvent(file string, key string) int {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) == 2 && fields[0] == key {
+			n, _ := strconv.Atoi(fields[1])
+			return n
+		}
+	}
+	return 0
+}
+
+// sandboxExec - the sandbox-exec helper (cicd sandbox-exec <command> [args]). In a sandbox it is pid 1 of the
+// new pid namespace: it mounts a private /proc and runs itself again for the command, which applies the
+// rlimits, drops to the sandbox user and execs the command
+func sandboxExec(args []string) {
+	var cfg sandboxConfig
+	json.Unmarshal([]byte(os.Getenv("CICD_SANDBOX")), &cfg)
+	fail := func(err error) {
+		fmt.Fprintln(os.Stderr, "sandbox :", err)
+		os.Exit(126)
+	}
+	if len(args) == 0 {
+		fail(errors.New("no command"))
+	}
+
+	if cfg.Namespaces {
+		if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+			fail(err)
+		}
+		if err := syscall.Mount("proc", "/proc", "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+			fail(err)
+		}
+		cfg.Namespaces = false
+		b, _ := json.Marshal(cfg)
+		self, _ := os.Executable()
+		cmd := exec.Command(self, append([]string{"sandbox-exec"}, args...)...)
+		cmd.Env = append(os.Environ(), "CICD_SANDBOX="+string(b))
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		err := cmd.Run()
+		if cmd.ProcessState == nil {
+			fail(err)
+		}
+		if ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			os.Exit(128 + int(ws.Signal()))
+		}
+		os.Exit(cmd.ProcessState.ExitCode())
+	}
+
+	os.Unsetenv("CICD_SANDBOX")
+	if cfg.CpuTime > 0 {
+		// SIGXCPU at the limit, SIGKILL a second later
+		if err := syscall.Setrlimit(syscall.RLIMIT_CPU, &syscall.Rlimit{Cur: uint64(cfg.CpuTime), Max: uint64(cfg.CpuTime) + 1}); err != nil {
+			fail(err)
+		}
+	}
+	if cfg.Memory > 0 {
+		if err := syscall.Setrlimit(syscall.RLIMIT_AS, &syscall.Rlimit{Cur: uint64(cfg.Memory), Max: uint64(cfg.Memory)}); err != nil {
+			fail(err)
+		}
+	}
+	if cfg.Uid != 0 {
+		if err := syscall.Setgroups([]int{}); err != nil {
+			fail(err)
+		}
+		if err := syscall.Setgid(cfg.Gid); err != nil {
+			fail(err)
+		}
+		if err := syscall.Setuid(cfg.Uid); err != nil {
+			fail(err)
+		}
+	}
+	if cfg.Procs > 0 {
+		// after the setuid, the helper's own threads count against it until the exec
+		if err := syscall.Setrlimit(RLIMIT_NPROC, &syscall.Rlimit{Cur: uint64(cfg.Procs), Max: uint64(cfg.Procs)}); err != nil {
+			fail(err)
+		}
+	}
+	path, err := exec.LookPath(args[0])
+	if err != nil {
+		fail(err)
+	}
+	fail(syscall.Exec(path, args, os.Environ()))
+}
@@ -0,0 +1,81 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func init() {
+	// the test binary stands in for the server as the sandbox-exec helper
+	if len(os.Args) > 1 && os.Args[1] == "sandbox-exec" {
+		sandboxExec(os.Args[2:])
+	}
+}
+
+func TestLimits(t *testing.T) {
+	tmp, _ := ioutil.TempDir("", "limits")
+	defer os.RemoveAll(tmp)
+
+	// create anonymous struct
+	tests := []struct {
+		Name     string
+		Script   string
+		Limits   *LimitsDetail
+		Sandbox  bool
+		Want     string
+		Reason   string
+		ErrorMsg string
+	}{
+		{"Test limits : within limits", "echo ok", &LimitsDetail{CpuTime: 5, Memory: "256m", Output: "1k", Wall: 5}, false, "ok\n", "", "Limits %s - got (%v) wanted (%v)"},
+		{"Test limits : wall time", "sleep 10", &LimitsDetail{Wall: 1}, false, "", "limit:wall_time", "Limits %s - got (%v) wanted (%v)"},
+		{"Test limits : output", "yes", &LimitsDetail{Output: "64k"}, false, "", "limit:output", "Limits %s - got (%v) wanted (%v)"},
+		{"Test limits : cpu time", "while :; do :; done", &LimitsDetail{CpuTime: 1, Wall: 20}, false, "", "limit:cpu_time", "Limits %s - got (%v) wanted (%v)"},
+		{"Test limits : failing command", "exit 3", &LimitsDetail{CpuTime: 5}, false, "", "", "Limits %s - got (%v) wanted (%v)"},
+		{"Test limits : sandbox pid namespace", "tr '\\0' ' ' < /proc/1/cmdline", nil, true, " sandbox-exec /bin/sh -c ", "", "Limits %s - got (%v) wanted (%v)"},
+		{"Test limits : sandbox network", "cat /proc/net/dev | tail -n +3 | cut -d: -f1 | tr -d ' '", nil, true, "lo\n", "", "Limits %s - got (%v) wanted (%v)"},
+	}
+
+	for _, tt := range tests {
+		fmt.Println(fmt.Sprintf("\nExecuting test : %s", tt.Name))
+		var streamed strings.Builder
+		spec := ExecSpec{Name: "cicd-limits-1", Dir: tmp, Exec: "/bin/sh", Commands: []string{"-c", tt.Script}, Limits: tt.Limits, Sandbox: tt.Sandbox}
+		res, err := HostExecutor{}.Execute(context.Background(), spec, &streamed)
+		if reason := limitReason(err); reason != tt.Reason {
+			t.Errorf(tt.ErrorMsg, tt.Name, err, tt.Reason)
+		}
+		if tt.Want != "" && (err != nil || !strings.Contains(res, tt.Want)) {
+			t.Errorf(tt.ErrorMsg, tt.Name, fmt.Sprintf("%q %v", res, err), tt.Want)
+		}
+		if tt.Want == "" && err == nil {
+			t.Errorf(tt.ErrorMsg, tt.Name, err, "an error")
+		}
+		if tt.Limits != nil && tt.Limits.Output != "" && int64(streamed.Len()) > 64<<10 {
+			t.Errorf(tt.ErrorMsg, tt.Name, streamed.Len(), "at most 64k streamed")
+		}
+		fmt.Println("")
+	}
+
+	// the sandbox user owns the stage directory and the output file (only root servers switch users)
+	os.Setenv("SANDBOX_USER", "65534")
+	defer os.Unsetenv("SANDBOX_USER")
+	output, _ := newOutputFile()
+	defer os.Remove(output)
+	spec := ExecSpec{Name: "cicd-limits-2", Dir: tmp, Exec: "/bin/sh", Commands: []string{"-c", "id -u; echo built > out.txt; echo user=$(id -u) >> $CICD_OUTPUT"},
+		Env: []string{"CICD_OUTPUT=" + output}, Output: output, Sandbox: true}
+	res, err := HostExecutor{}.Execute(context.Background(), spec, ioutil.Discard)
+	if os.Getuid() != 0 {
+		if err == nil {
+			t.Errorf("Limits sandbox user - got (%v) wanted (refused without root)", err)
+		}
+		return
+	}
+	if outputs, _ := readOutputs(output); err != nil || res != "65534\n" || outputs["user"] != "65534" {
+		t.Errorf("Limits sandbox user - got (%q %v %v) wanted (65534)", res, err, outputs)
+	}
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// limitCommand - only the wall time and output limits are available off linux
+func limitCommand(cmd *exec.Cmd, spec ExecSpec, l LimitsDetail, memory int64) (func(*os.ProcessState) string, error) {
+	if spec.Sandbox || l.CpuTime > 0 || memory > 0 || l.Procs > 0 {
+		return nil, errors.New("cpu time, memory and process limits and the sandbox need linux")
+	}
+	return func(*os.ProcessState) string { return "" }, nil
+}
+
+// sandboxExec - the sandbox-exec helper is linux only
+func sandboxExec(args []string) {
+	fmt.Fprintln(os.Stderr, "sandbox : not supported")
+	os.Exit(126)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// LevelTrace - below debug, slog has no trace level
+const LevelTrace = slog.Level(-8)
+
+// Logger - structured leveled logger (log/slog), Info/Warn/Error/Debug come from slog
+// the repo, run, stage and commit fields are attached with With/ForRun/ForStage
+type Logger struct {
+	*slog.Logger
+}
+
+// NewLogger - level is one of trace, debug, info, warn, error (default info),
+// format json or text (default text)
+func NewLogger(level string, format string, w io.Writer) *Logger {
+	levels := map[string]slog.Level{
+		"trace": LevelTrace,
+		"debug": slog.LevelDebug,
+		"info":  slog.LevelInfo,
+		"warn":  slog.LevelWarn,
+		"error": slog.LevelError,
+	}
+	lvl, ok := levels[strings.ToLower(level)]
+	if !ok {
+		lvl = slog.LevelInfo
+	}
+	opts := &slog.HandlerOptions{
+		Level: lvl,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.LevelKey && a.Value.Any() == LevelTrace {
+				a.Value = slog.StringValue("TRACE")
+			}
+			return a
+		},
+	}
+	if strings.ToLower(format) == "json" {
+		return &Logger{slog.New(slog.NewJSONHandler(w, opts))}
+	}
+	return &Logger{slog.New(slog.NewTextHandler(w, opts))}
+}
+
+func (l *Logger) Trace(msg string, args ...any) {
+	l.Log(context.Background(), LevelTrace, msg, args...)
+}
+
+// With - the logger with the fields added to every record
+func (l *Logger) With(args ...any) *Logger {
+	return &Logger{l.Logger.With(args...)}
+}
+
+// ForRun - repo, run and commit fields of the run
+func (l *Logger) ForRun(run *Run) *Logger {
+	return l.With("repo", run.RepoId, "run", run.Id, "commit", run.Commit)
+}
+
+// ForStage - stage id and name fields
+func (l *Logger) ForStage(stage StageDetail) *Logger {
+	return l.With("stage", stage.Id, "stagename", stage.Name)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	run := &Run{Id: "20240101-abc", RepoId: "1", Commit: "abc123"}
+
+	// create anonymous struct
+	tests := []struct {
+		Name     string
+		Level    string
+		Log      func(l *Logger)
+		Want     map[string]interface{}
+		ErrorMsg string
+	}{
+		{
+			"Test logger : run and stage fields",
+			"info",
+			func(l *Logger) {
+				l.ForRun(run).ForStage(StageDetail{Id: 2, Name: "Build"}).Info("Result", "stdout", "ok")
+			},
+			map[string]interface{}{"level": "INFO", "msg": "Result", "repo": "1", "run": "20240101-abc", "commit": "abc123", "stage": float64(2), "stagename": "Build", "stdout": "ok"},
+			"Logger %s - got (%v) wanted (%v)",
+		},
+		{
+			"Test logger : trace level",
+			"trace",
+			func(l *Logger) { l.Trace("Sending websocket message", "message", "1-2:success") },
+			map[string]interface{}{"level": "TRACE", "msg": "Sending websocket message", "message": "1-2:success"},
+			"Logger %s - got (%v) wanted (%v)",
+		},
+		{
+			"Test logger : below level is dropped",
+			"error",
+			func(l *Logger) { l.Info("dropped") },
+			nil,
+			"Logger %s - got (%v) wanted (%v)",
+		},
+	}
+
+	for _, tt := range tests {
+		fmt.Println(fmt.Sprintf("\nExecuting test : %s", tt.Name))
+		buf.Reset()
+		tt.Log(NewLogger(tt.Level, "json", &buf))
+		if tt.Want == nil {
+			if buf.Len() != 0 {
+				t.Errorf(tt.ErrorMsg, tt.Name, buf.String(), "")
+			}
+			continue
+		}
+		var got map[string]interface{}
+		if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+			t.Fatalf(tt.ErrorMsg, tt.Name, err, nil)
+		}
+		for k, v := range tt.Want {
+			if got[k] != v {
+				t.Errorf(tt.ErrorMsg, tt.Name, k+"="+fmt.Sprint(got[k]), v)
+			}
+		}
+		fmt.Println("")
+	}
+
+	// text output
+	buf.Reset()
+	NewLogger("info", "text", &buf).With("repo", "1").Error("Git", "error", "exit status 128")
+	if !strings.Contains(buf.String(), `level=ERROR msg=Git repo=1 error="exit status 128"`) {
+		t.Errorf("Logger text - got (%s)", buf.String())
+	}
+}
@@ -1,21 +1,21 @@
 package main
 
 import (
+	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 
 	"github.com/gorilla/mux"
-	"github.com/microlib/simple"
 )
 
 var (
-	logger  *simple.Logger
+	logger  *Logger
 	counter uint64
 )
 
-func startHttpServer(port string, logger *simple.Logger) *http.Server {
+func startHttpServer(port string, logger *Logger) *http.Server {
 	srv := &http.Server{Addr: ":" + port}
 
 	r := mux.NewRouter()
@@ -27,12 +27,70 @@ func startHttpServer(port string, logger *simple.Logger) *http.Server {
 		ForcePipelineHandler(w, req, logger)
 	}).Methods("POST")
 
-	r.HandleFunc("/api/v1/pipeline/{repo}/{stage}/{status}", func(w http.ResponseWriter, req *http.Request) {
+	r.HandleFunc("/api/v1/pipeline/{repo}/{run}/{stage}/{status}", func(w http.ResponseWriter, req *http.Request) {
 		PipelineStatusHandler(w, req, logger)
 	}).Methods("POST")
 
+	r.HandleFunc("/api/v1/runs", func(w http.ResponseWriter, req *http.Request) {
+		RunsHandler(w, req, logger)
+	}).Methods("GET")
+
+	r.HandleFunc("/api/v1/runs/{id}", func(w http.ResponseWriter, req *http.Request) {
+		RunHandler(w, req, logger)
+	}).Methods("GET")
+
+	r.HandleFunc("/api/v1/runs/{id}/artifacts/{name:.+}", func(w http.ResponseWriter, req *http.Request) {
+		ArtifactHandler(w, req, logger)
+	}).Methods("GET")
+
+	r.HandleFunc("/api/v1/runs/{id}/stages/{stageId}/log", func(w http.ResponseWriter, req *http.Request) {
+		StageLogHandler(w, req, logger)
+	}).Methods("GET")
+
+	r.HandleFunc("/api/v1/runs/{id}/stages/{stageId}/{decision:approve|reject}", func(w http.ResponseWriter, req *http.Request) {
+		ApprovalHandler(w, req, logger)
+	}).Methods("POST")
+
+	r.HandleFunc("/api/v1/webhooks/{id}", func(w http.ResponseWriter, req *http.Request) {
+		WebhookHandler(w, req, logger)
+	}).Methods("POST")
+
+	r.HandleFunc("/api/v1/credentials", func(w http.ResponseWriter, req *http.Request) {
+		CredentialsHandler(w, req, logger)
+	}).Methods("GET")
+
+	r.HandleFunc("/api/v1/credentials/{name}", func(w http.ResponseWriter, req *http.Request) {
+		UpdateCredentialHandler(w, req, logger)
+	}).Methods("PUT", "DELETE")
+
+	r.HandleFunc("/api/v1/project", func(w http.ResponseWriter, req *http.Request) {
+		ProjectHandler(w, req, logger)
+	}).Methods("GET", "PUT")
+
+	r.HandleFunc("/api/v1/me/permissions", func(w http.ResponseWriter, req *http.Request) {
+		PermissionsHandler(w, req, logger)
+	}).Methods("GET")
+
+	r.HandleFunc("/api/v1/audit", func(w http.ResponseWriter, req *http.Request) {
+		AuditHandler(w, req, logger)
+	}).Methods("GET")
+
+	r.HandleFunc("/api/v1/agents", func(w http.ResponseWriter, req *http.Request) {
+		AgentsHandler(w, req, logger)
+	}).Methods("GET")
+
+	r.HandleFunc("/api/v1/agents/connect", func(w http.ResponseWriter, req *http.Request) {
+		AgentConnectHandler(w, req, logger)
+	}).Methods("GET")
+
 	r.HandleFunc("/api/v2/sys/info/isalive", IsAlive).Methods("GET")
 
+	r.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
+		MetricsHandler(w, req, logger)
+	}).Methods("GET")
+
+	r.Use(authMiddleware(logger))
+
 	sh := http.StripPrefix("/api/v2/web/", http.FileServer(http.Dir("./simple-kb-html/")))
 	r.PathPrefix("/api/v2/web/").Handler(sh)
 
@@ -40,7 +98,24 @@ func startHttpServer(port string, logger *simple.Logger) *http.Server {
 
 	go func() {
 		if err := srv.ListenAndServe(); err != nil {
-			logger.Error("Httpserver: ListenAndServe() error: " + err.Error())
+			logger.Error("Httpserver: ListenAndServe()", "error", err)
+		}
+	}()
+
+	return srv
+}
+
+// startWebsocketServer - the dashboard websocket on 8080, on its own mux so that it doesn't serve the api
+func startWebsocketServer(logger *Logger) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/websocket/streamdata", func(w http.ResponseWriter, req *http.Request) {
+		StreamDataHandler(w, req, logger)
+	})
+	srv := &http.Server{Addr: ":8080", Handler: mux}
+
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Error("Websocket: ListenAndServe()", "error", err)
 		}
 	}()
 
@@ -49,10 +124,41 @@ func startHttpServer(port string, logger *simple.Logger) *http.Server {
 
 func main() {
 
+	// sandbox-exec runs a stage command inside its limits (started by the server, not by hand)
+	if len(os.Args) > 1 && os.Args[1] == "sandbox-exec" {
+		sandboxExec(os.Args[2:])
+	}
+
+	// audit-verify [file] checks the audit log hash chain and exits
+	if len(os.Args) > 1 && os.Args[1] == "audit-verify" {
+		file := auditFile()
+		if len(os.Args) > 2 {
+			file = os.Args[2]
+		}
+		n, err := verifyAudit(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "audit log %s : %d entries verified, then %v\n", file, n, err)
+			os.Exit(1)
+		}
+		fmt.Printf("audit log %s : %d entries verified\n", file, n)
+		os.Exit(0)
+	}
+
+	// LOG_FORMAT json or text
 	if os.Getenv("LOG_LEVEL") != "" {
-		logger = &simple.Logger{Level: os.Getenv("LOG_LEVEL")}
+		logger = NewLogger(os.Getenv("LOG_LEVEL"), os.Getenv("LOG_FORMAT"), os.Stdout)
 	} else {
-		logger = &simple.Logger{Level: "info"}
+		logger = NewLogger("info", os.Getenv("LOG_FORMAT"), os.Stdout)
+	}
+
+	// agent runs the stages of AGENT_SERVER instead of serving the api
+	if len(os.Args) > 1 && os.Args[1] == "agent" {
+		runAgent(logger)
+		return
+	}
+
+	if err := ValidateEnvars(logger); err != nil {
+		os.Exit(1)
 	}
 
 	var port string = "9000"
@@ -60,8 +166,17 @@ func main() {
 		port = os.Getenv("PORT")
 	}
 
+	if err := runStore.Load(); err != nil {
+		logger.Error("Loading runs", "error", err)
+	}
+	shutdownTracing := initTracing(logger)
+	startWorker(logger)
+	authenticators = newAuthenticators(logger)
+
 	srv := startHttpServer(port, logger)
-	logger.Info("Starting server on port " + srv.Addr)
+	logger.Info("Starting server", "addr", srv.Addr)
+	ws := startWebsocketServer(logger)
+	logger.Info("Starting websocket", "addr", ws.Addr)
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 
@@ -90,6 +205,8 @@ func main() {
 	if err := srv.Shutdown(nil); err != nil {
 		panic(err)
 	}
+	ws.Close()
+	shutdownTracing()
 	logger.Info("Server shutdown successfully")
 	os.Exit(code)
 }
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// prometheus metrics, served on /metrics
+var (
+	metricsHandler = promhttp.Handler()
+
+	runsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cicd_runs_total",
+		Help: "Finished pipeline runs by repository and result.",
+	}, []string{"repo", "result"})
+
+	stageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cicd_stage_duration_seconds",
+		Help:    "Duration of the pipeline stages by repository and stage name.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+	}, []string{"repo", "stage"})
+
+	gitFetchDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cicd_git_fetch_duration_seconds",
+		Help:    "Latency of the git fetch of each repository.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"repo"})
+
+	queueWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cicd_queue_wait_seconds",
+		Help:    "Time runs spent in the queue before the worker picked them up.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 14),
+	}, []string{"repo"})
+
+	queueDepth = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "cicd_queue_depth",
+		Help: "Runs waiting in the queue.",
+	}, func() float64 { return float64(len(runQueue)) })
+
+	websocketClients = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "cicd_websocket_clients",
+		Help: "Connected websocket clients.",
+	})
+
+	websocketMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cicd_websocket_messages_total",
+		Help: "Websocket messages by result (sent or dropped).",
+	}, []string{"result"})
+
+	schemaFetchErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cicd_schema_fetch_errors_total",
+		Help: "Errors fetching the cicd.json of a repository raw url.",
+	}, []string{"url"})
+
+	agentsConnected = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "cicd_agents_connected",
+		Help: "Build agents connected to the coordinator.",
+	})
+
+	agentQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "cicd_agent_queue_depth",
+		Help: "Stage jobs waiting for a matching agent.",
+	})
+
+	agentRequeues = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "cicd_agent_requeues_total",
+		Help: "Stage jobs requeued because their agent disappeared.",
+	})
+
+	stageLimits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cicd_stage_limits_exceeded_total",
+		Help: "Stages stopped for going over a limit by repository and limit.",
+	}, []string{"repo", "limit"})
+)
+
+// MetricsHandler - the prometheus metrics, their labels name every repository and stage so they need the project viewer role
+func MetricsHandler(w http.ResponseWriter, r *http.Request, logger *Logger) {
+	if err := authorize(principal(r), "", "view"); err != nil {
+		forbidden(w, r, "view", logger)
+		return
+	}
+	metricsHandler.ServeHTTP(w, r)
+}
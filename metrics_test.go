@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	tmp, _ := ioutil.TempDir("", "metrics")
+	defer os.RemoveAll(tmp)
+	cwd, _ := os.Getwd()
+	os.Chdir(tmp)
+	defer os.Chdir(cwd)
+	ioutil.WriteFile("project.json", []byte(`{"roles":[{"role":"viewer","groups":["ops"]}],"repositories":[{"id":"metrics-api","roles":[{"role":"developer","users":["bob"]}]}]}`), 0644)
+	defer func(s *RunStore) { runStore = s }(runStore)
+	runStore = &RunStore{runs: map[string]*Run{}, dir: "runs"}
+	logger := NewLogger("error", "text", ioutil.Discard)
+
+	// a finished run with a timed stage
+	run := runStore.Create("m1", Repository{Id: "metrics-api"}, &Pipeline{Id: "1"}, "abc")
+	run.Stages = []StageRun{{Id: 0, Name: "Build", Start: 1}}
+	stageStatus(run, 0, "success", logger)
+	finishRun(run, "success", logger)
+	gitFetchDuration.WithLabelValues("metrics-api").Observe(0.5)
+	stageLimits.WithLabelValues("metrics-api", "memory").Inc()
+
+	// create anonymous struct
+	tests := []struct {
+		Name      string
+		Principal *Principal
+		Code      int
+		ErrorMsg  string
+	}{
+		{"Test metrics : project viewer", &Principal{Name: "prometheus", Groups: []string{"ops"}, Method: "token"}, http.StatusOK, "Metrics %s - got (%v) wanted (%v)"},
+		{"Test metrics : repository developer", &Principal{Name: "bob", Method: "token"}, http.StatusForbidden, "Metrics %s - got (%v) wanted (%v)"},
+		{"Test metrics : no binding", &Principal{Name: "eve", Method: "token"}, http.StatusForbidden, "Metrics %s - got (%v) wanted (%v)"},
+	}
+
+	for _, tt := range tests {
+		fmt.Println(fmt.Sprintf("\nExecuting test : %s", tt.Name))
+		r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		r = r.WithContext(context.WithValue(r.Context(), principalKey{}, tt.Principal))
+		w := httptest.NewRecorder()
+		MetricsHandler(w, r, logger)
+		if w.Code != tt.Code {
+			t.Errorf(tt.ErrorMsg, tt.Name, w.Code, tt.Code)
+		}
+		if tt.Code != http.StatusOK {
+			if strings.Contains(w.Body.String(), "metrics-api") {
+				t.Errorf(tt.ErrorMsg, tt.Name, w.Body.String(), "no metrics")
+			}
+			continue
+		}
+		for _, want := range []string{
+			`cicd_runs_total{repo="metrics-api",result="success"} 1`,
+			`cicd_stage_duration_seconds_count{repo="metrics-api",stage="Build"} 1`,
+			`cicd_git_fetch_duration_seconds_count{repo="metrics-api"} 1`,
+			`cicd_stage_limits_exceeded_total{limit="memory",repo="metrics-api"} 1`,
+			`cicd_queue_depth 0`,
+		} {
+			if !strings.Contains(w.Body.String(), want) {
+				t.Errorf(tt.ErrorMsg, tt.Name, "missing", want)
+			}
+		}
+		fmt.Println("")
+	}
+
+	// behind the authentication middleware
+	authenticators = []Authenticator{&TokenAuthenticator{}}
+	defer func() { authenticators = nil }()
+	w := httptest.NewRecorder()
+	authMiddleware(logger)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		MetricsHandler(w, r, logger)
+	})).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Metrics authentication - got (%v) wanted (%v)", w.Code, http.StatusUnauthorized)
+	}
+}
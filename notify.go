@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+)
+
+const (
+	defaultSubject  = `[cicd] {{.Repo}} {{.Pipeline}} {{.Event}}`
+	defaultTemplate = `Pipeline {{.Pipeline}} of repository {{.Repo}} : {{.Event}} ({{.Status}})
+Run     : {{.Run}}
+Commit  : {{.Commit}} {{.Subject}} ({{.Author}})
+{{if .Stage}}Stage   : {{.Stage}}
+{{end}}{{if .Url}}Link    : {{.Url}}
+{{end}}{{if .Log}}
+---- last lines of the log ----
+{{.Log}}
+{{end}}`
+)
+
+// Notification - what is sent on a run outcome, Event is one of failure, recovery, success or approval
+type Notification struct {
+	Event    string `json:"event"`
+	Repo     string `json:"repo"`
+	Pipeline string `json:"pipeline"`
+	Run      string `json:"run"`
+	Status   string `json:"status"`
+	Commit   string `json:"commit"`
+	Author   string `json:"author,omitempty"`
+	Subject  string `json:"subject,omitempty"`
+	Stage    string `json:"stage,omitempty"`
+	Log      string `json:"log,omitempty"`
+	Url      string `json:"url,omitempty"`
+	Time     int64  `json:"time"`
+}
+
+// Notifier - delivers a notification to a single channel
+type Notifier interface {
+	Notify(n Notification) error
+}
+
+// WebhookNotifier - posts the notification as json, X-Cicd-Signature-256 is the hmac sha256 of the body
+type WebhookNotifier struct {
+	Url    string
+	Secret string
+	Client *http.Client
+}
+
+// ChatNotifier - slack and mattermost ({"text":...}) or teams (MessageCard) incoming webhooks
+type ChatNotifier struct {
+	Url    string
+	Format string
+	Client *http.Client
+}
+
+// EmailNotifier - SMTP_ADDR (host:port), SMTP_FROM and optionally SMTP_USER/SMTP_PASSWORD
+type EmailNotifier struct {
+	Addr     string
+	From     string
+	To       []string
+	Auth     smtp.Auth
+	Subject  string
+	Template string
+}
+
+func (c *WebhookNotifier) Notify(n Notification) error {
+	body, _ := json.Marshal(n)
+	req, _ := http.NewRequest("POST", c.Url, bytes.NewReader(body))
+	req.Header.Set(CONTENTTYPE, APPLICATIONJSON)
+	req.Header.Set("X-Cicd-Event", n.Event)
+	if c.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(c.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Cicd-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	return doStatus(c.Client, req)
+}
+
+func (c *ChatNotifier) Notify(n Notification) error {
+	text := fmt.Sprintf("%s %s %s : %s (%s)", n.Repo, n.Pipeline, n.Event, n.Status, shortSha(n.Commit))
+	if n.Stage != "" {
+		text += " stage " + n.Stage
+	}
+	if n.Url != "" {
+		text += " " + n.Url
+	}
+	var msg interface{}
+	switch c.Format {
+	case "teams":
+		colors := map[string]string{"failure": "d32f2f", "recovery": "388e3c", "success": "388e3c", "approval": "f9a825"}
+		msg = map[string]interface{}{
+			"@type":      "MessageCard",
+			"@context":   "https://schema.org/extensions",
+			"summary":    text,
+			"themeColor": colors[n.Event],
+			"title":      n.Repo + " " + n.Pipeline + " " + n.Event,
+			"text":       text,
+		}
+	default:
+		if n.Log != "" {
+			text += "\n```\n" + n.Log + "\n```"
+		}
+		msg = map[string]string{"text": text}
+	}
+	body, _ := json.Marshal(msg)
+	req, _ := http.NewRequest("POST", c.Url, bytes.NewReader(body))
+	req.Header.Set(CONTENTTYPE, APPLICATIONJSON)
+	return doStatus(c.Client, req)
+}
+
+func (c *EmailNotifier) Notify(n Notification) error {
+	if c.Addr == "" || len(c.To) == 0 {
+		return errors.New("email needs SMTP_ADDR and recipients")
+	}
+	subject, err := render(c.Subject, defaultSubject, n)
+	if err != nil {
+		return err
+	}
+	body, err := render(c.Template, defaultTemplate, n)
+	if err != nil {
+		return err
+	}
+	msg := "From: " + c.From + "\r\n" +
+		"To: " + strings.Join(c.To, ", ") + "\r\n" +
+		"Subject: " + headerValue(subject) + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n\r\n" +
+		strings.ReplaceAll(body, "\n", "\r\n")
+	return smtp.SendMail(c.Addr, c.Auth, c.From, c.To, []byte(msg))
+}
+
+// headerValue - control characters (\r and \n from a commit subject) are spaces, a value can't add headers
+func headerValue(str string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, str)
+}
+
+// render - the template (or the default) executed with the notification
+func render(text string, def string, n Notification) (string, error) {
+	if text == "" {
+		text = def
+	}
+	tmpl, err := template.New("notification").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	err = tmpl.Execute(&b, n)
+	return b.String(), err
+}
+
+func shortSha(sha string) string {
+	if len(sha) > 8 {
+		return sha[:8]
+	}
+	return sha
+}
+
+// newNotifier - the notifier for the channel, the webhook secret is a credential from the secret store
+func newNotifier(detail NotificationDetail) (Notifier, error) {
+	switch detail.Type {
+	case "webhook":
+		secret := ""
+		if detail.Secret != "" {
+			cred, err := secretStore.Get(detail.Secret)
+			if err != nil {
+				return nil, err
+			}
+			secret = cred.Token
+		}
+		return &WebhookNotifier{Url: detail.Url, Secret: secret}, nil
+	case "slack", "mattermost", "teams":
+		return &ChatNotifier{Url: detail.Url, Format: detail.Type}, nil
+	case "email":
+		var auth smtp.Auth
+		if os.Getenv("SMTP_USER") != "" {
+			host, _, _ := net.SplitHostPort(os.Getenv("SMTP_ADDR"))
+			auth = smtp.PlainAuth("", os.Getenv("SMTP_USER"), os.Getenv("SMTP_PASSWORD"), host)
+		}
+		return &EmailNotifier{Addr: os.Getenv("SMTP_ADDR"), From: os.Getenv("SMTP_FROM"), To: detail.To, Auth: auth, Subject: detail.Subject, Template: detail.Template}, nil
+	}
+	return nil, errors.New("unknown notification type " + detail.Type)
+}
+
+// attachNotifications - the repository and pipeline channels of the run
+func attachNotifications(run *Run, repo Repository, pipeline *Pipeline) {
+	run.notify = append([]NotificationDetail{}, repo.Notifications...)
+	if pipeline != nil {
+		run.notify = append(run.notify, pipeline.Notifications...)
+	}
+}
+
+// runEvents - the events of a finished run, most specific first (a success after a failure is a recovery)
+func runEvents(run *Run, status string) []string {
+	if status != "success" {
+		return []string{"failure"}
+	}
+	for _, r := range runStore.List() {
+		if r.Id == run.Id || r.RepoId != run.RepoId || r.Pipeline != run.Pipeline || r.Start > run.Start {
+			continue
+		}
+		if r.Status == "failed" {
+			return []string{"recovery", "success"}
+		}
+		if r.Status == "success" {
+			break
+		}
+	}
+	return []string{"success"}
+}
+
+// logTail - the last lines of the log of the stage
+func logTail(runId string, stageId int, lines int) string {
+	data, err := ioutil.ReadFile(stageLogPath(runId, stageId))
+	if err != nil {
+		return ""
+	}
+	all := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if len(all) > lines {
+		all = all[len(all)-lines:]
+	}
+	return strings.Join(all, "\n")
+}
+
+// notifyRun - sends the first of the events each channel is configured for, errors are only logged
+func notifyRun(run *Run, events []string, logger *Logger) {
+	for _, detail := range run.notify {
+		on := detail.On
+		if len(on) == 0 {
+			on = []string{"failure", "recovery"}
+		}
+		event := ""
+		for _, e := range events {
+			if event == "" && matchAny(on, e) {
+				event = e
+			}
+		}
+		if event == "" {
+			continue
+		}
+		n := Notification{Event: event, Repo: run.RepoId, Pipeline: run.Pipeline, Run: run.Id, Status: run.Status, Commit: run.Commit,
+			Author: run.Head.Author, Subject: run.Head.Subject, Url: runUrl(run), Time: time.Now().Unix()}
+		lines := detail.Lines
+		if lines <= 0 {
+			lines = 20
+		}
+		for _, sr := range run.Stages {
+			switch {
+			case event == "approval" && sr.Status == "waiting":
+				n.Stage = sr.Name
+			case event == "failure" && (sr.Status == "error" || sr.Status == "rejected"):
+				n.Stage = sr.Name
+				n.Log = logTail(run.Id, sr.Id, lines)
+			}
+		}
+		notifier, err := newNotifier(detail)
+		if err == nil {
+			err = notifier.Notify(n)
+		}
+		if err != nil {
+			logger.Error("Notify", "type", detail.Type, "event", event, "error", err)
+		} else {
+			logger.Debug("Notify", "type", detail.Type, "event", event)
+		}
+	}
+}
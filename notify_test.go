@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// smtpStandIn - accepts one message at a time and sends its data on the channel
+func smtpStandIn(t *testing.T) (string, chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("smtp listen %v", err)
+	}
+	messages := make(chan string, 4)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			r := bufio.NewReader(conn)
+			fmt.Fprint(conn, "220 localhost ESMTP\r\n")
+			var data strings.Builder
+			for inData := false; ; {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					break
+				}
+				if inData {
+					if line == ".\r\n" {
+						inData = false
+						messages <- data.String()
+						fmt.Fprint(conn, "250 OK\r\n")
+					} else {
+						data.WriteString(line)
+					}
+					continue
+				}
+				switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+				case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+					fmt.Fprint(conn, "250 localhost\r\n")
+				case cmd == "DATA":
+					inData = true
+					fmt.Fprint(conn, "354 go ahead\r\n")
+				case cmd == "QUIT":
+					fmt.Fprint(conn, "221 bye\r\n")
+				default:
+					fmt.Fprint(conn, "250 OK\r\n")
+				}
+			}
+			conn.Close()
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return ln.Addr().String(), messages
+}
+
+func TestNotifications(t *testing.T) {
+	// failing stage with a log
+	run := &Run{Id: "notify-test", RepoId: "1", Pipeline: "api", Commit: "0123456789abcdef", Status: "failed",
+		Head:   CommitDetail{Author: "lmz", Subject: "break the build"},
+		Stages: []StageRun{{Id: 1, Name: "Build", Status: "success"}, {Id: 2, Name: "Test", Status: "error"}}}
+	defer os.Remove(LOGSDIR)
+	defer os.RemoveAll(LOGSDIR + "/" + run.Id)
+	for i := 1; i <= 30; i++ {
+		appendStageLog(run.Id, 2, fmt.Sprintf("line %d\n", i))
+	}
+	logger := NewLogger("error", "text", os.Stdout)
+
+	received := map[string]*http.Request{}
+	bodies := map[string]string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received[r.URL.Path] = r
+		bodies[r.URL.Path] = string(body)
+	}))
+	defer srv.Close()
+	addr, messages := smtpStandIn(t)
+	os.Setenv("SMTP_ADDR", addr)
+	os.Setenv("SMTP_FROM", "cicd@example.com")
+	defer os.Unsetenv("SMTP_ADDR")
+	defer os.Unsetenv("SMTP_FROM")
+
+	// create anonymous struct
+	tests := []struct {
+		Name     string
+		Notifier Notifier
+		Path     string
+		Want     string
+		ErrorMsg string
+	}{
+		{"Test notify : signed webhook", &WebhookNotifier{Url: srv.URL + "/hook", Secret: "s3cret"}, "/hook", `"event":"failure"`, "Notify %s - got (%v) wanted (%v)"},
+		{"Test notify : slack", &ChatNotifier{Url: srv.URL + "/slack", Format: "slack"}, "/slack", `"text":"1 api failure : failed (01234567) stage Test`, "Notify %s - got (%v) wanted (%v)"},
+		{"Test notify : teams", &ChatNotifier{Url: srv.URL + "/teams", Format: "teams"}, "/teams", `"@type":"MessageCard"`, "Notify %s - got (%v) wanted (%v)"},
+		{"Test notify : email", &EmailNotifier{Addr: addr, From: "cicd@example.com", To: []string{"dev@example.com"}}, "", "Subject: [cicd] 1 api failure", "Notify %s - got (%v) wanted (%v)"},
+	}
+
+	for _, tt := range tests {
+		fmt.Println(fmt.Sprintf("\nExecuting test : %s", tt.Name))
+		n := Notification{Event: "failure", Repo: run.RepoId, Pipeline: run.Pipeline, Run: run.Id, Status: run.Status, Commit: run.Commit, Stage: "Test", Log: logTail(run.Id, 2, 5)}
+		if err := tt.Notifier.Notify(n); err != nil {
+			t.Fatalf(tt.ErrorMsg, tt.Name, err, nil)
+		}
+		got := bodies[tt.Path]
+		if tt.Path == "" {
+			got = <-messages
+		}
+		if !strings.Contains(got, tt.Want) {
+			t.Errorf(tt.ErrorMsg, tt.Name, got, tt.Want)
+		}
+		fmt.Println("")
+	}
+
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(bodies["/hook"]))
+	if sig := received["/hook"].Header.Get("X-Cicd-Signature-256"); sig != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+		t.Errorf("Notify signature - got (%v) wanted (valid hmac)", sig)
+	}
+	var payload Notification
+	json.Unmarshal([]byte(bodies["/hook"]), &payload)
+	if payload.Log != "line 26\nline 27\nline 28\nline 29\nline 30" {
+		t.Errorf("Notify log tail - got (%v) wanted (lines 26-30)", payload.Log)
+	}
+
+	// a commit subject can't add headers to the email
+	email := &EmailNotifier{Addr: addr, From: "cicd@example.com", To: []string{"dev@example.com"}, Subject: "{{.Subject}}"}
+	if err := email.Notify(Notification{Subject: "fix\r\nBcc: victim@example.com\rX-Evil: 1"}); err != nil {
+		t.Fatalf("Notify email subject - got (%v) wanted (nil)", err)
+	}
+	headers := strings.SplitN(<-messages, "\r\n\r\n", 2)[0]
+	if !strings.Contains(headers, "Subject: fix  Bcc: victim@example.com X-Evil: 1\r\n") || strings.Contains(headers, "\nBcc:") || strings.Contains(headers, "\rX-Evil") {
+		t.Errorf("Notify email subject - got (%q) wanted (%v)", headers, "a single subject header")
+	}
+
+	// notifyRun picks the channels by event, email gets the templated body with the log tail
+	run.notify = []NotificationDetail{
+		{Type: "slack", Url: srv.URL + "/failures"},
+		{Type: "mattermost", Url: srv.URL + "/successes", On: []string{"success"}},
+		{Type: "email", To: []string{"dev@example.com"}, Lines: 3, Template: "{{.Stage}} failed\n{{.Log}}"},
+	}
+	notifyRun(run, []string{"failure"}, logger)
+	if _, ok := received["/failures"]; !ok {
+		t.Errorf("Notify failure - got (%v) wanted (slack)", received)
+	}
+	if _, ok := received["/successes"]; ok {
+		t.Errorf("Notify failure - got (%v) wanted (no success)", received)
+	}
+	if msg := <-messages; !strings.Contains(msg, "Test failed\r\nline 28\r\nline 29\r\nline 30") {
+		t.Errorf("Notify email template - got (%v) wanted (log tail)", msg)
+	}
+
+	// a success after a failure is a recovery
+	tmp, _ := ioutil.TempDir("", "runs")
+	defer os.RemoveAll(tmp)
+	defer func(s *RunStore) { runStore = s }(runStore)
+	runStore = &RunStore{runs: map[string]*Run{}, dir: tmp}
+	runStore.Save(&Run{Id: "notify-prev", RepoId: "1", Pipeline: "api", Status: "failed", Start: 1})
+	next := &Run{Id: "notify-next", RepoId: "1", Pipeline: "api", Status: "success", Start: 2}
+	if events := runEvents(next, "success"); strings.Join(events, " ") != "recovery success" {
+		t.Errorf("Notify events - got (%v) wanted (recovery success)", events)
+	}
+}
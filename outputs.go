@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// newOutputFile - the file a stage writes key=value outputs to, exposed as CICD_OUTPUT
+// it lives outside the workspace so it never ends up in artifacts
+func newOutputFile() (string, error) {
+	f, err := ioutil.TempFile("", "cicd-output")
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+	return f.Name(), nil
+}
+
+// readOutputs - parses the key=value lines written by the stage, blank lines and # comments are ignored
+func readOutputs(path string) (map[string]string, error) {
+	outputs := map[string]string{}
+	f, err := os.Open(path)
+	if err != nil {
+		return outputs, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		outputs[strings.TrimSpace(kv[0])] = kv[1]
+	}
+	return outputs, scanner.Err()
+}
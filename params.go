@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	varPattern = regexp.MustCompile(`\$\{\{\s*([A-Za-z0-9_.\-]+)\s*\}\}`)
+	// -c (or -ec, -xc ...) takes the script of a shell exec
+	scriptFlag = regexp.MustCompile(`^-[a-z]*c[a-z]*$`)
+	shells     = map[string]bool{"sh": true, "bash": true, "dash": true, "ash": true, "zsh": true, "ksh": true}
+)
+
+// resolveParameters - merges the supplied values with the pipeline defaults and validates them
+func resolveParameters(defs []ParameterDetail, values map[string]string) (map[string]string, error) {
+	params := map[string]string{}
+	known := map[string]bool{}
+
+	for _, def := range defs {
+		known[def.Name] = true
+		value, ok := values[def.Name]
+		if !ok {
+			value = def.Default
+		}
+		if value == "" {
+			if def.Required {
+				return params, errors.New("parameter " + def.Name + " is mandatory")
+			}
+			params[def.Name] = value
+			continue
+		}
+		switch def.Type {
+		case "", "string":
+		case "bool":
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return params, fmt.Errorf("parameter %s expects a bool got %s", def.Name, value)
+			}
+			value = strconv.FormatBool(b)
+		case "choice":
+			found := false
+			for _, c := range def.Choices {
+				if c == value {
+					found = true
+				}
+			}
+			if !found {
+				return params, fmt.Errorf("parameter %s expects one of %v got %s", def.Name, def.Choices, value)
+			}
+		default:
+			return params, fmt.Errorf("parameter %s has an unknown type %s", def.Name, def.Type)
+		}
+		params[def.Name] = value
+	}
+	for name := range values {
+		if !known[name] {
+			return params, errors.New("parameter " + name + " is not declared by the pipeline")
+		}
+	}
+	return params, nil
+}
+
+// runVars - the variables available to stage interpolation for this run
+func runVars(run *Run) map[string]string {
+	vars := map[string]string{}
+	for k, v := range run.Parameters {
+		vars["parameters."+k] = v
+	}
+	for _, sr := range run.Stages {
+		for k, v := range sr.Outputs {
+			vars["stages."+strings.ToLower(sr.Name)+".outputs."+k] = v
+		}
+	}
+	for k, v := range commitVars(run) {
+		vars[k] = v
+	}
+	for k, v := range triggerVars(run) {
+		vars[k] = v
+	}
+	return vars
+}
+
+// commitVars - the built commit, i.e. ${{ commit.author }}
+func commitVars(run *Run) map[string]string {
+	short := run.Commit
+	if len(short) > 7 {
+		short = short[:7]
+	}
+	return map[string]string{
+		"commit.sha":            run.Commit,
+		"commit.short":          short,
+		"commit.previous":       run.Previous,
+		"commit.author":         run.Head.Author,
+		"commit.authoremail":    run.Head.AuthorEmail,
+		"commit.committer":      run.Head.Committer,
+		"commit.committeremail": run.Head.CommitterEmail,
+		"commit.subject":        run.Head.Subject,
+		"commit.timestamp":      strconv.FormatInt(run.Head.Timestamp, 10),
+	}
+}
+
+// runEnv - the variables exported to each stage's environment
+func runEnv(run *Run) []string {
+	var env []string
+	for k, v := range run.Parameters {
+		env = append(env, "PARAM_"+strings.ToUpper(strings.Replace(k, "-", "_", -1))+"="+v)
+	}
+	// i.e. CICD_COMMIT_SHA, CICD_PR_NUMBER
+	for _, vars := range []map[string]string{commitVars(run), triggerVars(run)} {
+		for k, v := range vars {
+			env = append(env, "CICD_"+strings.ToUpper(strings.Replace(k, ".", "_", -1))+"="+v)
+		}
+	}
+	return env
+}
+
+// interpolateCommands - interpolates the commands, in the script of a shell exec (sh -c '...') each value is
+// quoted as a single word: parameters and commit subjects come from whoever triggers or pushes and must not add commands
+func interpolateCommands(execPath string, commands []string, vars map[string]string) []string {
+	quoted := map[string]string{}
+	for k, v := range vars {
+		quoted[k] = "'" + strings.Replace(v, "'", `'"'"'`, -1) + "'"
+	}
+	var out []string
+	for x, c := range commands {
+		if shells[filepath.Base(execPath)] && x > 0 && scriptFlag.MatchString(commands[x-1]) {
+			out = append(out, interpolate(c, quoted))
+		} else {
+			out = append(out, interpolate(c, vars))
+		}
+	}
+	return out
+}
+
+// interpolate - replaces ${{ name }} references, unknown names are left as is
+func interpolate(str string, vars map[string]string) string {
+	return varPattern.ReplaceAllStringFunc(str, func(m string) string {
+		name := varPattern.FindStringSubmatch(m)[1]
+		if v, ok := vars[name]; ok {
+			return v
+		}
+		return m
+	})
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestParameters(t *testing.T) {
+	defs := []ParameterDetail{
+		{Name: "version", Type: "string", Required: true},
+		{Name: "env", Type: "choice", Choices: []string{"staging", "production"}, Default: "staging"},
+		{Name: "dry-run", Type: "bool"},
+	}
+
+	// create anonymous struct
+	tests := []struct {
+		Name     string
+		Defs     []ParameterDetail
+		Values   map[string]string
+		Want     map[string]string
+		Err      string
+		ErrorMsg string
+	}{
+		{"Test parameters : defaults", defs, map[string]string{"version": "1.0.4"}, map[string]string{"version": "1.0.4", "env": "staging", "dry-run": ""}, "", "Parameters %s - got (%v) wanted (%v)"},
+		{"Test parameters : bool", defs, map[string]string{"version": "1.0.4", "dry-run": "1"}, map[string]string{"version": "1.0.4", "env": "staging", "dry-run": "true"}, "", "Parameters %s - got (%v) wanted (%v)"},
+		{"Test parameters : bool type", defs, map[string]string{"version": "1.0.4", "dry-run": "maybe"}, nil, "parameter dry-run expects a bool got maybe", "Parameters %s - got (%v) wanted (%v)"},
+		{"Test parameters : choice", defs, map[string]string{"version": "1.0.4", "env": "production"}, map[string]string{"version": "1.0.4", "env": "production", "dry-run": ""}, "", "Parameters %s - got (%v) wanted (%v)"},
+		{"Test parameters : unknown choice", defs, map[string]string{"version": "1.0.4", "env": "qa"}, nil, "parameter env expects one of [staging production] got qa", "Parameters %s - got (%v) wanted (%v)"},
+		{"Test parameters : required", defs, map[string]string{"env": "staging"}, nil, "parameter version is mandatory", "Parameters %s - got (%v) wanted (%v)"},
+		{"Test parameters : undeclared", defs, map[string]string{"version": "1.0.4", "zone": "eu"}, nil, "parameter zone is not declared by the pipeline", "Parameters %s - got (%v) wanted (%v)"},
+		{"Test parameters : unknown type", []ParameterDetail{{Name: "n", Type: "int"}}, map[string]string{"n": "1"}, nil, "parameter n has an unknown type int", "Parameters %s - got (%v) wanted (%v)"},
+	}
+
+	for _, tt := range tests {
+		fmt.Println(fmt.Sprintf("\nExecuting test : %s", tt.Name))
+		got, err := resolveParameters(tt.Defs, tt.Values)
+		if tt.Err != "" {
+			if err == nil || err.Error() != tt.Err {
+				t.Errorf(tt.ErrorMsg, tt.Name, err, tt.Err)
+			}
+		} else if err != nil || !reflect.DeepEqual(got, tt.Want) {
+			t.Errorf(tt.ErrorMsg, tt.Name, fmt.Sprint(got, err), tt.Want)
+		}
+		fmt.Println("")
+	}
+
+	// run parameters are exported and interpolated
+	run := &Run{Parameters: map[string]string{"dry-run": "true"}}
+	if got := interpolate("deploy ${{ parameters.dry-run }} ${{ nope }}", runVars(run)); got != "deploy true ${{ nope }}" {
+		t.Errorf("Parameters interpolate - got (%v) wanted (%v)", got, "deploy true ${{ nope }}")
+	}
+	if env := strings.Join(runEnv(run), " "); !strings.Contains(env, "PARAM_DRY_RUN=true") {
+		t.Errorf("Parameters env - got (%v) wanted (%v)", env, "PARAM_DRY_RUN=true")
+	}
+}
+
+func TestInterpolateCommands(t *testing.T) {
+	vars := map[string]string{"commit.subject": "fix'; touch pwned; echo '", "parameters.version": "1.0.4"}
+
+	// create anonymous struct
+	tests := []struct {
+		Name     string
+		Exec     string
+		Commands []string
+		Want     []string
+		ErrorMsg string
+	}{
+		{"Test commands : argv", "make", []string{"release", "VERSION=${{ parameters.version }}", "${{ commit.subject }}"}, []string{"release", "VERSION=1.0.4", "fix'; touch pwned; echo '"}, "Commands %s - got (%v) wanted (%v)"},
+		{"Test commands : shell script", "/bin/sh", []string{"-c", "echo ${{ commit.subject }} ${{ parameters.version }}"}, []string{"-c", `echo 'fix'"'"'; touch pwned; echo '"'"'' '1.0.4'`}, "Commands %s - got (%v) wanted (%v)"},
+		{"Test commands : shell flags", "bash", []string{"-ec", "echo ${{ parameters.version }}", "${{ parameters.version }}"}, []string{"-ec", "echo '1.0.4'", "1.0.4"}, "Commands %s - got (%v) wanted (%v)"},
+		{"Test commands : shell file", "sh", []string{"release.sh", "${{ commit.subject }}"}, []string{"release.sh", "fix'; touch pwned; echo '"}, "Commands %s - got (%v) wanted (%v)"},
+	}
+
+	for _, tt := range tests {
+		fmt.Println(fmt.Sprintf("\nExecuting test : %s", tt.Name))
+		if got := interpolateCommands(tt.Exec, tt.Commands, vars); !reflect.DeepEqual(got, tt.Want) {
+			t.Errorf(tt.ErrorMsg, tt.Name, got, tt.Want)
+		}
+		fmt.Println("")
+	}
+
+	// the shell gets the value back as it was, nothing else runs
+	tmp, _ := ioutil.TempDir("", "commands")
+	defer os.RemoveAll(tmp)
+	cmd := exec.Command("/bin/sh", interpolateCommands("/bin/sh", []string{"-c", "echo ${{ commit.subject }}"}, vars)...)
+	cmd.Dir = tmp
+	out, err := cmd.Output()
+	if _, e := os.Stat(filepath.Join(tmp, "pwned")); err != nil || string(out) != vars["commit.subject"]+"\n" || e == nil {
+		t.Errorf("Commands shell - got (%q %v) wanted (%q)", out, err, vars["commit.subject"])
+	}
+}
+
+func TestForceParameters(t *testing.T) {
+	tmp, _ := ioutil.TempDir("", "force")
+	defer os.RemoveAll(tmp)
+	cwd, _ := os.Getwd()
+	os.Chdir(tmp)
+	defer os.Chdir(cwd)
+	project := `{"repositories":[{"id":"api","skip":true}]}`
+	ioutil.WriteFile("project.json", []byte(project), 0644)
+	logger := NewLogger("error", "text", ioutil.Discard)
+
+	force := func(body string) int {
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/force/0/true", strings.NewReader(body))
+		r = mux.SetURLVars(r, map[string]string{"id": "0", "flag": "true"})
+		r = r.WithContext(context.WithValue(r.Context(), principalKey{}, &Principal{Name: "anonymous", Method: "none"}))
+		w := httptest.NewRecorder()
+		ForcePipelineHandler(w, r, logger)
+		return w.Code
+	}
+
+	// parameters force a single poll and are not written to project.json
+	if code := force(`{"version":"1.0.4"}`); code != http.StatusOK {
+		t.Errorf("Force parameters - got (%v) wanted (%v)", code, http.StatusOK)
+	}
+	for x := 0; x < 200 && atomic.LoadInt32(&polling) != 0; x++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if b, _ := ioutil.ReadFile("project.json"); string(b) != project {
+		t.Errorf("Force parameters - got (%s) wanted (%s)", b, project)
+	}
+	if code := force(`{"version":`); code != http.StatusBadRequest {
+		t.Errorf("Force parameters - got (%v) wanted (%v)", code, http.StatusBadRequest)
+	}
+
+	// without parameters the force flag is kept
+	if code := force(""); code != http.StatusOK {
+		t.Errorf("Force flag - got (%v) wanted (%v)", code, http.StatusOK)
+	}
+	if b, _ := ioutil.ReadFile("project.json"); !strings.Contains(string(b), `"force": true`) || strings.Contains(string(b), "parameters") {
+		t.Errorf("Force flag - got (%s) wanted (%v)", b, "force set without parameters")
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"path"
+	"strings"
+)
+
+// pipelineDefinitions - the pipelines of the repository, a single cicd.json at the root when none are declared
+func pipelineDefinitions(repo Repository) []PipelineDetail {
+	if len(repo.Pipelines) == 0 {
+		return []PipelineDetail{{File: "cicd.json"}}
+	}
+	defs := []PipelineDetail{}
+	for _, def := range repo.Pipelines {
+		dir := strings.Trim(def.Dir, "/")
+		if def.File == "" {
+			def.File = path.Join(dir, "cicd.json")
+		}
+		if len(def.Paths) == 0 && dir != "" {
+			def.Paths = []string{dir + "/**"}
+		}
+		def.Dir = dir
+		defs = append(defs, def)
+	}
+	return defs
+}
+
+// selectPipelines - the pipelines with at least one changed file matching their paths (all when all is set)
+func selectPipelines(repo Repository, changed []string, all bool) []PipelineDetail {
+	selected := []PipelineDetail{}
+	for _, def := range pipelineDefinitions(repo) {
+		if all || len(def.Paths) == 0 || changedPaths(def.Paths, changed) {
+			selected = append(selected, def)
+		}
+	}
+	return selected
+}
+
+func changedPaths(globs []string, changed []string) bool {
+	for _, file := range changed {
+		for _, glob := range globs {
+			if matchPath(glob, file) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchPath - path.Match per segment where ** matches any number of directories
+func matchPath(glob string, file string) bool {
+	return matchSegments(strings.Split(strings.Trim(glob, "/"), "/"), strings.Split(file, "/"))
+}
+
+func matchSegments(glob []string, file []string) bool {
+	if len(glob) == 0 {
+		return len(file) == 0
+	}
+	if glob[0] == "**" {
+		for i := 0; i <= len(file); i++ {
+			if matchSegments(glob[1:], file[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(file) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(glob[0], file[0]); !ok {
+		return false
+	}
+	return matchSegments(glob[1:], file[1:])
+}
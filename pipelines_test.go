@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSelectPipelines(t *testing.T) {
+	repo := Repository{Pipelines: []PipelineDetail{
+		{Name: "api", Dir: "services/api"},
+		{Name: "web", Dir: "web", Paths: []string{"web/**/*.ts", "shared/**"}},
+		{Name: "docs", File: "ci/docs.json", Paths: []string{"*.md"}},
+	}}
+
+	// create anonymous struct
+	tests := []struct {
+		Name     string
+		Changed  []string
+		All      bool
+		Want     string
+		ErrorMsg string
+	}{
+		{
+			"Test pipelines : sub-directory default paths",
+			[]string{"services/api/main.go"},
+			false,
+			"[{api services/api services/api/cicd.json [services/api/**]}]",
+			"Pipelines %s - got (%v) wanted (%v)",
+		},
+		{
+			"Test pipelines : globs",
+			[]string{"web/src/app.ts", "README.md", "web/index.html"},
+			false,
+			"[{web web web/cicd.json [web/**/*.ts shared/**]} {docs  ci/docs.json [*.md]}]",
+			"Pipelines %s - got (%v) wanted (%v)",
+		},
+		{
+			"Test pipelines : nothing matches",
+			[]string{"services/other/main.go", "docs/guide.md"},
+			false,
+			"[]",
+			"Pipelines %s - got (%v) wanted (%v)",
+		},
+		{
+			"Test pipelines : forced",
+			[]string{},
+			true,
+			"[{api services/api services/api/cicd.json [services/api/**]} {web web web/cicd.json [web/**/*.ts shared/**]} {docs  ci/docs.json [*.md]}]",
+			"Pipelines %s - got (%v) wanted (%v)",
+		},
+	}
+
+	for _, tt := range tests {
+		fmt.Println(fmt.Sprintf("\nExecuting test : %s", tt.Name))
+		if got := fmt.Sprint(selectPipelines(repo, tt.Changed, tt.All)); got != tt.Want {
+			t.Errorf(tt.ErrorMsg, tt.Name, got, tt.Want)
+		}
+		fmt.Println("")
+	}
+
+	// a repository without pipelines has the single root cicd.json
+	if got := selectPipelines(Repository{}, []string{"a/b.go"}, false); len(got) != 1 || got[0].File != "cicd.json" {
+		t.Errorf("Pipelines default - got (%v) wanted (%v)", got, "[cicd.json]")
+	}
+}
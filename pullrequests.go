@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// pullRequestRef - the head ref the scm keeps for each pull/merge request
+func pullRequestRef(provider string, number int) string {
+	if provider == "gitlab" {
+		return "refs/merge-requests/" + strconv.Itoa(number) + "/head"
+	}
+	return "refs/pull/" + strconv.Itoa(number) + "/head"
+}
+
+// builtPullRequestRef - where the last built head of the pull request is recorded in the clone
+func builtPullRequestRef(number int) string {
+	return "refs/cicd/pr/" + strconv.Itoa(number)
+}
+
+// pollPullRequests - fetches all pull/merge request heads and queues the new or updated ones
+// the very first poll only records the existing heads so that old pull requests are not all built
+func pollPullRequests(ctx context.Context, scm SourceProvider, repo Repository, workDirPath string, logger *Logger) error {
+	remote := "refs/pull/*/head"
+	if repo.PullRequests == "gitlab" {
+		remote = "refs/merge-requests/*/head"
+	}
+	_, span := startSpan(ctx, "git fetch", attribute.String("cicd.ref", remote))
+	err := scm.FetchRefs(workDirPath, []string{"+" + remote + ":refs/remotes/origin/pr/*"})
+	endSpan(span, err)
+	if err != nil {
+		return err
+	}
+	heads, err := scm.ListRefs(workDirPath, "refs/remotes/origin/pr/")
+	if err != nil {
+		return err
+	}
+	built, err := scm.ListRefs(workDirPath, "refs/cicd/pr/")
+	if err != nil {
+		return err
+	}
+	baseline := len(built) == 0
+	var api PullRequestReader
+	if !baseline {
+		reporter, err := newStatusReporter(repo)
+		if err != nil {
+			return err
+		}
+		if reporter != nil {
+			api = reporter.(PullRequestReader)
+		}
+	}
+	for ref, sha := range heads {
+		number, err := strconv.Atoi(strings.TrimPrefix(ref, "refs/remotes/origin/pr/"))
+		if err != nil || built[builtPullRequestRef(number)] == sha {
+			continue
+		}
+		if baseline {
+			scm.UpdateRef(workDirPath, builtPullRequestRef(number), sha)
+			continue
+		}
+		pr := &PullRequestDetail{Number: number, Ref: pullRequestRef(repo.PullRequests, number), Target: "master", Sha: sha}
+		if api == nil {
+			logger.Warn("Pull requests : no status api configured, the pull request targets master", "pr", number)
+		} else {
+			// the refs don't carry the branches, left for the next poll when the api is down
+			if pr.Source, pr.Target, err = api.PullRequest(number); err == nil && pr.Target == "" {
+				err = errors.New("no target branch in the api response")
+			}
+			if err != nil {
+				logger.Error("Pull requests", "pr", number, "error", err)
+				continue
+			}
+		}
+		trigger := Trigger{Event: "pull_request", Sha: sha, Previous: built[builtPullRequestRef(number)], Ref: builtPullRequestRef(number), PullRequest: pr}
+		if err := enqueue(ctx, repo, trigger, logger); err != nil {
+			logger.Error("Queue", "error", err)
+		}
+	}
+	if baseline {
+		logger.Info("Pull requests : recorded existing heads", "count", len(heads))
+	}
+	return nil
+}
+
+// findRepository - the repository with the given id in project.json
+func findRepository(id string) (Repository, error) {
+	project, err := readProject()
+	if err != nil {
+		return Repository{}, err
+	}
+	for _, repo := range project.Repositories {
+		if repo.Id == id {
+			return repo, nil
+		}
+	}
+	return Repository{}, errors.New("repository " + id + " not found")
+}
+
+// verifyWebhook - checks the signature (github, gitea) or token (gitlab) against the repository webhook secret
+func verifyWebhook(r *http.Request, body []byte, secret string) error {
+	if secret == "" {
+		return errors.New("empty webhook secret")
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	expected := hex.EncodeToString(mac.Sum(nil))
+	switch {
+	case r.Header.Get("X-Hub-Signature-256") != "":
+		if hmac.Equal([]byte(r.Header.Get("X-Hub-Signature-256")), []byte("sha256="+expected)) {
+			return nil
+		}
+	case r.Header.Get("X-Gitea-Signature") != "":
+		if hmac.Equal([]byte(r.Header.Get("X-Gitea-Signature")), []byte(expected)) {
+			return nil
+		}
+	case r.Header.Get("X-Gitlab-Token") != "":
+		if hmac.Equal([]byte(r.Header.Get("X-Gitlab-Token")), []byte(secret)) {
+			return nil
+		}
+	}
+	return errors.New("webhook signature mismatch")
+}
+
+type pullRequestEvent struct {
+	Action      string `json:"action"`
+	Number      int    `json:"number"`
+	PullRequest struct {
+		Head struct {
+			Ref string `json:"ref"`
+			Sha string `json:"sha"`
+		} `json:"head"`
+		Base struct {
+			Ref string `json:"ref"`
+		} `json:"base"`
+	} `json:"pull_request"`
+	ObjectKind       string `json:"object_kind"`
+	ObjectAttributes struct {
+		Iid          int    `json:"iid"`
+		Action       string `json:"action"`
+		SourceBranch string `json:"source_branch"`
+		TargetBranch string `json:"target_branch"`
+		LastCommit   struct {
+			Id string `json:"id"`
+		} `json:"last_commit"`
+	} `json:"object_attributes"`
+}
+
+// PullRequestReader - reads the source and target branch of a pull/merge request from the scm api
+type PullRequestReader interface {
+	PullRequest(number int) (source string, target string, err error)
+}
+
+func (r *GithubReporter) PullRequest(number int) (string, string, error) {
+	var pr pullRequestEvent
+	req, _ := http.NewRequest("GET", strings.TrimSuffix(r.Url, "/")+"/repos/"+r.Repo+"/pulls/"+strconv.Itoa(number), nil)
+	req.Header.Set("Authorization", "Bearer "+r.Token)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	err := getJson(r.Client, req, &pr.PullRequest)
+	return pr.PullRequest.Head.Ref, pr.PullRequest.Base.Ref, err
+}
+
+func (r *GitlabReporter) PullRequest(number int) (string, string, error) {
+	var mr pullRequestEvent
+	req, _ := http.NewRequest("GET", strings.TrimSuffix(r.Url, "/")+"/api/v4/projects/"+url.PathEscape(r.Repo)+"/merge_requests/"+strconv.Itoa(number), nil)
+	req.Header.Set("PRIVATE-TOKEN", r.Token)
+	err := getJson(r.Client, req, &mr.ObjectAttributes)
+	return mr.ObjectAttributes.SourceBranch, mr.ObjectAttributes.TargetBranch, err
+}
+
+func (r *GiteaReporter) PullRequest(number int) (string, string, error) {
+	var pr pullRequestEvent
+	req, _ := http.NewRequest("GET", strings.TrimSuffix(r.Url, "/")+"/api/v1/repos/"+r.Repo+"/pulls/"+strconv.Itoa(number), nil)
+	req.Header.Set("Authorization", "token "+r.Token)
+	err := getJson(r.Client, req, &pr.PullRequest)
+	return pr.PullRequest.Head.Ref, pr.PullRequest.Base.Ref, err
+}
+
+// getJson - decodes the response of the scm api into v
+func getJson(client *http.Client, req *http.Request, v interface{}) error {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("scm api %s returned %d %s", req.URL.Path, resp.StatusCode, string(body))
+	}
+	return json.Unmarshal(body, v)
+}
+
+// parseWebhook - returns the pull request of a github/gitea pull_request or gitlab merge request event
+// nil (and no error) for events and actions that do not need a build
+func parseWebhook(r *http.Request, body []byte) (*PullRequestDetail, error) {
+	var event pullRequestEvent
+
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, err
+	}
+	switch {
+	case r.Header.Get("X-GitHub-Event") == "pull_request" || r.Header.Get("X-Gitea-Event") == "pull_request":
+		switch event.Action {
+		case "opened", "reopened", "synchronize", "synchronized":
+			return &PullRequestDetail{
+				Number: event.Number,
+				Ref:    pullRequestRef("github", event.Number),
+				Source: event.PullRequest.Head.Ref,
+				Target: event.PullRequest.Base.Ref,
+				Sha:    event.PullRequest.Head.Sha,
+			}, nil
+		}
+	case r.Header.Get("X-Gitlab-Event") == "Merge Request Hook":
+		switch event.ObjectAttributes.Action {
+		case "open", "reopen", "update":
+			return &PullRequestDetail{
+				Number: event.ObjectAttributes.Iid,
+				Ref:    pullRequestRef("gitlab", event.ObjectAttributes.Iid),
+				Source: event.ObjectAttributes.SourceBranch,
+				Target: event.ObjectAttributes.TargetBranch,
+				Sha:    event.ObjectAttributes.LastCommit.Id,
+			}, nil
+		}
+	}
+	return nil, nil
+}
+
+// triggerVars - ${{ event }} and for pull requests ${{ pr.number }}, ${{ pr.source }}, ${{ pr.target }}
+func triggerVars(run *Run) map[string]string {
+	vars := map[string]string{"event": run.Event}
+	if run.PullRequest != nil {
+		vars["pr.number"] = strconv.Itoa(run.PullRequest.Number)
+		vars["pr.source"] = run.PullRequest.Source
+		vars["pr.target"] = run.PullRequest.Target
+		vars["pr.sha"] = run.PullRequest.Sha
+	}
+	return vars
+}
+
+// stageWhen - evaluates the stage when rules, a stage without rules always runs
+func stageWhen(stage StageDetail, run *Run) bool {
+	if stage.When == nil {
+		return true
+	}
+	branch := "master"
+	if run.PullRequest != nil {
+		branch = run.PullRequest.Target
+	}
+	return matchAny(stage.When.Event, run.Event) && matchAny(stage.When.Branch, branch)
+}
+
+func matchAny(list []string, value string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
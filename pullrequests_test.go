@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/gorilla/mux"
+)
+
+func TestWebhooks(t *testing.T) {
+	github := `{"action":"synchronize","number":7,"pull_request":{"head":{"ref":"feature","sha":"abc123"},"base":{"ref":"master"}}}`
+	gitlab := `{"object_kind":"merge_request","object_attributes":{"iid":3,"action":"update","source_branch":"fix","target_branch":"develop","last_commit":{"id":"def456"}}}`
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(github))
+	signature := hex.EncodeToString(mac.Sum(nil))
+
+	// create anonymous struct
+	tests := []struct {
+		Name     string
+		Body     string
+		Headers  map[string]string
+		Verify   bool
+		Want     *PullRequestDetail
+		ErrorMsg string
+	}{
+		{
+			"Test webhook : github pull request",
+			github,
+			map[string]string{"X-GitHub-Event": "pull_request", "X-Hub-Signature-256": "sha256=" + signature},
+			true,
+			&PullRequestDetail{Number: 7, Ref: "refs/pull/7/head", Source: "feature", Target: "master", Sha: "abc123"},
+			"Webhook %s %s - got (%v) wanted (%v)",
+		},
+		{
+			"Test webhook : gitea bad signature",
+			github,
+			map[string]string{"X-Gitea-Event": "pull_request", "X-Gitea-Signature": "00"},
+			false,
+			&PullRequestDetail{Number: 7, Ref: "refs/pull/7/head", Source: "feature", Target: "master", Sha: "abc123"},
+			"Webhook %s %s - got (%v) wanted (%v)",
+		},
+		{
+			"Test webhook : gitlab merge request",
+			gitlab,
+			map[string]string{"X-Gitlab-Event": "Merge Request Hook", "X-Gitlab-Token": "s3cret"},
+			true,
+			&PullRequestDetail{Number: 3, Ref: "refs/merge-requests/3/head", Source: "fix", Target: "develop", Sha: "def456"},
+			"Webhook %s %s - got (%v) wanted (%v)",
+		},
+		{
+			"Test webhook : closed is ignored",
+			strings.Replace(github, "synchronize", "closed", 1),
+			map[string]string{"X-GitHub-Event": "pull_request", "X-Hub-Signature-256": "sha256=00"},
+			false,
+			nil,
+			"Webhook %s %s - got (%v) wanted (%v)",
+		},
+	}
+
+	for _, tt := range tests {
+		fmt.Println(fmt.Sprintf("\nExecuting test : %s", tt.Name))
+		r := httptest.NewRequest("POST", "/api/v1/webhooks/1", strings.NewReader(tt.Body))
+		for k, v := range tt.Headers {
+			r.Header.Set(k, v)
+		}
+		if err := verifyWebhook(r, []byte(tt.Body), "s3cret"); (err == nil) != tt.Verify {
+			t.Errorf(tt.ErrorMsg, tt.Name, "verify", err, tt.Verify)
+		}
+		pr, err := parseWebhook(r, []byte(tt.Body))
+		if err != nil || fmt.Sprint(pr) != fmt.Sprint(tt.Want) {
+			t.Errorf(tt.ErrorMsg, tt.Name, "parse", pr, tt.Want)
+		}
+		fmt.Println("")
+	}
+}
+
+func TestWebhookHandler(t *testing.T) {
+	tmp, _ := ioutil.TempDir("", "webhooks")
+	defer os.RemoveAll(tmp)
+	cwd, _ := os.Getwd()
+	os.Chdir(tmp)
+	defer os.Chdir(cwd)
+	os.Setenv("SECRETS_FILE", filepath.Join(tmp, "secrets.enc"))
+	os.Setenv("SECRETS_KEY", "k3y")
+	defer os.Unsetenv("SECRETS_FILE")
+	defer os.Unsetenv("SECRETS_KEY")
+	secretStore.Put("hook", CredentialDetail{Token: "s3cret"})
+	ioutil.WriteFile("project.json", []byte(`{"repositories":[{"id":"1","webhook":"hook"},{"id":"2"}]}`), 0644)
+	logger := NewLogger("error", "text", ioutil.Discard)
+
+	closed := `{"action":"closed","number":7,"pull_request":{"head":{"ref":"feature","sha":"abc123"},"base":{"ref":"master"}}}`
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(closed))
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	// create anonymous struct
+	tests := []struct {
+		Name      string
+		Repo      string
+		Signature string
+		Want      int
+		ErrorMsg  string
+	}{
+		{"Test webhook handler : signed", "1", signature, 200, "Webhook handler %s - got (%v) wanted (%v)"},
+		{"Test webhook handler : unsigned", "1", "", 401, "Webhook handler %s - got (%v) wanted (%v)"},
+		{"Test webhook handler : bad signature", "1", "sha256=00", 401, "Webhook handler %s - got (%v) wanted (%v)"},
+		{"Test webhook handler : no secret configured", "2", signature, 401, "Webhook handler %s - got (%v) wanted (%v)"},
+		{"Test webhook handler : unknown repository", "3", signature, 400, "Webhook handler %s - got (%v) wanted (%v)"},
+	}
+
+	for _, tt := range tests {
+		fmt.Println(fmt.Sprintf("\nExecuting test : %s", tt.Name))
+		r := httptest.NewRequest("POST", "/api/v1/webhooks/"+tt.Repo, strings.NewReader(closed))
+		r.Header.Set("X-GitHub-Event", "pull_request")
+		if tt.Signature != "" {
+			r.Header.Set("X-Hub-Signature-256", tt.Signature)
+		}
+		w := httptest.NewRecorder()
+		WebhookHandler(w, mux.SetURLVars(r, map[string]string{"id": tt.Repo}), logger)
+		if w.Code != tt.Want {
+			t.Errorf(tt.ErrorMsg, tt.Name, w.Code, tt.Want)
+		}
+		fmt.Println("")
+	}
+}
+
+func TestQueueDedup(t *testing.T) {
+	logger := NewLogger("error", "text", ioutil.Discard)
+	repo := Repository{Id: "dedup"}
+	trigger := Trigger{Event: "push", Sha: "abc123"}
+	key := queueKey(repo, trigger)
+	defer func() {
+		queued.Lock()
+		delete(queued.keys, key)
+		delete(queued.running, key)
+		queued.Unlock()
+	}()
+
+	// a run of the commit is being built, BUILTREF has not moved yet
+	queued.Lock()
+	queued.running[key] = "abc123"
+	queued.Unlock()
+	before := len(runQueue)
+	enqueue(context.Background(), repo, trigger, logger)
+	if len(runQueue) != before {
+		t.Errorf("Queue dedup - got (%v) wanted (%v)", len(runQueue), before)
+	}
+
+	// a new commit is queued while the previous one builds, but only once
+	trigger.Sha = "def456"
+	enqueue(context.Background(), repo, trigger, logger)
+	enqueue(context.Background(), repo, trigger, logger)
+	if len(runQueue) != before+1 {
+		t.Errorf("Queue dedup - got (%v) wanted (%v)", len(runQueue), before+1)
+	}
+
+	// forced runs with parameters are queued next to the push, once per set of values
+	forced := Trigger{Event: "push", Sha: "def456", Force: true, Parameters: map[string]string{"version": "1.0.4", "env": "qa"}}
+	other := Trigger{Event: "push", Sha: "def456", Force: true, Parameters: map[string]string{"version": "1.0.5", "env": "qa"}}
+	defer func() {
+		queued.Lock()
+		delete(queued.keys, queueKey(repo, forced))
+		delete(queued.keys, queueKey(repo, other))
+		queued.Unlock()
+	}()
+	enqueue(context.Background(), repo, forced, logger)
+	enqueue(context.Background(), repo, forced, logger)
+	enqueue(context.Background(), repo, other, logger)
+	if len(runQueue) != before+3 {
+		t.Errorf("Queue parameters - got (%v) wanted (%v)", len(runQueue), before+3)
+	}
+	if q := queueKey(repo, forced); q != "dedup/push?env=qa&version=1.0.4" {
+		t.Errorf("Queue parameters key - got (%v) wanted (%v)", q, "dedup/push?env=qa&version=1.0.4")
+	}
+	<-runQueue
+	<-runQueue
+	<-runQueue
+}
+
+func TestPolledPullRequests(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.EscapedPath() {
+		case "/repos/lmz/api/pulls/5", "/api/v1/repos/lmz/api/pulls/5":
+			fmt.Fprint(w, `{"number":5,"head":{"ref":"feature","sha":"abc123"},"base":{"ref":"develop"}}`)
+		case "/api/v4/projects/lmz%2Fapi/merge_requests/5":
+			fmt.Fprint(w, `{"iid":5,"source_branch":"fix","target_branch":"release"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	// create anonymous struct
+	tests := []struct {
+		Name     string
+		Reader   PullRequestReader
+		Number   int
+		Source   string
+		Target   string
+		Fails    bool
+		ErrorMsg string
+	}{
+		{"Test pull request api : github", &GithubReporter{Url: server.URL, Repo: "lmz/api"}, 5, "feature", "develop", false, "Pull request api %s - got (%v) wanted (%v)"},
+		{"Test pull request api : gitea", &GiteaReporter{Url: server.URL, Repo: "lmz/api"}, 5, "feature", "develop", false, "Pull request api %s - got (%v) wanted (%v)"},
+		{"Test pull request api : gitlab", &GitlabReporter{Url: server.URL, Repo: "lmz/api"}, 5, "fix", "release", false, "Pull request api %s - got (%v) wanted (%v)"},
+		{"Test pull request api : unknown", &GithubReporter{Url: server.URL, Repo: "lmz/api"}, 6, "", "", true, "Pull request api %s - got (%v) wanted (%v)"},
+	}
+
+	for _, tt := range tests {
+		fmt.Println(fmt.Sprintf("\nExecuting test : %s", tt.Name))
+		source, target, err := tt.Reader.PullRequest(tt.Number)
+		if (err != nil) != tt.Fails || source != tt.Source || target != tt.Target {
+			t.Errorf(tt.ErrorMsg, tt.Name, fmt.Sprint(source, " ", target, " ", err), tt.Source+" "+tt.Target)
+		}
+		fmt.Println("")
+	}
+
+	// a polled pull request targets the base branch of the api, not master
+	tmp, _ := ioutil.TempDir("", "polled")
+	defer os.RemoveAll(tmp)
+	logger := NewLogger("error", "text", ioutil.Discard)
+	upstreamDir := filepath.Join(tmp, "upstream")
+	cloneDir := filepath.Join(tmp, "clone")
+	upstream, _ := git.PlainInit(upstreamDir, false)
+	head := commitFile(t, upstream, upstreamDir, "a.txt", "first")
+	upstream.Storer.SetReference(plumbing.NewHashReference("refs/pull/5/head", plumbing.NewHash(head)))
+	scm := &GitSourceProvider{}
+	if err := scm.Clone(upstreamDir, cloneDir); err != nil {
+		t.Fatalf("clone %v", err)
+	}
+	repo := Repository{Id: "polled", PullRequests: "github", Status: &StatusDetail{Provider: "github", Url: server.URL, Repo: "lmz/api"}}
+	defer func() {
+		queued.Lock()
+		delete(queued.keys, "polled/pr/5")
+		queued.Unlock()
+	}()
+	before := len(runQueue)
+	pollPullRequests(context.Background(), scm, repo, cloneDir, logger)
+	head = commitFile(t, upstream, upstreamDir, "a.txt", "second")
+	upstream.Storer.SetReference(plumbing.NewHashReference("refs/pull/5/head", plumbing.NewHash(head)))
+	if err := pollPullRequests(context.Background(), scm, repo, cloneDir, logger); err != nil || len(runQueue) != before+1 {
+		t.Fatalf("Pull request poll - got (%v %v) wanted (%v)", len(runQueue), err, before+1)
+	}
+	q := <-runQueue
+	if pr := q.Trigger.PullRequest; pr.Sha != head || pr.Source != "feature" || pr.Target != "develop" {
+		t.Errorf("Pull request poll - got (%v) wanted (%v)", pr, "feature into develop")
+	}
+}
+
+func TestQueueLocks(t *testing.T) {
+	locks := &namedLocks{locks: map[string]*sync.Mutex{}}
+
+	// other keys build while one is held, the same key waits for it
+	unlock := locks.lock("api/push")
+	locks.lock("api/pr/5")()
+	done := make(chan bool)
+	go func() {
+		locks.lock("api/push")()
+		done <- true
+	}()
+	select {
+	case <-done:
+		t.Errorf("Queue locks - got (%v) wanted (%v)", "a second run of the key", "waiting")
+	case <-time.After(100 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Queue locks - got (%v) wanted (%v)", "still waiting", "the key released")
+	}
+
+	defer os.Unsetenv("RUN_WORKERS")
+	for env, want := range map[string]int{"": 4, "two": 4, "0": 4, "8": 8} {
+		os.Setenv("RUN_WORKERS", env)
+		if got := runWorkers(); got != want {
+			t.Errorf("Queue workers %q - got (%v) wanted (%v)", env, got, want)
+		}
+	}
+}
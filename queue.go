@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	QUEUESIZE int = 100
+)
+
+var (
+	runQueue = make(chan QueuedRun, QUEUESIZE)
+	queued   = struct {
+		sync.Mutex
+		keys map[string]bool
+		// the commit each key is building, BUILTREF only moves when the run finishes
+		running map[string]string
+	}{keys: map[string]bool{}, running: map[string]string{}}
+	worker sync.Once
+	// a queue key builds one run at a time, a clone is fetched and its refs moved by one run (or poll) at a time
+	keyLocks   = &namedLocks{locks: map[string]*sync.Mutex{}}
+	cloneLocks = &namedLocks{locks: map[string]*sync.Mutex{}}
+)
+
+// namedLocks - a mutex per name
+type namedLocks struct {
+	sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+// lock - blocks until name is free, returns the unlock
+func (n *namedLocks) lock(name string) func() {
+	n.Lock()
+	m, ok := n.locks[name]
+	if !ok {
+		m = &sync.Mutex{}
+		n.locks[name] = m
+	}
+	n.Unlock()
+	m.Lock()
+	return m.Unlock
+}
+
+// QueuedRun - a pipeline waiting for the worker
+type QueuedRun struct {
+	Repo    Repository
+	Trigger Trigger
+	Queued  time.Time
+	// the span that queued the run, linked from the build trace
+	link trace.SpanContext
+}
+
+// queueKey - one pending run per repository and branch/pull request, a forced run with parameters has its own
+// key (per set of values) so that a queued push doesn't swallow it
+func queueKey(repo Repository, trigger Trigger) string {
+	if trigger.PullRequest != nil {
+		return repo.Id + "/pr/" + strconv.Itoa(trigger.PullRequest.Number)
+	}
+	if len(trigger.Parameters) > 0 {
+		values := url.Values{}
+		for k, v := range trigger.Parameters {
+			values.Set(k, v)
+		}
+		return repo.Id + "/" + trigger.Event + "?" + values.Encode()
+	}
+	return repo.Id + "/" + trigger.Event
+}
+
+// enqueue - adds the run to the queue, duplicates of an already queued run or of the commit being built are ignored
+func enqueue(ctx context.Context, repo Repository, trigger Trigger, logger *Logger) error {
+	key := queueKey(repo, trigger)
+	queued.Lock()
+	defer queued.Unlock()
+	if queued.keys[key] {
+		logger.Debug("Queue : already queued", "key", key)
+		return nil
+	}
+	if sha, ok := queued.running[key]; ok && sha == trigger.Sha {
+		logger.Debug("Queue : already running", "key", key, "commit", sha)
+		return nil
+	}
+	select {
+	case runQueue <- QueuedRun{Repo: repo, Trigger: trigger, Queued: time.Now(), link: trace.SpanContextFromContext(ctx)}:
+		queued.keys[key] = true
+		logger.Info("Queue : queued", "key", key, "event", trigger.Event, "commit", trigger.Sha)
+		return nil
+	default:
+		return errors.New("run queue is full")
+	}
+}
+
+// runWorkers - RUN_WORKERS (default 4) runs are built at once
+func runWorkers() int {
+	if n, err := strconv.Atoi(os.Getenv("RUN_WORKERS")); err == nil && n > 0 {
+		return n
+	}
+	return 4
+}
+
+// startWorker - starts the pool building the queued pipelines (once per process), runs of different queue keys
+// (repositories, branches or pull requests) overlap, the runs of a key are built in order
+func startWorker(logger *Logger) {
+	worker.Do(func() {
+		for x := 0; x < runWorkers(); x++ {
+			go func() {
+				for q := range runQueue {
+					buildQueued(q, logger)
+				}
+			}()
+		}
+	})
+}
+
+// buildQueued - waits for the previous run of its key and builds it, the run stays queued (so that the same
+// branch isn't queued twice) until it starts
+func buildQueued(q QueuedRun, logger *Logger) {
+	key := queueKey(q.Repo, q.Trigger)
+	unlock := keyLocks.lock(key)
+	defer unlock()
+	queued.Lock()
+	delete(queued.keys, key)
+	queued.running[key] = q.Trigger.Sha
+	queued.Unlock()
+	queueWait.WithLabelValues(q.Repo.Id).Observe(time.Since(q.Queued).Seconds())
+	// one trace per build, linked to the poll or webhook that queued it
+	ctx, span := tracer.Start(context.Background(), "build "+q.Repo.Name,
+		trace.WithLinks(trace.Link{SpanContext: q.link}),
+		trace.WithAttributes(
+			attribute.String("cicd.repo", q.Repo.Id),
+			attribute.String("cicd.event", q.Trigger.Event),
+			attribute.String("cicd.commit", q.Trigger.Sha),
+			attribute.Float64("cicd.queue.wait", time.Since(q.Queued).Seconds()),
+		))
+	executePipeline(ctx, q.Repo, q.Trigger, logger)
+	span.End()
+	queued.Lock()
+	delete(queued.running, key)
+	queued.Unlock()
+}
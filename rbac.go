@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+)
+
+// roles, each one includes the permissions of the roles before it
+var roles = []string{"viewer", "developer", "deployer", "admin"}
+
+// actions and the lowest role allowed to do them
+var actions = map[string]string{
+	"view":    "viewer",
+	"logs":    "developer",
+	"trigger": "developer",
+	"approve": "deployer",
+	"secrets": "admin",
+	"project": "admin",
+	"audit":   "admin",
+	"agent":   "admin",
+}
+
+var errForbidden = errors.New("forbidden")
+
+// RoleBinding - grants the role to the users and to the members of the groups,
+// on the project (ProjectDetail.Roles) or on a single repository (Repository.Roles)
+type RoleBinding struct {
+	Role   string   `json:"role"`
+	Users  []string `json:"users,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+}
+
+// PermissionDetail - the roles and allowed actions of the caller, project wide and per repository
+type PermissionDetail struct {
+	User         string              `json:"user"`
+	Groups       []string            `json:"groups,omitempty"`
+	Role         string              `json:"role,omitempty"`
+	Actions      []string            `json:"actions"`
+	Repositories map[string][]string `json:"repositories"`
+}
+
+// roleRank - position of the role in roles, -1 for no (or an unknown) role
+func roleRank(role string) int {
+	for i, r := range roles {
+		if r == role {
+			return i
+		}
+	}
+	return -1
+}
+
+// bound - the highest role the bindings give to the principal
+func bound(p *Principal, bindings []RoleBinding) int {
+	rank := -1
+	for _, b := range bindings {
+		match := false
+		for _, u := range b.Users {
+			match = match || u == p.Name
+		}
+		for _, g := range b.Groups {
+			for _, pg := range p.Groups {
+				match = match || g == pg
+			}
+		}
+		if r := roleRank(b.Role); match && r > rank {
+			rank = r
+		}
+	}
+	return rank
+}
+
+// roleOf - the role of the principal on the repository (repoId "" for the project itself),
+// project bindings apply to every repository, without authentication (no authenticator configured)
+// everyone is admin, no principal at all has no role
+func roleOf(p *Principal, project ProjectDetail, repoId string) int {
+	if p == nil {
+		return -1
+	}
+	if p.Method == "none" {
+		return len(roles) - 1
+	}
+	rank := bound(p, project.Roles)
+	for _, repo := range project.Repositories {
+		if repoId != "" && repo.Id == repoId {
+			if r := bound(p, repo.Roles); r > rank {
+				rank = r
+			}
+		}
+	}
+	return rank
+}
+
+// allowed - the actions a role can do, sorted
+func allowed(rank int) []string {
+	list := []string{}
+	for action, role := range actions {
+		if rank >= 0 && rank >= roleRank(role) {
+			list = append(list, action)
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+// can - whether the principal can do the action on the repository (repoId "" for the project)
+func can(p *Principal, project ProjectDetail, repoId string, action string) bool {
+	rank := roleOf(p, project, repoId)
+	return rank >= 0 && rank >= roleRank(actions[action])
+}
+
+// canAny - whether the principal can do the action on the project or on any of its repositories
+func canAny(p *Principal, project ProjectDetail, action string) bool {
+	if can(p, project, "", action) {
+		return true
+	}
+	for _, repo := range project.Repositories {
+		if can(p, project, repo.Id, action) {
+			return true
+		}
+	}
+	return false
+}
+
+// readProject - project.json
+func readProject() (ProjectDetail, error) {
+	var project ProjectDetail
+
+	file, err := ioutil.ReadFile("project.json")
+	if err != nil {
+		return project, err
+	}
+	err = json.Unmarshal(file, &project)
+	return project, err
+}
+
+// validateProject - repository ids are set and unique, the bindings name known roles
+func validateProject(project ProjectDetail) error {
+	bindings := project.Roles
+	ids := map[string]bool{}
+	for _, repo := range project.Repositories {
+		if repo.Id == "" || ids[repo.Id] {
+			return fmt.Errorf("repository id %q missing or duplicated", repo.Id)
+		}
+		ids[repo.Id] = true
+		bindings = append(bindings, repo.Roles...)
+	}
+	for _, b := range bindings {
+		if roleRank(b.Role) < 0 {
+			return fmt.Errorf("unknown role %q", b.Role)
+		}
+	}
+	return nil
+}
+
+// authorize - can with the project read from project.json, a project that can't be read only
+// allows unauthenticated (open) setups
+func authorize(p *Principal, repoId string, action string) error {
+	project, err := readProject()
+	if err != nil && (p == nil || p.Method != "none") {
+		return err
+	}
+	if !can(p, project, repoId, action) {
+		return errForbidden
+	}
+	return nil
+}
+
+// permissions - what the principal can do on the project and on each repository
+func permissions(p *Principal, project ProjectDetail) PermissionDetail {
+	detail := PermissionDetail{Repositories: map[string][]string{}}
+	if p != nil {
+		detail.User = p.Name
+		detail.Groups = p.Groups
+	}
+	rank := roleOf(p, project, "")
+	if rank >= 0 {
+		detail.Role = roles[rank]
+	}
+	detail.Actions = allowed(rank)
+	for _, repo := range project.Repositories {
+		detail.Repositories[repo.Id] = allowed(roleOf(p, project, repo.Id))
+	}
+	return detail
+}
+
+// forbidden - writes the 403 response for the handlers
+func forbidden(w http.ResponseWriter, r *http.Request, action string, logger *Logger) {
+	name := ""
+	if p := principal(r); p != nil {
+		name = p.Name
+	}
+	logger.Warn("RBAC : denied", "user", name, "action", action, "path", r.URL.Path)
+	response := Response{Name: os.Getenv("NAME"), StatusCode: "403", Status: "KO", Message: fmt.Sprintf("%s not allowed", action), Payload: []Pipeline{}}
+	w.WriteHeader(http.StatusForbidden)
+	b, _ := json.MarshalIndent(response, "", "	")
+	fmt.Fprint(w, string(b))
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRoles(t *testing.T) {
+	project := ProjectDetail{
+		Roles: []RoleBinding{{Role: "viewer", Groups: []string{"staff"}}, {Role: "admin", Users: []string{"root"}}},
+		Repositories: []Repository{
+			{Id: "api", Roles: []RoleBinding{{Role: "deployer", Users: []string{"alice"}}, {Role: "developer", Groups: []string{"devs"}}}},
+			{Id: "web", Roles: []RoleBinding{{Role: "developer", Users: []string{"alice"}}}},
+		},
+	}
+	alice := &Principal{Name: "alice", Groups: []string{"staff"}, Method: "oidc"}
+	bob := &Principal{Name: "bob", Groups: []string{"devs"}, Method: "token"}
+	eve := &Principal{Name: "eve", Method: "basic"}
+	root := &Principal{Name: "root", Method: "token"}
+	anonymous := &Principal{Name: "anonymous", Method: "none"}
+
+	// create anonymous struct
+	tests := []struct {
+		Name      string
+		Principal *Principal
+		Repo      string
+		Action    string
+		Want      bool
+		ErrorMsg  string
+	}{
+		{"Test rbac : repository deployer approves", alice, "api", "approve", true, "Rbac %s - got (%v) wanted (%v)"},
+		{"Test rbac : developer elsewhere can't approve", alice, "web", "approve", false, "Rbac %s - got (%v) wanted (%v)"},
+		{"Test rbac : project viewer views", alice, "web", "view", true, "Rbac %s - got (%v) wanted (%v)"},
+		{"Test rbac : group developer triggers", bob, "api", "trigger", true, "Rbac %s - got (%v) wanted (%v)"},
+		{"Test rbac : group developer reads logs", bob, "api", "logs", true, "Rbac %s - got (%v) wanted (%v)"},
+		{"Test rbac : no binding on the repository", bob, "web", "view", false, "Rbac %s - got (%v) wanted (%v)"},
+		{"Test rbac : no binding at all", eve, "api", "view", false, "Rbac %s - got (%v) wanted (%v)"},
+		{"Test rbac : only admins manage secrets", alice, "", "secrets", false, "Rbac %s - got (%v) wanted (%v)"},
+		{"Test rbac : project admin", root, "", "project", true, "Rbac %s - got (%v) wanted (%v)"},
+		{"Test rbac : project admin on every repository", root, "web", "approve", true, "Rbac %s - got (%v) wanted (%v)"},
+		{"Test rbac : without authentication", anonymous, "api", "secrets", true, "Rbac %s - got (%v) wanted (%v)"},
+		{"Test rbac : no principal", nil, "api", "view", false, "Rbac %s - got (%v) wanted (%v)"},
+	}
+
+	for _, tt := range tests {
+		fmt.Println(fmt.Sprintf("\nExecuting test : %s", tt.Name))
+		if got := can(tt.Principal, project, tt.Repo, tt.Action); got != tt.Want {
+			t.Errorf(tt.ErrorMsg, tt.Name, got, tt.Want)
+		}
+		fmt.Println("")
+	}
+
+	perms := permissions(alice, project)
+	want := map[string][]string{"api": {"approve", "logs", "trigger", "view"}, "web": {"logs", "trigger", "view"}}
+	if perms.Role != "viewer" || !reflect.DeepEqual(perms.Actions, []string{"view"}) || !reflect.DeepEqual(perms.Repositories, want) {
+		t.Errorf("Rbac permissions - got (%v) wanted (%v)", perms, want)
+	}
+	if !canAny(bob, project, "view") || canAny(eve, project, "view") {
+		t.Errorf("Rbac canAny - got (%v %v) wanted (true false)", canAny(bob, project, "view"), canAny(eve, project, "view"))
+	}
+	if err := validateProject(ProjectDetail{Roles: []RoleBinding{{Role: "owner"}}}); err == nil {
+		t.Errorf("Rbac validateProject - got (%v) wanted (error)", err)
+	}
+	if err := validateProject(project); err != nil {
+		t.Errorf("Rbac validateProject - got (%v) wanted (nil)", err)
+	}
+
+	// without a readable project.json only open setups are allowed
+	tmp, _ := ioutil.TempDir("", "rbac")
+	defer os.RemoveAll(tmp)
+	cwd, _ := os.Getwd()
+	os.Chdir(tmp)
+	defer os.Chdir(cwd)
+	for _, p := range []*Principal{anonymous, root, nil} {
+		if err := authorize(p, "api", "view"); (err == nil) != (p == anonymous) {
+			t.Errorf("Rbac authorize without project.json %v - got (%v) wanted (%v)", p, err, p == anonymous)
+		}
+	}
+}
+
+func TestBroadcastRoles(t *testing.T) {
+	tmp, _ := ioutil.TempDir("", "broadcast")
+	defer os.RemoveAll(tmp)
+	cwd, _ := os.Getwd()
+	os.Chdir(tmp)
+	defer os.Chdir(cwd)
+	ioutil.WriteFile("project.json", []byte(`{"roles":[{"role":"viewer","groups":["staff"]}],"repositories":[{"id":"api","roles":[{"role":"developer","users":["bob"]}]}]}`), 0644)
+	logger := NewLogger("error", "text", ioutil.Discard)
+
+	// the dashboards connect as ?user=<name>
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// mallory isn't in staff and has no role at all
+		p := &Principal{Name: r.URL.Query().Get("user"), Groups: []string{"staff"}, Method: "token"}
+		if p.Name == "mallory" {
+			p.Groups = nil
+		}
+		addClient(conn, p)
+		defer removeClient(conn)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+	dial := func(user string) *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"?user="+user, nil)
+		if err != nil {
+			t.Fatalf("Broadcast dial %v", err)
+		}
+		return conn
+	}
+	bob, eve, mallory := dial("bob"), dial("eve"), dial("mallory")
+	defer bob.Close()
+	defer eve.Close()
+	defer mallory.Close()
+	for x := 0; x < 200; x++ {
+		clients.Lock()
+		n := len(clients.conns)
+		clients.Unlock()
+		if n == 3 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	broadcastRepo("api", "logs", "secret log line", logger)
+	broadcastEvent("run.finished", &Run{Id: "r1", RepoId: "api", Parameters: map[string]string{"version": "1.0.4"}}, logger)
+	// eve only gets the run event, mallory nothing
+	for conn, want := range map[*websocket.Conn]string{bob: "secret log line", eve: `{"event":"run.finished"`} {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, msg, err := conn.ReadMessage(); err != nil || !strings.HasPrefix(string(msg), want) {
+			t.Errorf("Broadcast roles - got (%s %v) wanted (%v)", msg, err, want)
+		}
+	}
+	mallory.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if _, msg, err := mallory.ReadMessage(); err == nil {
+		t.Errorf("Broadcast roles - got (%s) wanted (%v)", msg, "nothing without a role")
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	RUNSDIR string = "runs"
+	LOGSDIR string = "logs"
+)
+
+var (
+	runStore = &RunStore{runs: map[string]*Run{}, dir: RUNSDIR}
+)
+
+// RunStore - keeps every run in memory and persists each one as runs/<id>.json
+type RunStore struct {
+	mu   sync.Mutex
+	runs map[string]*Run
+	dir  string
+}
+
+// newRunId - unique (and sortable) run id, used for the run scoped directories too
+func newRunId() string {
+	return strconv.FormatInt(time.Now().Unix(), 10) + fmt.Sprintf("%04x", rand.Intn(0xffff))
+}
+
+// Create - registers a new run for the pipeline, all stages start as "queued"
+func (s *RunStore) Create(id string, repo Repository, pipeline *Pipeline, commit string) *Run {
+	run := &Run{
+		Id:       id,
+		RepoId:   repo.Id,
+		Pipeline: pipeline.Id,
+		Commit:   commit,
+		Status:   "running",
+		Start:    time.Now().Unix(),
+	}
+	for _, stage := range pipeline.Stages {
+		run.Stages = append(run.Stages, StageRun{Id: stage.Id, Name: stage.Name, Status: "queued"})
+	}
+	s.Save(run)
+	return run
+}
+
+// Save - stores a copy of the run and writes it to disk
+func (s *RunStore) Save(run *Run) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cp := copyRun(run)
+	s.runs[run.Id] = &cp
+	os.MkdirAll(s.dir, os.ModePerm)
+	data, _ := json.MarshalIndent(cp, "", "  ")
+	return ioutil.WriteFile(s.dir+"/"+run.Id+".json", data, 0755)
+}
+
+// Get - returns a copy of the run, falling back to the file on disk
+func (s *RunStore) Get(id string) (Run, error) {
+	var run Run
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r, ok := s.runs[id]; ok {
+		return copyRun(r), nil
+	}
+	data, err := ioutil.ReadFile(s.dir + "/" + id + ".json")
+	if err != nil {
+		return run, errors.New("run " + id + " not found")
+	}
+	err = json.Unmarshal(data, &run)
+	return run, err
+}
+
+// Load - reads the persisted runs back into memory (on startup)
+func (s *RunStore) Load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, f := range files {
+		var run Run
+		data, err := ioutil.ReadFile(s.dir + "/" + f.Name())
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &run); err != nil {
+			return fmt.Errorf("run file %s %v", f.Name(), err)
+		}
+		if run.Status == "waiting" {
+			// nothing can decide it after a restart
+			expireRun(&run)
+			data, _ = json.MarshalIndent(run, "", "  ")
+			if err := ioutil.WriteFile(s.dir+"/"+f.Name(), data, 0755); err != nil {
+				return err
+			}
+		}
+		s.runs[run.Id] = &run
+	}
+	return nil
+}
+
+// expireRun - fails a run that was left waiting for an approval, its approval expires
+func expireRun(run *Run) {
+	now := time.Now().Unix()
+	for x := range run.Stages {
+		sr := &run.Stages[x]
+		if sr.Status != "waiting" {
+			continue
+		}
+		sr.Status = "rejected"
+		sr.End = now
+		if sr.Approval != nil {
+			sr.Approval.Decision = "expired"
+			sr.Approval.Time = now
+		}
+	}
+	run.Status = "failed"
+	run.End = now
+}
+
+// List - all runs known in memory, newest first
+func (s *RunStore) List() []Run {
+	var runs []Run
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range s.runs {
+		runs = append(runs, copyRun(r))
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].Start > runs[j].Start })
+	return runs
+}
+
+func copyRun(run *Run) Run {
+	cp := *run
+	cp.Stages = make([]StageRun, len(run.Stages))
+	copy(cp.Stages, run.Stages)
+	cp.Artifacts = append([]ArtifactDetail(nil), run.Artifacts...)
+	cp.Commits = append([]CommitDetail(nil), run.Commits...)
+	return cp
+}
+
+// stageRun - looks up the stage record by stage id
+func (r *Run) stageRun(id int) *StageRun {
+	for x := range r.Stages {
+		if r.Stages[x].Id == id {
+			return &r.Stages[x]
+		}
+	}
+	return nil
+}
+
+// runRepo - the repository id of the run ("" when unknown)
+func runRepo(id string) string {
+	run, _ := runStore.Get(id)
+	return run.RepoId
+}
+
+// stageLogPath - logs/<run id>/<stage id>.log, kept out of the runs dir (Load reads every file there)
+func stageLogPath(runId string, stageId int) string {
+	return LOGSDIR + "/" + runId + "/" + strconv.Itoa(stageId) + ".log"
+}
+
+// appendStageLog - adds the output to the log of the stage in the run
+func appendStageLog(runId string, stageId int, data string) error {
+	os.MkdirAll(LOGSDIR+"/"+runId, os.ModePerm)
+	f, err := os.OpenFile(stageLogPath(runId, stageId), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(data)
+	return err
+}
+
+// stageStatus - records the stage status on the run and notifies all connected dashboards
+func stageStatus(run *Run, stageId int, status string, logger *Logger) {
+	if sr := run.stageRun(stageId); sr != nil {
+		sr.Status = status
+		switch status {
+		case "pending":
+			sr.Start = time.Now().Unix()
+		case "success", "error", "skipping", "rejected":
+			sr.End = time.Now().Unix()
+			if sr.Start > 0 && status != "skipping" {
+				stageDuration.WithLabelValues(run.RepoId, sr.Name).Observe(float64(sr.End - sr.Start))
+			}
+		}
+	}
+	runStore.Save(run)
+	broadcastRepo(run.RepoId, "view", run.Pipeline+"-"+strconv.Itoa(stageId)+":"+status, logger)
+	if sr := run.stageRun(stageId); sr != nil {
+		reportStatus(run, sr.Name, status, logger)
+	}
+}
+
+// finishRun - sets the final status of the run
+func finishRun(run *Run, status string, logger *Logger) {
+	run.Status = status
+	run.End = time.Now().Unix()
+	runStore.Save(run)
+	runsTotal.WithLabelValues(run.RepoId, status).Inc()
+	broadcastEvent("run.finished", run, logger)
+	reportStatus(run, "", status, logger)
+	if len(run.notify) > 0 {
+		// delivered in the background, a slow smtp server or webhook must not hold the worker
+		cp := copyRun(run)
+		go notifyRun(&cp, runEvents(run, status), logger)
+	}
+	logger.Info("Run : finished", "run", run.Id, "status", status)
+}
+
+// broadcastEvent - sends the run as a json event to the dashboards whose user can view its repository
+func broadcastEvent(event string, run *Run, logger *Logger) {
+	b, _ := json.Marshal(RunEvent{Event: event, Run: copyRun(run)})
+	broadcastRepo(run.RepoId, "view", string(b), logger)
+}
@@ -22,28 +22,78 @@ func (ct *CustomTime) UnmarshalJSON(b []byte) (err error) {
 // ShcemaInterface - acts as an interface wrapper for our profile schema
 // All the go microservices will using this schema
 type Pipeline struct {
-	Id         string        `json:"id"`
-	Project    string        `json:"project"`
-	Scm        string        `json:"scm"`
-	Workdir    string        `json:"workdir"`
-	Force      bool          `json:"force"`
-	Stages     []StageDetail `json:"stages"`
-	LastUpdate int64         `json:"lastupdate,omitempty"`
-	MetaInfo   string        `json:"metainfo,omitempty"`
+	Id            string               `json:"id"`
+	Project       string               `json:"project"`
+	Scm           string               `json:"scm"`
+	Workdir       string               `json:"workdir"`
+	Force         bool                 `json:"force"`
+	Parameters    []ParameterDetail    `json:"parameters,omitempty"`
+	Stages        []StageDetail        `json:"stages"`
+	LastUpdate    int64                `json:"lastupdate,omitempty"`
+	MetaInfo      string               `json:"metainfo,omitempty"`
+	Notifications []NotificationDetail `json:"notifications,omitempty"`
+	RunsOn        map[string]string    `json:"runsOn,omitempty"`
 }
 
 type StageDetail struct {
-	Id       int           `json:"id"`
-	Name     string        `json:"name"`
-	Exec     string        `json:"exec"`
-	Wait     int           `json:"wait"`
-	Service  string        `json:"service"`
-	Replicas int           `json:"replicas"`
-	Skip     bool          `json:"skip"`
-	Envars   []EnvarDetail `json:"envars"`
-	Commands []string      `json:"commands"`
-	Status   string        `json:"status"`
-	Log      string        `json:"log"`
+	Id        int                    `json:"id"`
+	Name      string                 `json:"name"`
+	Type      string                 `json:"type,omitempty"`
+	Exec      string                 `json:"exec"`
+	Wait      int                    `json:"wait"`
+	Expiry    int                    `json:"expiry,omitempty"`
+	Skip      bool                   `json:"skip"`
+	Envars    []EnvarDetail          `json:"envars"`
+	Commands  []string               `json:"commands"`
+	Artifacts []string               `json:"artifacts,omitempty"`
+	Restore   []string               `json:"restore,omitempty"`
+	Cache     *CacheDetail           `json:"cache,omitempty"`
+	When      *WhenDetail            `json:"when,omitempty"`
+	RunsOn    map[string]string      `json:"runsOn,omitempty"`
+	Image     string                 `json:"image,omitempty"`
+	Limits    *LimitsDetail          `json:"limits,omitempty"`
+	Sandbox   bool                   `json:"sandbox,omitempty"`
+	With      map[string]interface{} `json:"with,omitempty"`
+	Status    string                 `json:"status"`
+	Log       string                 `json:"log"`
+
+	// Service, Replicas - replaced by the deploy stage inputs, only read to refuse older cicd.json files
+	Service  string `json:"service,omitempty"`
+	Replicas int    `json:"replicas,omitempty"`
+}
+
+// ParameterDetail - input declared by a pipeline for manually triggered runs
+// Type is one of string, bool or choice
+type ParameterDetail struct {
+	Name        string   `json:"name"`
+	Type        string   `json:"type"`
+	Default     string   `json:"default"`
+	Choices     []string `json:"choices,omitempty"`
+	Required    bool     `json:"required"`
+	Description string   `json:"description,omitempty"`
+}
+
+// CacheDetail - paths restored before and saved after the stage, keyed by the (templated) key
+type CacheDetail struct {
+	Key   string   `json:"key"`
+	Paths []string `json:"paths"`
+}
+
+// LimitsDetail - resources of a stage, memory and output are sizes like 512m, cpu and wall time are seconds
+// (cpus only applies to containers, cpu time, output and wall time only to the host)
+type LimitsDetail struct {
+	Cpus    float64 `json:"cpus,omitempty"`
+	Memory  string  `json:"memory,omitempty"`
+	Procs   int     `json:"procs,omitempty"`
+	CpuTime int     `json:"cpuTime,omitempty"`
+	Output  string  `json:"output,omitempty"`
+	Wall    int     `json:"wall,omitempty"`
+}
+
+// WhenDetail - the stage only runs for the listed events (push, pull_request) and branches (target branch for pull requests)
+type WhenDetail struct {
+	Event  []string `json:"event,omitempty"`
+	Branch []string `json:"branch,omitempty"`
 }
 
 type EnvarDetail struct {
@@ -53,28 +103,206 @@ type EnvarDetail struct {
 
 // Response schema
 type Response struct {
-	Name       string      `json:"name"`
-	StatusCode string      `json:"statuscode"`
-	Status     string      `json:"status"`
-	Message    string      `json:"message"`
-	Stage      StageDetail `json:"stage,omitempty"`
-	MetaInfo   string      `json:"metainfo,omitempty"`
-	Payload    []Pipeline  `json:"payload"`
+	Name        string             `json:"name"`
+	StatusCode  string             `json:"statuscode"`
+	Status      string             `json:"status"`
+	Message     string             `json:"message"`
+	Stage       StageDetail        `json:"stage,omitempty"`
+	MetaInfo    string             `json:"metainfo,omitempty"`
+	Payload     []Pipeline         `json:"payload"`
+	Runs        []Run              `json:"runs,omitempty"`
+	Credentials []CredentialDetail `json:"credentials,omitempty"`
+	Permissions *PermissionDetail  `json:"permissions,omitempty"`
+	Audit       []AuditEntry       `json:"audit,omitempty"`
+	Agents      []AgentDetail      `json:"agents,omitempty"`
 }
 
 type Repository struct {
-	Id       string `json:"id"`
-	Name     string `json:"name"`
-	MetaInfo string `json:"metainfo"`
-	WorkDir  string `json:"workdir"`
-	Path     string `json:"path"`
-	Scm      string `json:"scm"`
-	RawUrl   string `json:"cicd-raw-url"`
-	Skip     bool   `json:"skip"`
-	Force    bool   `json:"force"`
+	Id            string               `json:"id"`
+	Name          string               `json:"name"`
+	MetaInfo      string               `json:"metainfo"`
+	WorkDir       string               `json:"workdir"`
+	Path          string               `json:"path"`
+	Scm           string               `json:"scm"`
+	RawUrl        string               `json:"cicd-raw-url"`
+	Skip          bool                 `json:"skip"`
+	Force         bool                 `json:"force"`
+	Credentials   string               `json:"credentials,omitempty"`
+	Status        *StatusDetail        `json:"status,omitempty"`
+	PullRequests  string               `json:"pullrequests,omitempty"`
+	Webhook       string               `json:"webhook,omitempty"`
+	Pipelines     []PipelineDetail     `json:"pipelines,omitempty"`
+	Checkout      *CheckoutDetail      `json:"checkout,omitempty"`
+	Roles         []RoleBinding        `json:"roles,omitempty"`
+	Notifications []NotificationDetail `json:"notifications,omitempty"`
+
+	// parameters of a forced poll, never kept in project.json
+	Parameters map[string]string `json:"-"`
+}
+
+// CheckoutDetail - clone/fetch and checkout options of a repository
+// Depth > 0 makes shallow clones/fetches, Sparse holds the sparse checkout patterns
+type CheckoutDetail struct {
+	Submodules bool     `json:"submodules,omitempty"`
+	Lfs        bool     `json:"lfs,omitempty"`
+	Depth      int      `json:"depth,omitempty"`
+	Sparse     []string `json:"sparse,omitempty"`
+}
+
+// PipelineDetail - one of the pipelines of a (monorepo) repository
+// Dir is the sub-directory the stages run in, File the cicd.json path (default <dir>/cicd.json)
+// and Paths the globs of the files that trigger it (default <dir>/**)
+type PipelineDetail struct {
+	Name  string   `json:"name"`
+	Dir   string   `json:"dir,omitempty"`
+	File  string   `json:"file,omitempty"`
+	Paths []string `json:"paths,omitempty"`
+}
+
+// StatusDetail - where commit statuses are reported to
+// Provider is one of github, gitlab or gitea, Repo is owner/name (or the gitlab project id/path)
+// Credentials names a token credential in the secret store
+type StatusDetail struct {
+	Provider    string `json:"provider"`
+	Url         string `json:"url,omitempty"`
+	Repo        string `json:"repo"`
+	Credentials string `json:"credentials"`
+	Context     string `json:"context,omitempty"`
+	Stages      bool   `json:"stages"`
+}
+
+// NotificationDetail - a channel notified of run outcomes, On is any of failure, recovery, success
+// and approval (default failure and recovery), Type one of webhook, slack, mattermost, teams or email
+// Secret is the credential (token) that signs webhook payloads, Template the email body (text/template)
+type NotificationDetail struct {
+	Type     string   `json:"type"`
+	On       []string `json:"on,omitempty"`
+	Url      string   `json:"url,omitempty"`
+	Secret   string   `json:"secret,omitempty"`
+	To       []string `json:"to,omitempty"`
+	Subject  string   `json:"subject,omitempty"`
+	Template string   `json:"template,omitempty"`
+	Lines    int      `json:"lines,omitempty"`
+}
+
+// CredentialDetail - kept in the encrypted secret store, referenced by name
+// Type is one of ssh (privatekey + knownhosts), https (username + token or password) or token
+type CredentialDetail struct {
+	Name       string `json:"name,omitempty"`
+	Type       string `json:"type"`
+	PrivateKey string `json:"privatekey,omitempty"`
+	Passphrase string `json:"passphrase,omitempty"`
+	KnownHosts string `json:"knownhosts,omitempty"`
+	Username   string `json:"username,omitempty"`
+	Password   string `json:"password,omitempty"`
+	Token      string `json:"token,omitempty"`
 }
 
 type ProjectDetail struct {
-	Name         string       `json:"name"`
-	Repositories []Repository `json:"repositories"`
+	Name         string        `json:"name"`
+	Repositories []Repository  `json:"repositories"`
+	Roles        []RoleBinding `json:"roles,omitempty"`
+}
+
+// Run schema - records a single execution of a pipeline
+type Run struct {
+	Id          string             `json:"id"`
+	RepoId      string             `json:"repoid"`
+	Pipeline    string             `json:"pipeline"`
+	Commit      string             `json:"commit"`
+	Event       string             `json:"event"`
+	PullRequest *PullRequestDetail `json:"pullrequest,omitempty"`
+	Previous    string             `json:"previous,omitempty"`
+	Head        CommitDetail       `json:"head"`
+	Commits     []CommitDetail     `json:"commits,omitempty"`
+	Parameters  map[string]string  `json:"parameters,omitempty"`
+	Status      string             `json:"status"`
+	Start       int64              `json:"start"`
+	End         int64              `json:"end,omitempty"`
+	Stages      []StageRun         `json:"stages"`
+	Artifacts   []ArtifactDetail   `json:"artifacts,omitempty"`
+	reporter    *runReporter
+	notify      []NotificationDetail
+	callback    string
+	source      *jobSource
+}
+
+// CommitDetail - metadata of a single commit
+type CommitDetail struct {
+	Hash           string `json:"hash"`
+	Author         string `json:"author"`
+	AuthorEmail    string `json:"authoremail"`
+	Committer      string `json:"committer"`
+	CommitterEmail string `json:"committeremail"`
+	Subject        string `json:"subject"`
+	Timestamp      int64  `json:"timestamp"`
+}
+
+// ArtifactDetail - a file archived from a stage, stored by its sha256 digest
+type ArtifactDetail struct {
+	Name    string `json:"name"`
+	Stage   string `json:"stage"`
+	Digest  string `json:"digest"`
+	Size    int64  `json:"size"`
+	Created int64  `json:"created"`
+}
+
+type StageRun struct {
+	Id       int               `json:"id"`
+	Name     string            `json:"name"`
+	Status   string            `json:"status"`
+	Start    int64             `json:"start,omitempty"`
+	End      int64             `json:"end,omitempty"`
+	Approval *ApprovalDetail   `json:"approval,omitempty"`
+	Outputs  map[string]string `json:"outputs,omitempty"`
+	Cache    string            `json:"cache,omitempty"`
+	CacheKey string            `json:"cachekey,omitempty"`
+	Reason   string            `json:"reason,omitempty"`
+}
+
+// ApprovalDetail - the sign-off (or rejection) of an approval stage
+type ApprovalDetail struct {
+	Decision string `json:"decision"`
+	Approver string `json:"approver"`
+	Comment  string `json:"comment"`
+	Expires  int64  `json:"expires,omitempty"`
+	Time     int64  `json:"time,omitempty"`
+}
+
+// PullRequestDetail - the pull/merge request a run builds
+type PullRequestDetail struct {
+	Number int    `json:"number"`
+	Ref    string `json:"ref"`
+	Source string `json:"source"`
+	Target string `json:"target"`
+	Sha    string `json:"sha"`
+}
+
+// Trigger - what the worker should build
+// Ref is where the built commit is recorded once the run is done
+type Trigger struct {
+	Event       string             `json:"event"`
+	Sha         string             `json:"sha"`
+	Previous    string             `json:"previous,omitempty"`
+	Ref         string             `json:"ref"`
+	Force       bool               `json:"force,omitempty"`
+	Parameters  map[string]string  `json:"parameters,omitempty"`
+	PullRequest *PullRequestDetail `json:"pullrequest,omitempty"`
+}
+
+// RunEvent - json event broadcast to the dashboards (run.started, run.finished)
+type RunEvent struct {
+	Event string `json:"event"`
+	Run   Run    `json:"run"`
+}
+
+// WebsocketCommand - json messages sent from the dashboard
+type WebsocketCommand struct {
+	Command    string            `json:"command"`
+	Repo       string            `json:"repo"`
+	Run        string            `json:"run"`
+	Stage      int               `json:"stage"`
+	Approver   string            `json:"approver"`
+	Comment    string            `json:"comment"`
+	Parameters map[string]string `json:"parameters,omitempty"`
 }
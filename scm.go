@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+// SourceProvider - all the scm operations the pipeline needs
+// dir is always the local clone of the repository
+type SourceProvider interface {
+	Clone(url string, dir string) error
+	Fetch(dir string) error
+	FetchRefs(dir string, refspecs []string) error
+	ListRefs(dir string, prefix string) (map[string]string, error)
+	ResolveRef(dir string, ref string) (string, error)
+	UpdateRef(dir string, ref string, sha string) error
+	// Checkout - creates a clean checkout of the commit in dest (outside of the clone)
+	Checkout(dir string, dest string, sha string) error
+	RemoveCheckout(dir string, dest string) error
+	// Merge - merges the commit into the checkout in dest (pull request merge result)
+	Merge(dest string, sha string) error
+	// ChangedFiles - the files changed on to since its merge base with from (from...to), a pull request only
+	// lists its own changes
+	ChangedFiles(dir string, from string, to string) ([]string, error)
+	Commit(dir string, sha string) (CommitDetail, error)
+	// Log - the commits reachable from to but not from from (newest first, at most MAXCOMMITS)
+	Log(dir string, from string, to string) ([]CommitDetail, error)
+	// Close - removes any credential files used by the provider
+	Close() error
+}
+
+const (
+	MAXCOMMITS int = 100
+)
+
+// ScmError - structured error returned by the providers
+type ScmError struct {
+	Op     string
+	Dir    string
+	Output string
+	Err    error
+}
+
+func (e *ScmError) Error() string {
+	msg := "scm " + e.Op + " (" + e.Dir + ") : " + e.Err.Error()
+	if strings.TrimSpace(e.Output) != "" {
+		msg += " : " + strings.TrimSpace(e.Output)
+	}
+	return msg
+}
+
+func (e *ScmError) Unwrap() error {
+	return e.Err
+}
+
+// newSourceProvider - SCM_PROVIDER=cli uses the git binary, anything else the native go-git client
+func newSourceProvider(opts CheckoutDetail) SourceProvider {
+	if os.Getenv("SCM_PROVIDER") == "cli" {
+		return &CliSourceProvider{Options: opts}
+	}
+	return &GitSourceProvider{Options: opts}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// CliSourceProvider - fallback provider, runs the git binary directly (no shell) with separate arguments
+// Env holds the credential envars (GIT_SSH_COMMAND etc) for this repository only, they are reused for submodules and lfs
+type CliSourceProvider struct {
+	Env     []string
+	Options CheckoutDetail
+	credDir string
+}
+
+func (p *CliSourceProvider) git(op string, dir string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), p.Env...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", &ScmError{Op: op, Dir: dir, Output: stderr.String(), Err: err}
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+func (p *CliSourceProvider) Clone(url string, dir string) error {
+	args := []string{"clone"}
+	if p.Options.Depth > 0 {
+		args = append(args, "--depth", strconv.Itoa(p.Options.Depth), "--no-single-branch")
+	}
+	if p.Options.Submodules {
+		args = append(args, "--recurse-submodules")
+	}
+	_, err := p.git("clone", ".", append(args, "--", url, dir)...)
+	return err
+}
+
+func (p *CliSourceProvider) Fetch(dir string) error {
+	_, err := p.git("fetch", dir, p.fetchArgs()...)
+	return err
+}
+
+func (p *CliSourceProvider) FetchRefs(dir string, refspecs []string) error {
+	_, err := p.git("fetch", dir, append(p.fetchArgs(), refspecs...)...)
+	return err
+}
+
+// fetchArgs - fetch with the same depth and submodule options as the clone
+func (p *CliSourceProvider) fetchArgs() []string {
+	args := []string{"fetch"}
+	if p.Options.Depth > 0 {
+		args = append(args, "--depth", strconv.Itoa(p.Options.Depth))
+	}
+	if p.Options.Submodules {
+		args = append(args, "--recurse-submodules=on-demand")
+	}
+	return append(args, "origin")
+}
+
+func (p *CliSourceProvider) ListRefs(dir string, prefix string) (map[string]string, error) {
+	refs := map[string]string{}
+	out, err := p.git("list-refs", dir, "for-each-ref", "--format=%(refname) %(objectname)", prefix)
+	if err != nil || out == "" {
+		return refs, err
+	}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			refs[fields[0]] = fields[1]
+		}
+	}
+	return refs, nil
+}
+
+func (p *CliSourceProvider) ResolveRef(dir string, ref string) (string, error) {
+	return p.git("resolve", dir, "rev-parse", "--verify", "--quiet", ref+"^{commit}")
+}
+
+func (p *CliSourceProvider) UpdateRef(dir string, ref string, sha string) error {
+	_, err := p.git("update-ref", dir, "update-ref", ref, sha)
+	return err
+}
+
+func (p *CliSourceProvider) Checkout(dir string, dest string, sha string) error {
+	if len(p.Options.Sparse) == 0 {
+		if _, err := p.git("checkout", dir, "worktree", "add", "--detach", dest, sha); err != nil {
+			return err
+		}
+	} else {
+		// populate the worktree only once the sparse patterns are set
+		if _, err := p.git("checkout", dir, "worktree", "add", "--no-checkout", "--detach", dest, sha); err != nil {
+			return err
+		}
+		patterns := append([]string{}, p.Options.Sparse...)
+		if p.Options.Submodules {
+			patterns = append(patterns, "/.gitmodules")
+		}
+		if _, err := p.git("sparse-checkout", dest, append([]string{"sparse-checkout", "set", "--no-cone"}, patterns...)...); err != nil {
+			return err
+		}
+		if _, err := p.git("checkout", dest, "read-tree", "-mu", "HEAD"); err != nil {
+			return err
+		}
+	}
+	return p.updateCheckout(dest)
+}
+
+// updateCheckout - submodules and lfs objects of a fresh checkout
+func (p *CliSourceProvider) updateCheckout(dest string) error {
+	if p.Options.Submodules {
+		args := []string{"submodule", "update", "--init", "--recursive"}
+		if p.Options.Depth > 0 {
+			args = append(args, "--depth", strconv.Itoa(p.Options.Depth))
+		}
+		if _, err := p.git("submodules", dest, args...); err != nil {
+			return err
+		}
+	}
+	if p.Options.Lfs {
+		if _, err := p.git("lfs", dest, "lfs", "pull"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *CliSourceProvider) RemoveCheckout(dir string, dest string) error {
+	if _, err := p.git("remove-checkout", dir, "worktree", "remove", "--force", dest); err != nil {
+		return err
+	}
+	_, err := p.git("remove-checkout", dir, "worktree", "prune")
+	return err
+}
+
+func (p *CliSourceProvider) Merge(dest string, sha string) error {
+	_, err := p.git("merge", dest, "-c", "user.name=cicd", "-c", "user.email=cicd@localhost", "merge", "--no-ff", "--no-edit", sha)
+	return err
+}
+
+func (p *CliSourceProvider) ChangedFiles(dir string, from string, to string) ([]string, error) {
+	out, err := p.git("diff", dir, "diff", "--name-only", from+"..."+to, "--")
+	if err != nil || out == "" {
+		return []string{}, err
+	}
+	return strings.Split(out, "\n"), nil
+}
+
+func (p *CliSourceProvider) Commit(dir string, sha string) (CommitDetail, error) {
+	var commit CommitDetail
+	out, err := p.git("commit", dir, "show", "-s", "--format="+commitFormat, sha, "--")
+	if err != nil {
+		return commit, err
+	}
+	return parseCommit(dir, out)
+}
+
+func (p *CliSourceProvider) Log(dir string, from string, to string) ([]CommitDetail, error) {
+	commits := []CommitDetail{}
+	rng := to
+	if from != "" {
+		rng = from + ".." + to
+	}
+	out, err := p.git("log", dir, "log", "--max-count="+strconv.Itoa(MAXCOMMITS), "--format="+commitFormat, rng, "--")
+	if err != nil || out == "" {
+		return commits, err
+	}
+	// one commit per line, %s is always a single line
+	for _, entry := range strings.Split(out, "\n") {
+		commit, err := parseCommit(dir, entry)
+		if err != nil {
+			return commits, err
+		}
+		commits = append(commits, commit)
+	}
+	return commits, nil
+}
+
+// commitFormat - the fields of CommitDetail separated by NUL
+const commitFormat = "%H%x00%an%x00%ae%x00%cn%x00%ce%x00%ct%x00%s"
+
+func parseCommit(dir string, out string) (CommitDetail, error) {
+	var commit CommitDetail
+	fields := strings.Split(strings.Trim(out, "\n"), "\x00")
+	if len(fields) != 7 {
+		return commit, &ScmError{Op: "commit", Dir: dir, Output: out, Err: errors.New("unexpected git output")}
+	}
+	ts, _ := strconv.ParseInt(fields[5], 10, 64)
+	commit = CommitDetail{
+		Hash:           fields[0],
+		Author:         fields[1],
+		AuthorEmail:    fields[2],
+		Committer:      fields[3],
+		CommitterEmail: fields[4],
+		Timestamp:      ts,
+		Subject:        fields[6],
+	}
+	return commit, nil
+}
+
+func (p *CliSourceProvider) Close() error {
+	if p.credDir == "" {
+		return nil
+	}
+	return os.RemoveAll(p.credDir)
+}
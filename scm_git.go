@@ -0,0 +1,303 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// GitSourceProvider - native provider using go-git, needs neither git nor bash in the image
+// Auth is used for the remote operations (clone, fetch and submodules) only
+// go-git has no lfs, lfs pulls (and merges) run the git binary with Env
+// and sparse checkouts only take directory patterns
+type GitSourceProvider struct {
+	Auth    transport.AuthMethod
+	Env     []string
+	Options CheckoutDetail
+	credDir string
+}
+
+func (p *GitSourceProvider) open(op string, dir string) (*git.Repository, error) {
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		return nil, &ScmError{Op: op, Dir: dir, Err: err}
+	}
+	return repo, nil
+}
+
+func (p *GitSourceProvider) Clone(url string, dir string) error {
+	opts := &git.CloneOptions{URL: url, Auth: p.Auth, Depth: p.Options.Depth}
+	if p.Options.Submodules {
+		opts.RecurseSubmodules = git.DefaultSubmoduleRecursionDepth
+	}
+	_, err := git.PlainClone(dir, false, opts)
+	if err != nil {
+		return &ScmError{Op: "clone", Dir: dir, Err: err}
+	}
+	return nil
+}
+
+func (p *GitSourceProvider) Fetch(dir string) error {
+	repo, err := p.open("fetch", dir)
+	if err != nil {
+		return err
+	}
+	err = repo.Fetch(&git.FetchOptions{RemoteName: "origin", Auth: p.Auth, Depth: p.Options.Depth})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return &ScmError{Op: "fetch", Dir: dir, Err: err}
+	}
+	return nil
+}
+
+func (p *GitSourceProvider) FetchRefs(dir string, refspecs []string) error {
+	repo, err := p.open("fetch", dir)
+	if err != nil {
+		return err
+	}
+	specs := []config.RefSpec{}
+	for _, r := range refspecs {
+		specs = append(specs, config.RefSpec(r))
+	}
+	err = repo.Fetch(&git.FetchOptions{RemoteName: "origin", RefSpecs: specs, Auth: p.Auth, Depth: p.Options.Depth})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return &ScmError{Op: "fetch", Dir: dir, Output: strings.Join(refspecs, " "), Err: err}
+	}
+	return nil
+}
+
+func (p *GitSourceProvider) ListRefs(dir string, prefix string) (map[string]string, error) {
+	refs := map[string]string{}
+	repo, err := p.open("list-refs", dir)
+	if err != nil {
+		return refs, err
+	}
+	iter, err := repo.References()
+	if err != nil {
+		return refs, &ScmError{Op: "list-refs", Dir: dir, Err: err}
+	}
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference && strings.HasPrefix(ref.Name().String(), prefix) {
+			refs[ref.Name().String()] = ref.Hash().String()
+		}
+		return nil
+	})
+	return refs, err
+}
+
+func (p *GitSourceProvider) ResolveRef(dir string, ref string) (string, error) {
+	repo, err := p.open("resolve", dir)
+	if err != nil {
+		return "", err
+	}
+	hash, err := repo.ResolveRevision(plumbing.Revision(ref))
+	if err != nil {
+		return "", &ScmError{Op: "resolve", Dir: dir, Output: ref, Err: err}
+	}
+	return hash.String(), nil
+}
+
+func (p *GitSourceProvider) UpdateRef(dir string, ref string, sha string) error {
+	repo, err := p.open("update-ref", dir)
+	if err != nil {
+		return err
+	}
+	err = repo.Storer.SetReference(plumbing.NewHashReference(plumbing.ReferenceName(ref), plumbing.NewHash(sha)))
+	if err != nil {
+		return &ScmError{Op: "update-ref", Dir: dir, Output: ref, Err: err}
+	}
+	return nil
+}
+
+// Checkout - go-git can't add worktrees, dest is laid out like git worktree add does it: its .git file points at
+// .git/worktrees/<name> of the clone, which only holds its HEAD and index and shares the objects, refs and config
+// (origin is the upstream url for submodules and lfs) of the clone
+func (p *GitSourceProvider) Checkout(dir string, dest string, sha string) error {
+	common, err := filepath.Abs(filepath.Join(dir, ".git"))
+	if err != nil {
+		return &ScmError{Op: "checkout", Dir: dir, Err: err}
+	}
+	if dest, err = filepath.Abs(dest); err != nil {
+		return &ScmError{Op: "checkout", Dir: dest, Err: err}
+	}
+	admin := filepath.Join(common, "worktrees", filepath.Base(dest))
+	os.MkdirAll(admin, os.ModePerm)
+	os.MkdirAll(dest, os.ModePerm)
+	files := map[string]string{
+		filepath.Join(admin, "commondir"): "../..\n",
+		filepath.Join(admin, "gitdir"):    filepath.Join(dest, ".git") + "\n",
+		filepath.Join(admin, "HEAD"):      sha + "\n",
+		filepath.Join(dest, ".git"):       "gitdir: " + admin + "\n",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			return &ScmError{Op: "checkout", Dir: dest, Err: err}
+		}
+	}
+	repo, err := git.PlainOpenWithOptions(dest, &git.PlainOpenOptions{EnableDotGitCommonDir: true})
+	if err != nil {
+		return &ScmError{Op: "checkout", Dir: dest, Err: err}
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		return &ScmError{Op: "checkout", Dir: dest, Err: err}
+	}
+	opts := &git.CheckoutOptions{Hash: plumbing.NewHash(sha), Force: true}
+	for _, pattern := range p.Options.Sparse {
+		opts.SparseCheckoutDirectories = append(opts.SparseCheckoutDirectories, strings.Trim(pattern, "/"))
+	}
+	if len(opts.SparseCheckoutDirectories) > 0 && p.Options.Submodules {
+		opts.SparseCheckoutDirectories = append(opts.SparseCheckoutDirectories, ".gitmodules")
+	}
+	if err = wt.Checkout(opts); err != nil {
+		return &ScmError{Op: "checkout", Dir: dest, Output: sha, Err: err}
+	}
+	if p.Options.Submodules {
+		subs, err := wt.Submodules()
+		if err != nil {
+			return &ScmError{Op: "submodules", Dir: dest, Err: err}
+		}
+		err = subs.Update(&git.SubmoduleUpdateOptions{Init: true, RecurseSubmodules: git.DefaultSubmoduleRecursionDepth, Auth: p.Auth, Depth: p.Options.Depth})
+		if err != nil {
+			return &ScmError{Op: "submodules", Dir: dest, Err: err}
+		}
+	}
+	if p.Options.Lfs {
+		return (&CliSourceProvider{Env: p.Env, Options: CheckoutDetail{Lfs: true}}).updateCheckout(dest)
+	}
+	return nil
+}
+
+func (p *GitSourceProvider) RemoveCheckout(dir string, dest string) error {
+	if err := os.RemoveAll(dest); err != nil {
+		return &ScmError{Op: "remove-checkout", Dir: dest, Err: err}
+	}
+	if err := os.RemoveAll(filepath.Join(dir, ".git", "worktrees", filepath.Base(dest))); err != nil {
+		return &ScmError{Op: "remove-checkout", Dir: dir, Err: err}
+	}
+	return nil
+}
+
+// Merge - go-git can only fast-forward, so merge results are built with the git binary
+func (p *GitSourceProvider) Merge(dest string, sha string) error {
+	return (&CliSourceProvider{Env: p.Env}).Merge(dest, sha)
+}
+
+// ChangedFiles - diffs to against its merge base with from, like git diff from...to
+func (p *GitSourceProvider) ChangedFiles(dir string, from string, to string) ([]string, error) {
+	files := []string{}
+	repo, err := p.open("diff", dir)
+	if err != nil {
+		return files, err
+	}
+	commits := make([]*object.Commit, 2)
+	for x, sha := range []string{from, to} {
+		if commits[x], err = repo.CommitObject(plumbing.NewHash(sha)); err != nil {
+			return files, &ScmError{Op: "diff", Dir: dir, Output: sha, Err: err}
+		}
+	}
+	// without a common history the whole tree of from is the base
+	base := commits[0]
+	if bases, err := commits[0].MergeBase(commits[1]); err != nil {
+		return files, &ScmError{Op: "diff", Dir: dir, Err: err}
+	} else if len(bases) > 0 {
+		base = bases[0]
+	}
+	trees := make([]*object.Tree, 2)
+	for x, c := range []*object.Commit{base, commits[1]} {
+		if trees[x], err = c.Tree(); err != nil {
+			return files, &ScmError{Op: "diff", Dir: dir, Output: c.Hash.String(), Err: err}
+		}
+	}
+	changes, err := object.DiffTree(trees[0], trees[1])
+	if err != nil {
+		return files, &ScmError{Op: "diff", Dir: dir, Err: err}
+	}
+	for _, c := range changes {
+		if c.To.Name != "" {
+			files = append(files, c.To.Name)
+		} else {
+			files = append(files, c.From.Name)
+		}
+	}
+	return files, nil
+}
+
+func (p *GitSourceProvider) Commit(dir string, sha string) (CommitDetail, error) {
+	var commit CommitDetail
+	repo, err := p.open("commit", dir)
+	if err != nil {
+		return commit, err
+	}
+	c, err := repo.CommitObject(plumbing.NewHash(sha))
+	if err != nil {
+		return commit, &ScmError{Op: "commit", Dir: dir, Output: sha, Err: err}
+	}
+	return toCommitDetail(c), nil
+}
+
+// Log - like git log from..to, the commits reachable from from are marked seen before the walk
+func (p *GitSourceProvider) Log(dir string, from string, to string) ([]CommitDetail, error) {
+	commits := []CommitDetail{}
+	repo, err := p.open("log", dir)
+	if err != nil {
+		return commits, err
+	}
+	head, err := repo.CommitObject(plumbing.NewHash(to))
+	if err != nil {
+		return commits, &ScmError{Op: "log", Dir: dir, Output: to, Err: err}
+	}
+	seen := map[plumbing.Hash]bool{}
+	if from != "" {
+		excluded, err := repo.Log(&git.LogOptions{From: plumbing.NewHash(from)})
+		if err != nil {
+			return commits, &ScmError{Op: "log", Dir: dir, Output: from, Err: err}
+		}
+		err = excluded.ForEach(func(c *object.Commit) error {
+			seen[c.Hash] = true
+			return nil
+		})
+		if err != nil {
+			return commits, &ScmError{Op: "log", Dir: dir, Output: from, Err: err}
+		}
+	}
+	iter := object.NewCommitPreorderIter(head, seen, nil)
+	defer iter.Close()
+	err = iter.ForEach(func(c *object.Commit) error {
+		if len(commits) == MAXCOMMITS {
+			return storer.ErrStop
+		}
+		commits = append(commits, toCommitDetail(c))
+		return nil
+	})
+	if err != nil {
+		return commits, &ScmError{Op: "log", Dir: dir, Err: err}
+	}
+	return commits, nil
+}
+
+func toCommitDetail(c *object.Commit) CommitDetail {
+	return CommitDetail{
+		Hash:           c.Hash.String(),
+		Author:         c.Author.Name,
+		AuthorEmail:    c.Author.Email,
+		Committer:      c.Committer.Name,
+		CommitterEmail: c.Committer.Email,
+		Timestamp:      c.Committer.When.Unix(),
+		Subject:        strings.SplitN(c.Message, "\n", 2)[0],
+	}
+}
+
+func (p *GitSourceProvider) Close() error {
+	if p.credDir == "" {
+		return nil
+	}
+	return os.RemoveAll(p.credDir)
+}
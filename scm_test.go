@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// commitFile - writes the file in the upstream work tree and commits it
+func commitFile(t *testing.T, repo *git.Repository, dir string, name string, msg string) string {
+	ioutil.WriteFile(filepath.Join(dir, name), []byte(msg), 0644)
+	wt, _ := repo.Worktree()
+	wt.Add(name)
+	sig := &object.Signature{Name: "lmz", Email: "lmz@example.com", When: time.Now()}
+	hash, err := wt.Commit(msg, &git.CommitOptions{Author: sig, Committer: sig})
+	if err != nil {
+		t.Fatalf("commit %s %v", name, err)
+	}
+	return hash.String()
+}
+
+func TestSourceProviders(t *testing.T) {
+
+	// create anonymous struct
+	tests := []struct {
+		Name     string
+		Provider SourceProvider
+		ErrorMsg string
+	}{
+		{
+			"Test scm : native go-git provider",
+			&GitSourceProvider{},
+			"Provider %s %s - got (%v) wanted (%v)",
+		},
+		{
+			"Test scm : git cli provider",
+			&CliSourceProvider{},
+			"Provider %s %s - got (%v) wanted (%v)",
+		},
+	}
+
+	for _, tt := range tests {
+		fmt.Println(fmt.Sprintf("\nExecuting test : %s", tt.Name))
+		if _, ok := tt.Provider.(*CliSourceProvider); ok {
+			if _, err := exec.LookPath("git"); err != nil {
+				t.Logf("git binary not found, skipping %s", tt.Name)
+				continue
+			}
+		}
+		tmp, _ := ioutil.TempDir("", "scm")
+		defer os.RemoveAll(tmp)
+
+		// upstream work tree and the bare repository the provider clones from
+		upstreamDir := filepath.Join(tmp, "upstream")
+		bareDir := filepath.Join(tmp, "bare.git")
+		cloneDir := filepath.Join(tmp, "clone")
+		upstream, _ := git.PlainInit(upstreamDir, false)
+		first := commitFile(t, upstream, upstreamDir, "a.txt", "first")
+		bare, err := git.PlainClone(bareDir, true, &git.CloneOptions{URL: upstreamDir})
+		if err != nil {
+			t.Fatalf("bare clone %v", err)
+		}
+
+		if err := tt.Provider.Clone(bareDir, cloneDir); err != nil {
+			t.Fatalf(tt.ErrorMsg, tt.Name, "Clone", err, nil)
+		}
+		if sha, err := tt.Provider.ResolveRef(cloneDir, "origin/master"); sha != first {
+			t.Errorf(tt.ErrorMsg, tt.Name, "ResolveRef", sha+" "+fmt.Sprint(err), first)
+		}
+
+		// new commit lands in the bare repository
+		second := commitFile(t, upstream, upstreamDir, "b.txt", "second")
+		bare.Fetch(&git.FetchOptions{RefSpecs: []config.RefSpec{"+refs/heads/*:refs/heads/*"}})
+
+		if err := tt.Provider.Fetch(cloneDir); err != nil {
+			t.Errorf(tt.ErrorMsg, tt.Name, "Fetch", err, nil)
+		}
+		if sha, err := tt.Provider.ResolveRef(cloneDir, "origin/master"); sha != second {
+			t.Errorf(tt.ErrorMsg, tt.Name, "ResolveRef", sha+" "+fmt.Sprint(err), second)
+		}
+		if files, _ := tt.Provider.ChangedFiles(cloneDir, first, second); !reflect.DeepEqual(files, []string{"b.txt"}) {
+			t.Errorf(tt.ErrorMsg, tt.Name, "ChangedFiles", files, []string{"b.txt"})
+		}
+		if commit, _ := tt.Provider.Commit(cloneDir, second); commit.Subject != "second" || commit.Author != "lmz" || commit.Hash != second {
+			t.Errorf(tt.ErrorMsg, tt.Name, "Commit", commit, "subject second by lmz")
+		}
+		if commits, _ := tt.Provider.Log(cloneDir, first, second); len(commits) != 1 || commits[0].Hash != second {
+			t.Errorf(tt.ErrorMsg, tt.Name, "Log", commits, "[second]")
+		}
+		if commits, _ := tt.Provider.Log(cloneDir, "", second); len(commits) != 2 || commits[1].Subject != "first" {
+			t.Errorf(tt.ErrorMsg, tt.Name, "Log", commits, "[second first]")
+		}
+		// a branch of the first commit, its changes and commits are its own and not master's
+		wt, _ := upstream.Worktree()
+		wt.Checkout(&git.CheckoutOptions{Branch: "refs/heads/feature", Hash: plumbing.NewHash(first), Create: true})
+		feature := commitFile(t, upstream, upstreamDir, "c.txt", "feature")
+		wt.Checkout(&git.CheckoutOptions{Branch: "refs/heads/master"})
+		bare.Fetch(&git.FetchOptions{RefSpecs: []config.RefSpec{"+refs/heads/*:refs/heads/*"}})
+		tt.Provider.Fetch(cloneDir)
+		if files, err := tt.Provider.ChangedFiles(cloneDir, second, feature); !reflect.DeepEqual(files, []string{"c.txt"}) {
+			t.Errorf(tt.ErrorMsg, tt.Name, "ChangedFiles merge base", fmt.Sprint(files, err), []string{"c.txt"})
+		}
+		if commits, err := tt.Provider.Log(cloneDir, second, feature); len(commits) != 1 || commits[0].Hash != feature {
+			t.Errorf(tt.ErrorMsg, tt.Name, "Log merge base", fmt.Sprint(commits, err), "[feature]")
+		}
+		if refs, _ := tt.Provider.ListRefs(cloneDir, "refs/remotes/origin/"); refs["refs/remotes/origin/master"] != second {
+			t.Errorf(tt.ErrorMsg, tt.Name, "ListRefs", refs, second)
+		}
+		if _, err := tt.Provider.ResolveRef(cloneDir, BUILTREF); err == nil {
+			t.Errorf(tt.ErrorMsg, tt.Name, "ResolveRef", nil, "error")
+		}
+		tt.Provider.UpdateRef(cloneDir, BUILTREF, first)
+		if sha, _ := tt.Provider.ResolveRef(cloneDir, BUILTREF); sha != first {
+			t.Errorf(tt.ErrorMsg, tt.Name, "UpdateRef", sha, first)
+		}
+
+		// clean checkout of the first commit, b.txt must not be there
+		dest := filepath.Join(tmp, "workspaces", "run")
+		os.MkdirAll(filepath.Dir(dest), os.ModePerm)
+		if err := tt.Provider.Checkout(cloneDir, dest, first); err != nil {
+			t.Fatalf(tt.ErrorMsg, tt.Name, "Checkout", err, nil)
+		}
+		if _, err := os.Stat(filepath.Join(dest, "a.txt")); err != nil {
+			t.Errorf(tt.ErrorMsg, tt.Name, "Checkout a.txt", err, nil)
+		}
+		if _, err := os.Stat(filepath.Join(dest, "b.txt")); !os.IsNotExist(err) {
+			t.Errorf(tt.ErrorMsg, tt.Name, "Checkout b.txt", err, "not exist")
+		}
+		// merge result of the second commit on top of the first
+		if err := tt.Provider.Merge(dest, second); err != nil {
+			t.Errorf(tt.ErrorMsg, tt.Name, "Merge", err, nil)
+		}
+		if _, err := os.Stat(filepath.Join(dest, "b.txt")); err != nil {
+			t.Errorf(tt.ErrorMsg, tt.Name, "Merge b.txt", err, nil)
+		}
+		if err := tt.Provider.RemoveCheckout(cloneDir, dest); err != nil {
+			t.Errorf(tt.ErrorMsg, tt.Name, "RemoveCheckout", err, nil)
+		}
+		if _, err := os.Stat(dest); !os.IsNotExist(err) {
+			t.Errorf(tt.ErrorMsg, tt.Name, "RemoveCheckout", err, "not exist")
+		}
+
+		// errors are structured
+		_, err = tt.Provider.ResolveRef(filepath.Join(tmp, "missing"), "HEAD")
+		if _, ok := err.(*ScmError); !ok {
+			t.Errorf(tt.ErrorMsg, tt.Name, "ScmError", err, "*ScmError")
+		}
+		fmt.Println("")
+	}
+}
+
+// gitRun - runs git for the test fixtures
+func gitRun(t *testing.T, dir string, args ...string) {
+	cmd := exec.Command("git", append([]string{"-c", "protocol.file.allow=always", "-c", "user.name=lmz", "-c", "user.email=lmz@example.com"}, args...)...)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git %v %v %s", args, err, out)
+	}
+}
+
+func TestCheckoutOptions(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git binary not found")
+	}
+	// local submodules need the file protocol
+	env := []string{"GIT_CONFIG_COUNT=1", "GIT_CONFIG_KEY_0=protocol.file.allow", "GIT_CONFIG_VALUE_0=always"}
+
+	tmp, _ := ioutil.TempDir("", "scm")
+	defer os.RemoveAll(tmp)
+
+	// upstream with a library submodule and two services
+	libDir := filepath.Join(tmp, "lib")
+	upstreamDir := filepath.Join(tmp, "upstream")
+	os.MkdirAll(libDir, os.ModePerm)
+	os.MkdirAll(filepath.Join(upstreamDir, "api"), os.ModePerm)
+	os.MkdirAll(filepath.Join(upstreamDir, "web"), os.ModePerm)
+	gitRun(t, libDir, "init", "-q")
+	ioutil.WriteFile(filepath.Join(libDir, "lib.go"), []byte("lib"), 0644)
+	gitRun(t, libDir, "add", ".")
+	gitRun(t, libDir, "commit", "-q", "-m", "lib")
+	gitRun(t, upstreamDir, "init", "-q", "-b", "master")
+	ioutil.WriteFile(filepath.Join(upstreamDir, "api", "main.go"), []byte("api"), 0644)
+	ioutil.WriteFile(filepath.Join(upstreamDir, "web", "index.html"), []byte("web"), 0644)
+	gitRun(t, upstreamDir, "submodule", "add", "-q", libDir, "lib")
+	gitRun(t, upstreamDir, "add", ".")
+	gitRun(t, upstreamDir, "commit", "-q", "-m", "first")
+	ioutil.WriteFile(filepath.Join(upstreamDir, "api", "main.go"), []byte("api v2"), 0644)
+	gitRun(t, upstreamDir, "commit", "-q", "-a", "-m", "second")
+
+	// create anonymous struct
+	tests := []struct {
+		Name     string
+		Provider SourceProvider
+		ErrorMsg string
+	}{
+		{
+			"Test checkout options : native go-git provider",
+			&GitSourceProvider{Env: env, Options: CheckoutDetail{Submodules: true, Depth: 1, Sparse: []string{"api", "lib"}}},
+			"Provider %s %s - got (%v) wanted (%v)",
+		},
+		{
+			"Test checkout options : git cli provider",
+			&CliSourceProvider{Env: env, Options: CheckoutDetail{Submodules: true, Depth: 1, Sparse: []string{"/api/", "/lib/"}}},
+			"Provider %s %s - got (%v) wanted (%v)",
+		},
+	}
+
+	for x, tt := range tests {
+		fmt.Println(fmt.Sprintf("\nExecuting test : %s", tt.Name))
+		cloneDir := filepath.Join(tmp, fmt.Sprintf("clone%d", x))
+		if err := tt.Provider.Clone("file://"+upstreamDir, cloneDir); err != nil {
+			t.Fatalf(tt.ErrorMsg, tt.Name, "Clone", err, nil)
+		}
+		if err := tt.Provider.Fetch(cloneDir); err != nil {
+			t.Errorf(tt.ErrorMsg, tt.Name, "Fetch", err, nil)
+		}
+		sha, _ := tt.Provider.ResolveRef(cloneDir, "origin/master")
+		// shallow, the first commit was not fetched
+		if commits, _ := tt.Provider.Log(cloneDir, "", sha); len(commits) != 1 {
+			t.Errorf(tt.ErrorMsg, tt.Name, "Depth", len(commits), 1)
+		}
+
+		dest := filepath.Join(tmp, fmt.Sprintf("run%d", x))
+		if err := tt.Provider.Checkout(cloneDir, dest, sha); err != nil {
+			t.Fatalf(tt.ErrorMsg, tt.Name, "Checkout", err, nil)
+		}
+		if b, err := ioutil.ReadFile(filepath.Join(dest, "api", "main.go")); string(b) != "api v2" {
+			t.Errorf(tt.ErrorMsg, tt.Name, "Checkout api", err, "api v2")
+		}
+		if _, err := os.Stat(filepath.Join(dest, "web", "index.html")); !os.IsNotExist(err) {
+			t.Errorf(tt.ErrorMsg, tt.Name, "Sparse web", err, "not exist")
+		}
+		if b, err := ioutil.ReadFile(filepath.Join(dest, "lib", "lib.go")); string(b) != "lib" {
+			t.Errorf(tt.ErrorMsg, tt.Name, "Submodule lib", err, "lib")
+		}
+		fmt.Println("")
+	}
+}
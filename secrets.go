@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+var (
+	secretStore = &SecretStore{}
+)
+
+// SecretStore - credentials encrypted at rest with AES-256-GCM
+// the file is SECRETS_FILE (default secrets.enc), the key is derived from the SECRETS_KEY envar with scrypt
+// and the random salt written in the file header
+type SecretStore struct {
+	mu sync.Mutex
+	// the last derived key, scrypt is slow on purpose
+	secret string
+	salt   []byte
+	key    []byte
+}
+
+// secretsHeader - starts the files with a salt, older files are the nonce and ciphertext only
+// with the key as the sha256 of SECRETS_KEY, they are rewritten with a salt on the next change
+const secretsHeader = "cicd-secrets-v2\n"
+
+const secretsSaltSize = 16
+
+func (s *SecretStore) file() string {
+	if os.Getenv("SECRETS_FILE") != "" {
+		return os.Getenv("SECRETS_FILE")
+	}
+	return "secrets.enc"
+}
+
+// gcm - the cipher for the salt, a nil salt is the unsalted sha256 key of the older files
+func (s *SecretStore) gcm(salt []byte) (cipher.AEAD, error) {
+	secret := os.Getenv("SECRETS_KEY")
+	if secret == "" {
+		return nil, errors.New("SECRETS_KEY envar is mandatory to use the secret store")
+	}
+	var key []byte
+	if salt == nil {
+		sum := sha256.Sum256([]byte(secret))
+		key = sum[:]
+	} else if s.key != nil && s.secret == secret && bytes.Equal(s.salt, salt) {
+		key = s.key
+	} else {
+		var err error
+		if key, err = scrypt.Key([]byte(secret), salt, 1<<15, 8, 1, 32); err != nil {
+			return nil, err
+		}
+		s.secret, s.salt, s.key = secret, salt, key
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (s *SecretStore) load() (map[string]CredentialDetail, error) {
+	creds := map[string]CredentialDetail{}
+	if os.Getenv("SECRETS_KEY") == "" {
+		return creds, errors.New("SECRETS_KEY envar is mandatory to use the secret store")
+	}
+	data, err := ioutil.ReadFile(s.file())
+	if os.IsNotExist(err) {
+		return creds, nil
+	}
+	if err != nil {
+		return creds, err
+	}
+	var salt []byte
+	if bytes.HasPrefix(data, []byte(secretsHeader)) {
+		data = data[len(secretsHeader):]
+		if len(data) < secretsSaltSize {
+			return creds, errors.New("secret store is corrupt")
+		}
+		salt, data = data[:secretsSaltSize], data[secretsSaltSize:]
+	}
+	gcm, err := s.gcm(salt)
+	if err != nil {
+		return creds, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return creds, errors.New("secret store is corrupt")
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return creds, errors.New("secret store can not be decrypted (wrong SECRETS_KEY ?)")
+	}
+	err = json.Unmarshal(plain, &creds)
+	return creds, err
+}
+
+// save - always with a new salt and nonce
+func (s *SecretStore) save(creds map[string]CredentialDetail) error {
+	salt := make([]byte, secretsSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return err
+	}
+	gcm, err := s.gcm(salt)
+	if err != nil {
+		return err
+	}
+	plain, _ := json.Marshal(creds)
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	data := append([]byte(secretsHeader), salt...)
+	return ioutil.WriteFile(s.file(), gcm.Seal(append(data, nonce...), nonce, plain, nil), 0600)
+}
+
+// Get - the decrypted credential
+func (s *SecretStore) Get(name string) (CredentialDetail, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	creds, err := s.load()
+	if err != nil {
+		return CredentialDetail{}, err
+	}
+	cred, ok := creds[name]
+	if !ok {
+		return cred, errors.New("credential " + name + " not found")
+	}
+	return cred, nil
+}
+
+// Put - adds or replaces the credential
+func (s *SecretStore) Put(name string, cred CredentialDetail) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	creds, err := s.load()
+	if err != nil {
+		return err
+	}
+	creds[name] = cred
+	return s.save(creds)
+}
+
+func (s *SecretStore) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	creds, err := s.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := creds[name]; !ok {
+		return errors.New("credential " + name + " not found")
+	}
+	delete(creds, name)
+	return s.save(creds)
+}
+
+// List - only the names (and types), values never leave the store through the api
+func (s *SecretStore) List() ([]CredentialDetail, error) {
+	var list []CredentialDetail
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	creds, err := s.load()
+	if err != nil {
+		return list, err
+	}
+	for name, cred := range creds {
+		list = append(list, CredentialDetail{Name: name, Type: cred.Type})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
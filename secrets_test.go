@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestSecretStore(t *testing.T) {
+	tmp, _ := ioutil.TempDir("", "secrets")
+	defer os.RemoveAll(tmp)
+	file := filepath.Join(tmp, "secrets.enc")
+	os.Setenv("SECRETS_FILE", file)
+	defer os.Unsetenv("SECRETS_FILE")
+	os.Setenv("SECRETS_KEY", "k3y")
+	defer os.Unsetenv("SECRETS_KEY")
+	store := &SecretStore{}
+
+	// round trip, the file never holds the values in clear
+	deploy := CredentialDetail{Type: "https", Username: "bot", Token: "ghp_s3cret"}
+	if err := store.Put("github-deploy", deploy); err != nil {
+		t.Fatalf("Secret store put - got (%v) wanted (nil)", err)
+	}
+	store.Put("webhook", CredentialDetail{Type: "token", Token: "hook-s3cret"})
+	if got, err := store.Get("github-deploy"); err != nil || got != deploy {
+		t.Errorf("Secret store get - got (%v %v) wanted (%v)", got, err, deploy)
+	}
+	if b, _ := ioutil.ReadFile(file); bytes.Contains(b, []byte("ghp_s3cret")) || bytes.Contains(b, []byte("github-deploy")) {
+		t.Errorf("Secret store file - got (%q) wanted (encrypted)", b)
+	}
+	if info, _ := os.Stat(file); info.Mode().Perm() != 0600 {
+		t.Errorf("Secret store file mode - got (%v) wanted (%v)", info.Mode().Perm(), os.FileMode(0600))
+	}
+
+	// create anonymous struct
+	tests := []struct {
+		Name     string
+		Key      string
+		Secret   string
+		Err      string
+		ErrorMsg string
+	}{
+		{"Test secret store : right key", "k3y", "github-deploy", "", "Secret store %s - got (%v) wanted (%v)"},
+		{"Test secret store : unknown credential", "k3y", "nope", "credential nope not found", "Secret store %s - got (%v) wanted (%v)"},
+		{"Test secret store : wrong key", "other", "github-deploy", "secret store can not be decrypted (wrong SECRETS_KEY ?)", "Secret store %s - got (%v) wanted (%v)"},
+		{"Test secret store : no key", "", "github-deploy", "SECRETS_KEY envar is mandatory to use the secret store", "Secret store %s - got (%v) wanted (%v)"},
+	}
+
+	for _, tt := range tests {
+		fmt.Println(fmt.Sprintf("\nExecuting test : %s", tt.Name))
+		os.Setenv("SECRETS_KEY", tt.Key)
+		_, err := store.Get(tt.Secret)
+		if (tt.Err == "" && err != nil) || (tt.Err != "" && (err == nil || err.Error() != tt.Err)) {
+			t.Errorf(tt.ErrorMsg, tt.Name, err, tt.Err)
+		}
+		fmt.Println("")
+	}
+	// a wrong key never overwrites the store
+	os.Setenv("SECRETS_KEY", "other")
+	if err := store.Put("other", deploy); err == nil {
+		t.Errorf("Secret store put with a wrong key - got (%v) wanted (an error)", err)
+	}
+	os.Setenv("SECRETS_KEY", "k3y")
+	if err := store.Delete("webhook"); err != nil {
+		t.Errorf("Secret store delete - got (%v) wanted (nil)", err)
+	}
+	if list, err := store.List(); err != nil || len(list) != 1 || list[0] != (CredentialDetail{Name: "github-deploy", Type: "https"}) {
+		t.Errorf("Secret store list - got (%v %v) wanted (%v)", list, err, "github-deploy only")
+	}
+}
+
+func TestSecretStoreKey(t *testing.T) {
+	tmp, _ := ioutil.TempDir("", "secrets")
+	defer os.RemoveAll(tmp)
+	file := filepath.Join(tmp, "secrets.enc")
+	os.Setenv("SECRETS_FILE", file)
+	defer os.Unsetenv("SECRETS_FILE")
+	os.Setenv("SECRETS_KEY", "k3y")
+	defer os.Unsetenv("SECRETS_KEY")
+	deploy := CredentialDetail{Type: "https", Username: "bot", Token: "ghp_s3cret"}
+
+	// a file written before the salt, the key was the sha256 of SECRETS_KEY
+	legacy := func() []byte {
+		key := sha256.Sum256([]byte("k3y"))
+		block, _ := aes.NewCipher(key[:])
+		gcm, _ := cipher.NewGCM(block)
+		plain, _ := json.Marshal(map[string]CredentialDetail{"github-deploy": deploy})
+		nonce := make([]byte, gcm.NonceSize())
+		rand.Read(nonce)
+		return gcm.Seal(nonce, nonce, plain, nil)
+	}
+	salt := func() string {
+		b, _ := ioutil.ReadFile(file)
+		if !bytes.HasPrefix(b, []byte(secretsHeader)) || len(b) < len(secretsHeader)+secretsSaltSize {
+			return ""
+		}
+		return string(b[len(secretsHeader) : len(secretsHeader)+secretsSaltSize])
+	}
+
+	// create anonymous struct
+	tests := []struct {
+		Name     string
+		Legacy   bool
+		Put      bool
+		Salted   bool
+		ErrorMsg string
+	}{
+		{"Test secret key : older file is read", true, false, false, "Secret key %s - got (%v) wanted (%v)"},
+		{"Test secret key : older file is salted on change", true, true, true, "Secret key %s - got (%v) wanted (%v)"},
+		{"Test secret key : salted file", false, true, true, "Secret key %s - got (%v) wanted (%v)"},
+	}
+
+	previous := ""
+	for _, tt := range tests {
+		fmt.Println(fmt.Sprintf("\nExecuting test : %s", tt.Name))
+		if tt.Legacy {
+			ioutil.WriteFile(file, legacy(), 0600)
+		}
+		store := &SecretStore{}
+		if tt.Put {
+			store.Put("webhook", CredentialDetail{Type: "token", Token: "hook-s3cret"})
+		}
+		if got, err := (&SecretStore{}).Get("github-deploy"); err != nil || got != deploy {
+			t.Errorf(tt.ErrorMsg, tt.Name, fmt.Sprint(got, err), deploy)
+		}
+		// every save draws a new salt
+		if got := salt(); (got != "") != tt.Salted || (got != "" && got == previous) {
+			t.Errorf(tt.ErrorMsg, tt.Name, []byte(got), "a new salt")
+		} else {
+			previous = got
+		}
+		fmt.Println("")
+	}
+}
+
+func TestCredentialsHandlers(t *testing.T) {
+	tmp, _ := ioutil.TempDir("", "credentials")
+	defer os.RemoveAll(tmp)
+	cwd, _ := os.Getwd()
+	os.Chdir(tmp)
+	defer os.Chdir(cwd)
+	ioutil.WriteFile("project.json", []byte(`{"roles":[{"role":"admin","users":["root"]},{"role":"developer","users":["bob"]}],"repositories":[]}`), 0644)
+	os.Setenv("SECRETS_KEY", "k3y")
+	defer os.Unsetenv("SECRETS_KEY")
+	defer func(a *AuditLog) { auditLog = a }(auditLog)
+	auditLog = &AuditLog{file: filepath.Join(tmp, "audit.log")}
+	logger := NewLogger("error", "text", ioutil.Discard)
+	root := &Principal{Name: "root", Method: "token"}
+	bob := &Principal{Name: "bob", Method: "token"}
+
+	call := func(p *Principal, method string, name string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/api/v1/credentials/"+name, strings.NewReader(body))
+		r = r.WithContext(context.WithValue(r.Context(), principalKey{}, p))
+		w := httptest.NewRecorder()
+		if name == "" {
+			CredentialsHandler(w, r, logger)
+		} else {
+			UpdateCredentialHandler(w, mux.SetURLVars(r, map[string]string{"name": name}), logger)
+		}
+		return w
+	}
+
+	// create anonymous struct
+	tests := []struct {
+		Name      string
+		Principal *Principal
+		Method    string
+		Cred      string
+		Body      string
+		Code      int
+		ErrorMsg  string
+	}{
+		{"Test credentials : put https", root, http.MethodPut, "github-deploy", `{"type":"https","username":"bot","token":"ghp_s3cret"}`, http.StatusOK, "Credentials %s - got (%v) wanted (%v)"},
+		{"Test credentials : put ssh", root, http.MethodPut, "gitlab", `{"type":"ssh","privatekey":"-----BEGIN KEY-----","knownhosts":"gitlab.com ssh-ed25519 AAAA"}`, http.StatusOK, "Credentials %s - got (%v) wanted (%v)"},
+		{"Test credentials : ssh without knownhosts", root, http.MethodPut, "gitea", `{"type":"ssh","privatekey":"-----BEGIN KEY-----"}`, http.StatusBadRequest, "Credentials %s - got (%v) wanted (%v)"},
+		{"Test credentials : unknown type", root, http.MethodPut, "gitea", `{"type":"vault"}`, http.StatusBadRequest, "Credentials %s - got (%v) wanted (%v)"},
+		{"Test credentials : developer can't put", bob, http.MethodPut, "mine", `{"type":"token","token":"t"}`, http.StatusForbidden, "Credentials %s - got (%v) wanted (%v)"},
+		{"Test credentials : developer can't list", bob, http.MethodGet, "", "", http.StatusForbidden, "Credentials %s - got (%v) wanted (%v)"},
+		{"Test credentials : delete unknown", root, http.MethodDelete, "nope", "", http.StatusBadRequest, "Credentials %s - got (%v) wanted (%v)"},
+	}
+
+	for _, tt := range tests {
+		fmt.Println(fmt.Sprintf("\nExecuting test : %s", tt.Name))
+		if w := call(tt.Principal, tt.Method, tt.Cred, tt.Body); w.Code != tt.Code {
+			t.Errorf(tt.ErrorMsg, tt.Name, w.Code, tt.Code)
+		}
+		fmt.Println("")
+	}
+
+	// the listing only has the names and types, the values stay in the store
+	w := call(root, http.MethodGet, "", "")
+	var response Response
+	json.Unmarshal(w.Body.Bytes(), &response)
+	want := []CredentialDetail{{Name: "github-deploy", Type: "https"}, {Name: "gitlab", Type: "ssh"}}
+	if w.Code != http.StatusOK || fmt.Sprint(response.Credentials) != fmt.Sprint(want) {
+		t.Errorf("Credentials list - got (%v %v) wanted (%v)", w.Code, response.Credentials, want)
+	}
+	for _, secret := range []string{"ghp_s3cret", "bot", "BEGIN KEY", "ssh-ed25519"} {
+		if strings.Contains(w.Body.String(), secret) {
+			t.Errorf("Credentials list - got (%s) wanted (%s redacted)", w.Body.String(), secret)
+		}
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(tmp, "audit.log")); bytes.Contains(b, []byte("ghp_s3cret")) || !bytes.Contains(b, []byte("credential.put")) {
+		t.Errorf("Credentials audit - got (%s) wanted (the put without its values)", b)
+	}
+}
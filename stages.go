@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StageContext - what a stage type gets to run a stage, Spec is the stage's command (workspace, env and
+// output file) and Out the stage log
+type StageContext struct {
+	Run    *Run
+	Stage  StageDetail
+	Spec   ExecSpec
+	Out    io.Writer
+	Logger *Logger
+}
+
+// StageExecutor - a stage type, Validate checks the stage and its `with` inputs before the run starts, Execute
+// returns the stage result like an Executor (stdout on success, stderr on failure)
+type StageExecutor interface {
+	Validate(stage StageDetail) error
+	Execute(ctx context.Context, sc StageContext) (string, error)
+}
+
+// GateStage - a stage type that runs without a workspace (no env, artifacts or cache), a failure is recorded
+// with its FailStatus rather than error
+type GateStage interface {
+	StageExecutor
+	FailStatus() string
+}
+
+// InputDetail - a `with` input of a stage type, Type is one of string, int, bool, list or map
+type InputDetail struct {
+	Name     string
+	Type     string
+	Required bool
+}
+
+// PluginRequest - the json line an out of process stage type reads on stdin, Method is validate or run
+type PluginRequest struct {
+	Method string                 `json:"method"`
+	Type   string                 `json:"type"`
+	Stage  StageDetail            `json:"stage"`
+	With   map[string]interface{} `json:"with,omitempty"`
+	Run    string                 `json:"run,omitempty"`
+	Dir    string                 `json:"dir,omitempty"`
+}
+
+// PluginMessage - a json line written by the plugin on stdout, log lines and outputs as it runs and
+// finally done (Error is empty on success)
+type PluginMessage struct {
+	Log     string            `json:"log,omitempty"`
+	Outputs map[string]string `json:"outputs,omitempty"`
+	Done    bool              `json:"done,omitempty"`
+	Error   string            `json:"error,omitempty"`
+}
+
+type shellStage struct{}
+type containerStage struct{}
+type approvalStage struct{}
+type callbackStage struct{}
+type deployStage struct{}
+type httpStage struct{}
+
+// pluginStage - a cicd-stage-<type> executable in STAGE_PLUGINS speaking json over stdio
+type pluginStage struct {
+	name string
+	path string
+}
+
+// stageTypes - the built in stage types, others are looked up as plugins
+var stageTypes = map[string]StageExecutor{
+	"shell":     shellStage{},
+	"container": containerStage{},
+	"approval":  approvalStage{},
+	"callback":  callbackStage{},
+	"deploy":    deployStage{},
+	"http":      httpStage{},
+}
+
+var typePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// registerStageType - adds (or replaces) a built in stage type
+func registerStageType(name string, e StageExecutor) {
+	stageTypes[name] = e
+}
+
+// pluginDir - STAGE_PLUGINS, default plugins
+func pluginDir() string {
+	if os.Getenv("STAGE_PLUGINS") != "" {
+		return os.Getenv("STAGE_PLUGINS")
+	}
+	return "plugins"
+}
+
+// stageExecutor - the stage type, shell when none is set
+func stageExecutor(name string) (StageExecutor, error) {
+	if name == "" {
+		name = "shell"
+	}
+	if e, ok := stageTypes[name]; ok {
+		return e, nil
+	}
+	if !typePattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid stage type %s", name)
+	}
+	path, _ := filepath.Abs(filepath.Join(pluginDir(), "cicd-stage-"+name))
+	if info, err := os.Stat(path); err != nil || info.IsDir() {
+		return nil, fmt.Errorf("unknown stage type %s", name)
+	}
+	return &pluginStage{name: name, path: path}, nil
+}
+
+// validateStages - every stage has a known type that accepts its inputs
+func validateStages(stages []StageDetail) error {
+	for _, stage := range stages {
+		if stage.Service != "" || stage.Replicas != 0 {
+			return fmt.Errorf("stage %s : service and replicas are no longer stage fields, use \"type\": \"deploy\" with them in \"with\"", stage.Name)
+		}
+		e, err := stageExecutor(stage.Type)
+		if err == nil {
+			err = e.Validate(stage)
+		}
+		if err != nil {
+			return fmt.Errorf("stage %s : %v", stage.Name, err)
+		}
+	}
+	return nil
+}
+
+// validateInputs - no unknown inputs, the required ones are set and all have their type
+func validateInputs(inputs []InputDetail, with map[string]interface{}) error {
+	types := map[string]string{}
+	for _, in := range inputs {
+		types[in.Name] = in.Type
+		if _, ok := with[in.Name]; in.Required && !ok {
+			return fmt.Errorf("input %s is required", in.Name)
+		}
+	}
+	names := make([]string, 0, len(with))
+	for name := range with {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		t, ok := types[name]
+		if !ok {
+			return fmt.Errorf("unknown input %s", name)
+		}
+		valid := false
+		switch v := with[name].(type) {
+		case string:
+			valid = t == "string"
+		case float64:
+			valid = t == "int" && v == math.Trunc(v)
+		case bool:
+			valid = t == "bool"
+		case []interface{}:
+			valid = t == "list"
+		case map[string]interface{}:
+			valid = t == "map"
+		}
+		if !valid {
+			return fmt.Errorf("input %s must be of type %s", name, t)
+		}
+	}
+	return nil
+}
+
+// interpolateWith - the ${{ }} variables in the string inputs (also inside lists and maps)
+func interpolateWith(with map[string]interface{}, vars map[string]string) map[string]interface{} {
+	if with == nil {
+		return nil
+	}
+	var walk func(v interface{}) interface{}
+	walk = func(v interface{}) interface{} {
+		switch t := v.(type) {
+		case string:
+			return interpolate(t, vars)
+		case []interface{}:
+			list := make([]interface{}, len(t))
+			for i := range t {
+				list[i] = walk(t[i])
+			}
+			return list
+		case map[string]interface{}:
+			m := make(map[string]interface{}, len(t))
+			for k := range t {
+				m[k] = walk(t[k])
+			}
+			return m
+		}
+		return v
+	}
+	return walk(with).(map[string]interface{})
+}
+
+// inputString - a string input, def when it is not set
+func inputString(with map[string]interface{}, name string, def string) string {
+	if v, ok := with[name].(string); ok {
+		return v
+	}
+	return def
+}
+
+// inputInt - an int input, def when it is not set
+func inputInt(with map[string]interface{}, name string, def int) int {
+	if v, ok := with[name].(float64); ok {
+		return int(v)
+	}
+	return def
+}
+
+// Validate - the commands need an exec and take no inputs
+func (shellStage) Validate(stage StageDetail) error {
+	if stage.Exec == "" {
+		return errors.New("exec is required")
+	}
+	return validateInputs(nil, stage.With)
+}
+
+// Execute - runs the commands on the host, in a container (image) or on an agent (runsOn)
+func (shellStage) Execute(ctx context.Context, sc StageContext) (string, error) {
+	return executorFor(sc.Run, sc.Stage, sc.Logger).Execute(ctx, sc.Spec, sc.Out)
+}
+
+// Validate - the image is the stage's image or the image input
+func (containerStage) Validate(stage StageDetail) error {
+	if stage.Image == "" && inputString(stage.With, "image", "") == "" {
+		return errors.New("image is required")
+	}
+	return validateInputs([]InputDetail{{Name: "image", Type: "string"}}, stage.With)
+}
+
+// Execute - the commands (or the image's entrypoint without an exec) in the image
+func (containerStage) Execute(ctx context.Context, sc StageContext) (string, error) {
+	sc.Stage.Image = inputString(sc.Stage.With, "image", sc.Stage.Image)
+	sc.Spec.Image = inputString(sc.Stage.With, "image", sc.Spec.Image)
+	return executorFor(sc.Run, sc.Stage, sc.Logger).Execute(ctx, sc.Spec, sc.Out)
+}
+
+// Validate - approvals take no inputs
+func (approvalStage) Validate(stage StageDetail) error {
+	return validateInputs(nil, stage.With)
+}
+
+// FailStatus - a refused (or expired) sign-off
+func (approvalStage) FailStatus() string {
+	return "rejected"
+}
+
+// Execute - waits for the sign-off, an error is a rejection (or expiry)
+func (approvalStage) Execute(ctx context.Context, sc StageContext) (string, error) {
+	_, as := startSpan(ctx, "approval")
+	err := waitForApproval(sc.Run, sc.Stage, sc.Logger)
+	endSpan(as, err)
+	return "", err
+}
+
+// Validate - like a shell stage
+func (callbackStage) Validate(stage StageDetail) error {
+	return shellStage{}.Validate(stage)
+}
+
+// Execute - the commands start an external job, its status comes back through the callback api
+func (callbackStage) Execute(ctx context.Context, sc StageContext) (string, error) {
+	res, err := shellStage{}.Execute(ctx, sc)
+	if err != nil {
+		return res, err
+	}
+	_, cs := startSpan(ctx, "callback")
+	err = waitForCallback(sc.Run, sc.Stage, sc.Logger)
+	endSpan(cs, err)
+	return res, err
+}
+
+var deployInputs = []InputDetail{{Name: "service", Type: "string", Required: true}, {Name: "replicas", Type: "int"}}
+
+// Validate - the service is required, replicas is a positive count
+func (deployStage) Validate(stage StageDetail) error {
+	if stage.Exec == "" {
+		return errors.New("exec is required")
+	}
+	if err := validateInputs(deployInputs, stage.With); err != nil {
+		return err
+	}
+	if inputInt(stage.With, "replicas", 1) < 1 {
+		return errors.New("input replicas must be at least 1")
+	}
+	return nil
+}
+
+// Execute - the commands get the service and replicas as CICD_DEPLOY_SERVICE and CICD_DEPLOY_REPLICAS
+func (deployStage) Execute(ctx context.Context, sc StageContext) (string, error) {
+	service, replicas := inputString(sc.Stage.With, "service", ""), inputInt(sc.Stage.With, "replicas", 1)
+	sc.Logger.Info("Deploy", "service", service, "replicas", replicas)
+	sc.Spec.Env = append(sc.Spec.Env, "CICD_DEPLOY_SERVICE="+service, "CICD_DEPLOY_REPLICAS="+strconv.Itoa(replicas))
+	return shellStage{}.Execute(ctx, sc)
+}
+
+var httpInputs = []InputDetail{{Name: "url", Type: "string", Required: true}, {Name: "method", Type: "string"},
+	{Name: "headers", Type: "map"}, {Name: "body", Type: "string"}, {Name: "expect", Type: "int"}, {Name: "timeout", Type: "int"}}
+
+// Validate - a url, and string header values
+func (httpStage) Validate(stage StageDetail) error {
+	if err := validateInputs(httpInputs, stage.With); err != nil {
+		return err
+	}
+	headers, _ := stage.With["headers"].(map[string]interface{})
+	for k, v := range headers {
+		if _, ok := v.(string); !ok {
+			return fmt.Errorf("header %s must be a string", k)
+		}
+	}
+	return nil
+}
+
+// Execute - sends the request (GET without a body, POST with one), the response body goes to the stage log and
+// the status code to the status output, any status but expect (default 2xx) fails the stage
+func (httpStage) Execute(ctx context.Context, sc StageContext) (string, error) {
+	with := sc.Stage.With
+	body := inputString(with, "body", "")
+	method := "GET"
+	if body != "" {
+		method = "POST"
+	}
+	method = strings.ToUpper(inputString(with, "method", method))
+	req, err := http.NewRequestWithContext(ctx, method, inputString(with, "url", ""), strings.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	headers, _ := with["headers"].(map[string]interface{})
+	for k, v := range headers {
+		req.Header.Set(k, v.(string))
+	}
+	client := &http.Client{Timeout: time.Duration(inputInt(with, "timeout", 30)) * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var b bytes.Buffer
+	io.Copy(io.MultiWriter(&b, sc.Out), io.LimitReader(resp.Body, 1<<20))
+	ioutil.WriteFile(sc.Spec.Output, []byte("status="+strconv.Itoa(resp.StatusCode)+"\n"), 0600)
+	expect := inputInt(with, "expect", 0)
+	if (expect == 0 && resp.StatusCode/100 != 2) || (expect != 0 && resp.StatusCode != expect) {
+		return b.String(), fmt.Errorf("%s %s : %s", method, req.URL.Redacted(), resp.Status)
+	}
+	return b.String(), nil
+}
+
+// Validate - asks the plugin, its error message (or stderr) is the validation error. Plugins run on the server
+// as they are, the fields of the executors are refused rather than ignored
+func (p *pluginStage) Validate(stage StageDetail) error {
+	switch {
+	case stage.Limits != nil:
+		return errors.New("limits are not supported by plugin stages")
+	case stage.Sandbox:
+		return errors.New("sandbox is not supported by plugin stages")
+	case len(stage.RunsOn) > 0:
+		return errors.New("runsOn is not supported by plugin stages")
+	case stage.Image != "":
+		return errors.New("image is not supported by plugin stages")
+	}
+	var stderr bytes.Buffer
+	var result *PluginMessage
+	err := p.call(context.Background(), PluginRequest{Method: "validate", Type: p.name, Stage: stage, With: stage.With}, "", nil, &stderr, func(msg PluginMessage) {
+		if msg.Done {
+			result = &msg
+		}
+	})
+	switch {
+	case result != nil && result.Error != "":
+		return errors.New(result.Error)
+	case result == nil && stderr.Len() > 0:
+		return errors.New(strings.TrimSpace(stderr.String()))
+	case result == nil:
+		return fmt.Errorf("plugin %s : no result (%v)", p.name, err)
+	case err != nil:
+		return fmt.Errorf("plugin %s : %v", p.name, err)
+	}
+	return nil
+}
+
+// Execute - runs the plugin in the workspace with the stage's env, its log lines (and stderr) go to the stage
+// log and its outputs to the output file
+func (p *pluginStage) Execute(ctx context.Context, sc StageContext) (string, error) {
+	var out bytes.Buffer
+	var result *PluginMessage
+	outputs := map[string]string{}
+	req := PluginRequest{Method: "run", Type: p.name, Stage: sc.Stage, With: sc.Stage.With, Run: sc.Run.Id, Dir: sc.Spec.Dir}
+	// stderr and the log lines are written from different goroutines
+	sc.Out = &syncWriter{w: sc.Out}
+	err := p.call(ctx, req, sc.Spec.Dir, sc.Spec.Env, sc.Out, func(msg PluginMessage) {
+		if msg.Log != "" {
+			out.WriteString(msg.Log)
+			io.WriteString(sc.Out, msg.Log)
+		}
+		for k, v := range msg.Outputs {
+			outputs[k] = v
+		}
+		if msg.Done {
+			result = &msg
+		}
+	})
+	if len(outputs) > 0 && sc.Spec.Output != "" {
+		var b strings.Builder
+		for k, v := range outputs {
+			b.WriteString(k + "=" + v + "\n")
+		}
+		ioutil.WriteFile(sc.Spec.Output, []byte(b.String()), 0600)
+	}
+	switch {
+	case result == nil:
+		return out.String(), fmt.Errorf("plugin %s : no result (%v)", p.name, err)
+	case result.Error != "":
+		return out.String(), errors.New(result.Error)
+	case err != nil:
+		// done but crashed or exited non zero afterwards
+		return out.String(), fmt.Errorf("plugin %s : %v", p.name, err)
+	}
+	return out.String(), nil
+}
+
+// call - starts the plugin, writes the request and passes each json line of its stdout to fn
+func (p *pluginStage) call(ctx context.Context, req PluginRequest, dir string, env []string, stderr io.Writer, fn func(PluginMessage)) error {
+	b, _ := json.Marshal(req)
+	cmd := exec.CommandContext(ctx, p.path)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdin = bytes.NewReader(append(b, '\n'))
+	cmd.Stderr = stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		var msg PluginMessage
+		if json.Unmarshal(scanner.Bytes(), &msg) != nil {
+			// not a message, kept as a log line
+			msg = PluginMessage{Log: scanner.Text() + "\n"}
+		}
+		fn(msg)
+	}
+	return cmd.Wait()
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// the plugin echoes its request as a log line, reports an output and fails validation without a greeting
+const pluginScript = `#!/bin/sh
+read request
+case "$request" in
+  *'"method":"validate"'*'"greeting"'*) echo '{"done":true}' ;;
+  *'"method":"validate"'*) echo '{"done":true,"error":"input greeting is required"}' ;;
+  *) echo "$request" >&2
+     printf '%s\n' '{"log":"hello from the plugin\n"}'
+     echo "not json"
+     echo '{"outputs":{"dir":"'$(pwd)'"}}'
+     echo '{"done":true}' ;;
+esac
+`
+
+// the plugin reports done and then exits 1 when it runs
+const crashScript = `#!/bin/sh
+read request
+echo '{"done":true}'
+case "$request" in
+  *'"method":"run"'*) exit 1 ;;
+esac
+`
+
+func TestStageTypes(t *testing.T) {
+	tmp, _ := ioutil.TempDir("", "stages")
+	defer os.RemoveAll(tmp)
+	os.Setenv("STAGE_PLUGINS", tmp)
+	defer os.Unsetenv("STAGE_PLUGINS")
+	ioutil.WriteFile(filepath.Join(tmp, "cicd-stage-greet"), []byte(pluginScript), 0755)
+	ioutil.WriteFile(filepath.Join(tmp, "cicd-stage-crash"), []byte(crashScript), 0755)
+	logger := NewLogger("error", "text", os.Stdout)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Token") != "t0ken" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s", r.Method, b)
+	}))
+	defer srv.Close()
+
+	with := func(str string) map[string]interface{} {
+		var m map[string]interface{}
+		json.Unmarshal([]byte(str), &m)
+		return m
+	}
+
+	// create anonymous struct
+	tests := []struct {
+		Name     string
+		Stage    StageDetail
+		Invalid  string
+		Want     string
+		Outputs  string
+		Fails    bool
+		ErrorMsg string
+	}{
+		{"Test stage type : shell", StageDetail{Exec: "/bin/sh", Commands: []string{"-c", "echo shell"}}, "", "shell\n", "", false, "Stage type %s - got (%v) wanted (%v)"},
+		{"Test stage type : shell without exec", StageDetail{}, "exec is required", "", "", false, "Stage type %s - got (%v) wanted (%v)"},
+		{"Test stage type : unknown", StageDetail{Type: "nope"}, "unknown stage type nope", "", "", false, "Stage type %s - got (%v) wanted (%v)"},
+		{"Test stage type : invalid name", StageDetail{Type: "../greet"}, "invalid stage type ../greet", "", "", false, "Stage type %s - got (%v) wanted (%v)"},
+		{"Test stage type : deploy", StageDetail{Type: "deploy", Exec: "/bin/sh", Commands: []string{"-c", "echo $CICD_DEPLOY_SERVICE $CICD_DEPLOY_REPLICAS"}, With: with(`{"service": "api", "replicas": 3}`)},
+			"", "api 3\n", "", false, "Stage type %s - got (%v) wanted (%v)"},
+		{"Test stage type : deploy without service", StageDetail{Type: "deploy", Exec: "make", With: with(`{"replicas": 3}`)}, "input service is required", "", "", false, "Stage type %s - got (%v) wanted (%v)"},
+		{"Test stage type : deploy replicas type", StageDetail{Type: "deploy", Exec: "make", With: with(`{"service": "api", "replicas": "3"}`)}, "input replicas must be of type int", "", "", false, "Stage type %s - got (%v) wanted (%v)"},
+		{"Test stage type : deploy unknown input", StageDetail{Type: "deploy", Exec: "make", With: with(`{"service": "api", "zone": "eu"}`)}, "unknown input zone", "", "", false, "Stage type %s - got (%v) wanted (%v)"},
+		{"Test stage type : deploy fields", StageDetail{Exec: "make", Service: "api", Replicas: 3}, `service and replicas are no longer stage fields, use "type": "deploy" with them in "with"`, "", "", false, "Stage type %s - got (%v) wanted (%v)"},
+		{"Test stage type : container without image", StageDetail{Type: "container", Exec: "make"}, "image is required", "", "", false, "Stage type %s - got (%v) wanted (%v)"},
+		{"Test stage type : http", StageDetail{Type: "http", With: with(`{"url": "` + srv.URL + `", "body": "ping", "headers": {"X-Token": "t0ken"}}`)}, "", "POST ping", "status=200", false, "Stage type %s - got (%v) wanted (%v)"},
+		{"Test stage type : http status", StageDetail{Type: "http", With: with(`{"url": "` + srv.URL + `", "method": "put"}`)}, "", "PUT ", "status=401", true, "Stage type %s - got (%v) wanted (%v)"},
+		{"Test stage type : http expect", StageDetail{Type: "http", With: with(`{"url": "` + srv.URL + `", "expect": 401}`)}, "", "GET ", "status=401", false, "Stage type %s - got (%v) wanted (%v)"},
+		{"Test stage type : http header type", StageDetail{Type: "http", With: with(`{"url": "` + srv.URL + `", "headers": {"X-Count": 1}}`)}, "header X-Count must be a string", "", "", false, "Stage type %s - got (%v) wanted (%v)"},
+		{"Test stage type : plugin validation", StageDetail{Type: "greet"}, "input greeting is required", "", "", false, "Stage type %s - got (%v) wanted (%v)"},
+		{"Test stage type : plugin with runsOn", StageDetail{Type: "greet", RunsOn: map[string]string{"os": "linux"}, With: with(`{"greeting": "hello"}`)}, "runsOn is not supported by plugin stages", "", "", false, "Stage type %s - got (%v) wanted (%v)"},
+		{"Test stage type : plugin", StageDetail{Type: "greet", With: with(`{"greeting": "hello"}`)}, "", "hello from the plugin\nnot json\n", "dir=" + tmp, false, "Stage type %s - got (%v) wanted (%v)"},
+		{"Test stage type : plugin exit status", StageDetail{Type: "crash"}, "", "", "", true, "Stage type %s - got (%v) wanted (%v)"},
+	}
+
+	for _, tt := range tests {
+		fmt.Println(fmt.Sprintf("\nExecuting test : %s", tt.Name))
+		tt.Stage.Name = "Test"
+		err := validateStages([]StageDetail{tt.Stage})
+		if tt.Invalid != "" {
+			if err == nil || err.Error() != "stage Test : "+tt.Invalid {
+				t.Errorf(tt.ErrorMsg, tt.Name, err, tt.Invalid)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf(tt.ErrorMsg, tt.Name, err, nil)
+		}
+		outputFile := filepath.Join(tmp, "output")
+		ioutil.WriteFile(outputFile, nil, 0600)
+		st, _ := stageExecutor(tt.Stage.Type)
+		var log strings.Builder
+		spec := ExecSpec{Dir: tmp, Exec: tt.Stage.Exec, Commands: tt.Stage.Commands, Output: outputFile}
+		res, err := st.Execute(context.Background(), StageContext{Run: &Run{Id: "stages-test"}, Stage: tt.Stage, Spec: spec, Out: &log, Logger: logger})
+		if res != tt.Want || (err != nil) != tt.Fails {
+			t.Errorf(tt.ErrorMsg, tt.Name, fmt.Sprintf("%q %v", res, err), tt.Want)
+		}
+		if b, _ := ioutil.ReadFile(outputFile); strings.TrimSpace(string(b)) != tt.Outputs {
+			t.Errorf(tt.ErrorMsg, tt.Name, string(b), tt.Outputs)
+		}
+		if tt.Stage.Type == "greet" && !strings.Contains(log.String(), `"method":"run"`) {
+			t.Errorf(tt.ErrorMsg, tt.Name, log.String(), "the request on stderr in the stage log")
+		}
+		fmt.Println("")
+	}
+
+	// approvals are gates, a failure is a rejection
+	if gate, ok := stageTypes["approval"].(GateStage); !ok || gate.FailStatus() != "rejected" {
+		t.Errorf("Stage type approval - got (%v) wanted (%v)", ok, "a gate failing as rejected")
+	}
+
+	// inputs are interpolated before the stage type sees them
+	got := interpolateWith(with(`{"url": "https://${{ commit }}", "headers": {"X-Run": "${{ run }}"}, "expect": 200}`), map[string]string{"commit": "abc", "run": "1"})
+	if b, _ := json.Marshal(got); string(b) != `{"expect":200,"headers":{"X-Run":"1"},"url":"https://abc"}` {
+		t.Errorf("Stage type inputs - got (%s) wanted (interpolated)", b)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// StatusReporter - posts commit statuses back to the scm
+// state is one of pending, success, failure
+type StatusReporter interface {
+	Report(sha string, state string, context string, description string, targetUrl string) error
+}
+
+// GithubReporter - https://docs.github.com/rest/commits/statuses
+type GithubReporter struct {
+	Url    string
+	Repo   string
+	Token  string
+	Client *http.Client
+}
+
+// GitlabReporter - https://docs.gitlab.com/ee/api/commits.html#set-the-pipeline-status-of-a-commit
+type GitlabReporter struct {
+	Url    string
+	Repo   string
+	Token  string
+	Client *http.Client
+}
+
+// GiteaReporter - POST /repos/{owner}/{repo}/statuses/{sha}
+type GiteaReporter struct {
+	Url    string
+	Repo   string
+	Token  string
+	Client *http.Client
+}
+
+type commitStatus struct {
+	State       string `json:"state"`
+	TargetUrl   string `json:"target_url,omitempty"`
+	Description string `json:"description,omitempty"`
+	Context     string `json:"context"`
+}
+
+func (r *GithubReporter) Report(sha string, state string, context string, description string, targetUrl string) error {
+	body, _ := json.Marshal(commitStatus{State: state, TargetUrl: targetUrl, Description: description, Context: context})
+	req, _ := http.NewRequest("POST", strings.TrimSuffix(r.Url, "/")+"/repos/"+r.Repo+"/statuses/"+sha, bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+r.Token)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set(CONTENTTYPE, APPLICATIONJSON)
+	return doStatus(r.Client, req)
+}
+
+func (r *GitlabReporter) Report(sha string, state string, context string, description string, targetUrl string) error {
+	// gitlab has its own state names
+	states := map[string]string{"pending": "running", "success": "success", "failure": "failed"}
+	q := url.Values{}
+	q.Set("state", states[state])
+	q.Set("name", context)
+	q.Set("description", description)
+	if targetUrl != "" {
+		q.Set("target_url", targetUrl)
+	}
+	req, _ := http.NewRequest("POST", strings.TrimSuffix(r.Url, "/")+"/api/v4/projects/"+url.PathEscape(r.Repo)+"/statuses/"+sha+"?"+q.Encode(), nil)
+	req.Header.Set("PRIVATE-TOKEN", r.Token)
+	return doStatus(r.Client, req)
+}
+
+func (r *GiteaReporter) Report(sha string, state string, context string, description string, targetUrl string) error {
+	body, _ := json.Marshal(commitStatus{State: state, TargetUrl: targetUrl, Description: description, Context: context})
+	req, _ := http.NewRequest("POST", strings.TrimSuffix(r.Url, "/")+"/api/v1/repos/"+r.Repo+"/statuses/"+sha, bytes.NewReader(body))
+	req.Header.Set("Authorization", "token "+r.Token)
+	req.Header.Set(CONTENTTYPE, APPLICATIONJSON)
+	return doStatus(r.Client, req)
+}
+
+func doStatus(client *http.Client, req *http.Request) error {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("status api %s returned %d %s", req.URL.Path, resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// newStatusReporter - the reporter configured for the repository (nil when not configured)
+// the api token is a credential (type token or https) from the secret store
+func newStatusReporter(repo Repository) (StatusReporter, error) {
+	if repo.Status == nil {
+		return nil, nil
+	}
+	token := ""
+	if repo.Status.Credentials != "" {
+		cred, err := secretStore.Get(repo.Status.Credentials)
+		if err != nil {
+			return nil, err
+		}
+		token = cred.Token
+	}
+	switch repo.Status.Provider {
+	case "github":
+		u := repo.Status.Url
+		if u == "" {
+			u = "https://api.github.com"
+		}
+		return &GithubReporter{Url: u, Repo: repo.Status.Repo, Token: token}, nil
+	case "gitlab":
+		u := repo.Status.Url
+		if u == "" {
+			u = "https://gitlab.com"
+		}
+		return &GitlabReporter{Url: u, Repo: repo.Status.Repo, Token: token}, nil
+	case "gitea":
+		if repo.Status.Url == "" {
+			return nil, errors.New("gitea status reporter needs a url")
+		}
+		return &GiteaReporter{Url: repo.Status.Url, Repo: repo.Status.Repo, Token: token}, nil
+	}
+	return nil, errors.New("unknown status provider " + repo.Status.Provider)
+}
+
+// runUrl - link to the run (PUBLIC_URL is the externally reachable address of the api)
+func runUrl(run *Run) string {
+	if os.Getenv("PUBLIC_URL") == "" {
+		return ""
+	}
+	return strings.TrimSuffix(os.Getenv("PUBLIC_URL"), "/") + "/api/v1/runs/" + run.Id
+}
+
+// runReporter - the reporter attached to a run with the repository settings
+type runReporter struct {
+	StatusReporter
+	stages  bool
+	context string
+}
+
+// attachReporter - sets up status reporting for the run, errors are only logged
+func attachReporter(run *Run, repo Repository, logger *Logger) {
+	reporter, err := newStatusReporter(repo)
+	if err != nil {
+		logger.Error("Status", "error", err)
+		return
+	}
+	if reporter == nil {
+		return
+	}
+	context := repo.Status.Context
+	if context == "" {
+		context = "cicd"
+	}
+	run.reporter = &runReporter{StatusReporter: reporter, stages: repo.Status.Stages, context: context}
+}
+
+// reportStatus - posts the pipeline (stage == "") or stage status, errors are only logged
+func reportStatus(run *Run, stage string, status string, logger *Logger) {
+	if run.reporter == nil || (stage != "" && !run.reporter.stages) {
+		return
+	}
+	states := map[string]string{
+		"pending":  "pending",
+		"running":  "pending",
+		"waiting":  "pending",
+		"success":  "success",
+		"error":    "failure",
+		"failed":   "failure",
+		"rejected": "failure",
+	}
+	state, ok := states[status]
+	if !ok {
+		return
+	}
+	context := run.reporter.context
+	description := "pipeline " + run.Pipeline + " " + status
+	if stage != "" {
+		context += "/" + strings.ToLower(stage)
+		description = "stage " + stage + " " + status
+	}
+	if err := run.reporter.Report(run.Commit, state, context, description, runUrl(run)); err != nil {
+		logger.Error("Status", "error", err)
+	}
+}
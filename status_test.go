@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStatusReporters(t *testing.T) {
+	var got *http.Request
+	var body commitStatus
+
+	// stand-in for the scm apis, records the last request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		body = commitStatus{}
+		b, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(b, &body)
+		if r.URL.Query().Get("state") != "" {
+			body.State = r.URL.Query().Get("state")
+			body.Context = r.URL.Query().Get("name")
+			body.TargetUrl = r.URL.Query().Get("target_url")
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	// create anonymous struct
+	tests := []struct {
+		Name     string
+		Reporter StatusReporter
+		State    string
+		Path     string
+		Header   string
+		Value    string
+		Want     string
+		ErrorMsg string
+	}{
+		{
+			"Test status : github",
+			&GithubReporter{Url: server.URL, Repo: "lmz/golang-cicd", Token: "gh"},
+			"failure",
+			"/repos/lmz/golang-cicd/statuses/abc123",
+			"Authorization",
+			"Bearer gh",
+			"failure",
+			"Reporter %s returned - got (%v) wanted (%v)",
+		},
+		{
+			"Test status : gitlab",
+			&GitlabReporter{Url: server.URL, Repo: "lmz/golang-cicd", Token: "gl"},
+			"pending",
+			"/api/v4/projects/lmz%2Fgolang-cicd/statuses/abc123",
+			"Private-Token",
+			"gl",
+			"running",
+			"Reporter %s returned - got (%v) wanted (%v)",
+		},
+		{
+			"Test status : gitea",
+			&GiteaReporter{Url: server.URL, Repo: "lmz/golang-cicd", Token: "gt"},
+			"success",
+			"/api/v1/repos/lmz/golang-cicd/statuses/abc123",
+			"Authorization",
+			"token gt",
+			"success",
+			"Reporter %s returned - got (%v) wanted (%v)",
+		},
+	}
+
+	for _, tt := range tests {
+		fmt.Println(fmt.Sprintf("\nExecuting test : %s", tt.Name))
+		err := tt.Reporter.Report("abc123", tt.State, "cicd", "pipeline 1001 "+tt.State, "http://cicd/api/v1/runs/1")
+		if err != nil {
+			t.Errorf(tt.ErrorMsg, tt.Name, err, nil)
+			continue
+		}
+		if got.Method != "POST" || got.URL.EscapedPath() != tt.Path {
+			t.Errorf(tt.ErrorMsg, tt.Name, got.Method+" "+got.URL.EscapedPath(), "POST "+tt.Path)
+		}
+		if got.Header.Get(tt.Header) != tt.Value {
+			t.Errorf(tt.ErrorMsg, tt.Name, got.Header.Get(tt.Header), tt.Value)
+		}
+		if body.State != tt.Want || body.Context != "cicd" || body.TargetUrl != "http://cicd/api/v1/runs/1" {
+			t.Errorf(tt.ErrorMsg, tt.Name, body, tt.Want)
+		}
+	}
+
+	// api errors are surfaced
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer failing.Close()
+	reporter := &GithubReporter{Url: failing.URL, Repo: "lmz/golang-cicd", Token: "bad"}
+	if err := reporter.Report("abc123", "success", "cicd", "", ""); err == nil {
+		t.Errorf("Reporter %s returned - got (%v) wanted (%v)", "Test status : unauthorized", nil, "error")
+	}
+}
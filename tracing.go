@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.41.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/luigizuccarelli/golang-cicd")
+
+// initTracing - OTEL_EXPORTER_OTLP_ENDPOINT exports the spans via otlp/http,
+// TRACE_FILE writes them as json lines to a local file (offline use), without either tracing is a no-op
+// the returned func flushes and stops the exporter
+func initTracing(logger *Logger) func() {
+	var exporter sdktrace.SpanExporter
+	var err error
+
+	switch {
+	case os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != "":
+		// endpoint, headers etc are read from the standard OTEL_EXPORTER_OTLP_* envars
+		exporter, err = otlptracehttp.New(context.Background())
+	case os.Getenv("TRACE_FILE") != "":
+		var file *os.File
+		file, err = os.OpenFile(os.Getenv("TRACE_FILE"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err == nil {
+			exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+		}
+	default:
+		return func() {}
+	}
+	if err != nil {
+		logger.Error("Tracing", "error", err)
+		return func() {}
+	}
+
+	name := os.Getenv("NAME")
+	if name == "" {
+		name = "golang-cicd"
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(name), semconv.ServiceVersion(os.Getenv("VERSION")))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	logger.Info("Tracing : enabled")
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			logger.Error("Tracing", "error", err)
+		}
+	}
+}
+
+// startSpan - child span of the span in ctx
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan - ends the span, recording the error (if any)
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// sleep - the waits between stages are spans too, so that they show up next to the stages
+func sleep(ctx context.Context, d time.Duration, reason string) {
+	if d <= 0 {
+		return
+	}
+	_, span := startSpan(ctx, "sleep", attribute.String("cicd.sleep.reason", reason), attribute.Float64("cicd.sleep.seconds", d.Seconds()))
+	time.Sleep(d)
+	span.End()
+}
+
+// traceparent - the w3c trace context of ctx for the stage env (TRACEPARENT)
+func traceparent(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+	return carrier.Get("traceparent")
+}
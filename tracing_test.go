@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTracingFileExporter(t *testing.T) {
+	tmp, _ := ioutil.TempDir("", "trace")
+	defer os.RemoveAll(tmp)
+	os.Setenv("TRACE_FILE", filepath.Join(tmp, "traces.json"))
+	defer os.Unsetenv("TRACE_FILE")
+
+	shutdown := initTracing(NewLogger("error", "text", ioutil.Discard))
+	ctx, span := startSpan(context.Background(), "run")
+	sleep(ctx, time.Millisecond, "wait")
+	// 00-<trace id>-<span id>-01
+	tp := traceparent(ctx)
+	if parts := strings.Split(tp, "-"); len(parts) != 4 || parts[1] != span.SpanContext().TraceID().String() {
+		t.Errorf("Traceparent - got (%v) wanted (%v)", tp, span.SpanContext().TraceID())
+	}
+	span.End()
+	shutdown()
+
+	b, _ := ioutil.ReadFile(filepath.Join(tmp, "traces.json"))
+	for _, name := range []string{`"Name":"run"`, `"Name":"sleep"`, `"cicd.sleep.reason"`} {
+		if !strings.Contains(string(b), name) {
+			t.Errorf("Trace file - got (%s) wanted (%v)", string(b), name)
+		}
+	}
+}
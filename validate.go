@@ -6,20 +6,18 @@ import (
 	"os"
 	"strconv"
 	"strings"
-
-	"github.com/microlib/simple"
 )
 
 // checkEnvars - private function, iterates through each item and checks the required field
-func checkEnvar(item string, logger *simple.Logger) error {
+func checkEnvar(item string, logger *Logger) error {
 	name := strings.Split(item, ",")[0]
 	required, _ := strconv.ParseBool(strings.Split(item, ",")[1])
 	if os.Getenv(name) == "" {
 		if required {
-			logger.Error(fmt.Sprintf("%s envar is mandatory please set it", name))
+			logger.Error("envar is mandatory please set it", "envar", name)
 			return errors.New(fmt.Sprintf("%s envar is mandatory please set it", name))
 		} else {
-			logger.Error(fmt.Sprintf("%s envar is empty please set it", name))
+			logger.Error("envar is empty please set it", "envar", name)
 		}
 	}
 	return nil
@@ -28,7 +26,7 @@ func checkEnvar(item string, logger *simple.Logger) error {
 // ValidateEnvars : public call that groups all envar validations
 // These envars are set via the openshift template
 // Each microservice will obviously have a diffefrent envars so change where needed
-func ValidateEnvars(logger *simple.Logger) error {
+func ValidateEnvars(logger *Logger) error {
 	items := []string{
 		"LOG_LEVEL,false",
 	}
@@ -2,85 +2,54 @@ package main
 
 import (
 	"fmt"
-	"github.com/microlib/simple"
 	"os"
 	"testing"
 )
 
-var (
-	logger simple.Logger
-)
-
 func TestEnvars(t *testing.T) {
+	logger := NewLogger("trace", "text", os.Stdout)
 
 	// create anonymous struct
 	tests := []struct {
 		Name     string
-		Payload  string
-		Handler  string
-		FileName string
+		Item     string
+		Value    string
 		Want     bool
 		ErrorMsg string
 	}{
 		{
 			"Test envars : should fail",
-			"",
-			"TestEnvarsFail",
+			"SERVER_PORT,true",
 			"",
 			true,
-			"Handler %s returned - got (%v) wanted (%v)",
+			"Envar %s returned - got (%v) wanted (%v)",
 		},
 		{
 			"Test envars : should pass",
-			"",
-			"TestEnvarsPass",
+			"SERVER_PORT,true",
+			"9000",
+			false,
+			"Envar %s returned - got (%v) wanted (%v)",
+		},
+		{
+			"Test envars : optional",
+			"SERVER_PORT,false",
 			"",
 			false,
-			"Handler %s returned - got (%v) wanted (%v)",
+			"Envar %s returned - got (%v) wanted (%v)",
 		},
 	}
-	var err error
-	logger.Level = "trace"
 	for _, tt := range tests {
 		fmt.Println(fmt.Sprintf("\nExecuting test : %s", tt.Name))
-		switch tt.Handler {
-		case "TestEnvarsFail":
-			err = nil
-			os.Setenv("SERVER_PORT", "")
-			err = ValidateEnvars()
-		case "TestEnvarsPass":
-			err = nil
-			os.Setenv("SERVER_PORT", "9000")
-			os.Setenv("REDIS_HOST", "127.0.0.1")
-			os.Setenv("REDIS_PORT", "6379")
-			os.Setenv("REDIS_PASSWORD", "6379")
-			os.Setenv("MONGODB_HOST", "localhost")
-			os.Setenv("MONGODB_PORT", "27017")
-			os.Setenv("MONGODB_DATABASE", "test")
-			os.Setenv("MONGODB_USER", "mp")
-			os.Setenv("MONGODB_PASSWORD", "mp")
-			os.Setenv("URL", "http://test.com")
-			os.Setenv("TOKEN", "dsafsdfdsf")
-			os.Setenv("VERSION", "1.0.3")
-			os.Setenv("BROKERS", "localhost:9092")
-			os.Setenv("TOPIC", "test")
-			os.Setenv("CONNECTOR", "NA")
-			os.Setenv("PROVIDER_NAME", "NA")
-			os.Setenv("PROVIDER_URL", "http://test.com")
-			os.Setenv("PROVIDER_TOKEN", "dsfgsdfsdf")
-			os.Setenv("ANALYTICS_URL", "http://test.com")
-			err = ValidateEnvars()
-		}
-
-		if !tt.Want {
-			if err != nil {
-				t.Errorf(fmt.Sprintf(tt.ErrorMsg, tt.Handler, err, nil))
-			}
-		} else {
-			if err == nil {
-				t.Errorf(fmt.Sprintf(tt.ErrorMsg, tt.Handler, "nil", "error"))
-			}
+		os.Setenv("SERVER_PORT", tt.Value)
+		err := checkEnvar(tt.Item, logger)
+		if (err != nil) != tt.Want {
+			t.Errorf(tt.ErrorMsg, tt.Item, err, tt.Want)
 		}
 		fmt.Println("")
 	}
+	os.Unsetenv("SERVER_PORT")
+	if err := ValidateEnvars(logger); err != nil {
+		t.Errorf("Envars - got (%v) wanted (nil)", err)
+	}
 }
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const (
+	BUILTREF string = "refs/cicd/built"
+)
+
+var (
+	// the workspaces of the runs in progress, never garbage collected
+	activeWorkspaces = struct {
+		sync.Mutex
+		dirs map[string]bool
+	}{dirs: map[string]bool{}}
+)
+
+// workspaceDir - root for the per run worktrees (WORKSPACE_DIR, default workspaces)
+func workspaceDir() string {
+	if os.Getenv("WORKSPACE_DIR") != "" {
+		return os.Getenv("WORKSPACE_DIR")
+	}
+	return "workspaces"
+}
+
+// runWorkspace - the run scoped directory, <root>/<repo path>/<run id>
+func runWorkspace(repo Repository, runId string) (string, error) {
+	return filepath.Abs(filepath.Join(workspaceDir(), repo.Path, runId))
+}
+
+// createWorktree - checks out the exact commit in a fresh checkout outside of the clone
+func createWorktree(scm SourceProvider, repoDir string, dir string, sha string) error {
+	os.MkdirAll(filepath.Dir(dir), os.ModePerm)
+	return scm.Checkout(repoDir, dir, sha)
+}
+
+// useWorkspace - keeps gcWorktrees away from the workspace while the run builds in it, returns the release
+func useWorkspace(dir string) func() {
+	activeWorkspaces.Lock()
+	activeWorkspaces.dirs[dir] = true
+	activeWorkspaces.Unlock()
+	return func() {
+		activeWorkspaces.Lock()
+		delete(activeWorkspaces.dirs, dir)
+		activeWorkspaces.Unlock()
+	}
+}
+
+// lastBuilt - the commit of the last run, falls back to HEAD for clones built before worktrees were used
+func lastBuilt(scm SourceProvider, repoDir string) (string, error) {
+	sha, err := scm.ResolveRef(repoDir, BUILTREF)
+	if err != nil {
+		return scm.ResolveRef(repoDir, "HEAD")
+	}
+	return sha, nil
+}
+
+// gcWorktrees - removes all but the newest WORKSPACE_KEEP (default 5) worktrees of the repository, the ones
+// still in use by a run are kept
+func gcWorktrees(scm SourceProvider, repoDir string, repo Repository, logger *Logger) {
+	keep := 5
+	if os.Getenv("WORKSPACE_KEEP") != "" {
+		n, err := strconv.Atoi(os.Getenv("WORKSPACE_KEEP"))
+		if err != nil || n < 0 {
+			logger.Error("Worktree : invalid WORKSPACE_KEEP, keeping 5", "value", os.Getenv("WORKSPACE_KEEP"), "error", err)
+		} else {
+			keep = n
+		}
+	}
+	root := filepath.Join(workspaceDir(), repo.Path)
+	dirs, err := ioutil.ReadDir(root)
+	if err != nil {
+		return
+	}
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i].ModTime().After(dirs[j].ModTime()) })
+	for x, d := range dirs {
+		if x < keep || !d.IsDir() {
+			continue
+		}
+		dir, _ := filepath.Abs(filepath.Join(root, d.Name()))
+		activeWorkspaces.Lock()
+		active := activeWorkspaces.dirs[dir]
+		activeWorkspaces.Unlock()
+		if active {
+			continue
+		}
+		if err := scm.RemoveCheckout(repoDir, dir); err != nil {
+			logger.Warn("Worktree", "error", err)
+			os.RemoveAll(dir)
+		}
+		logger.Debug("Worktree : removed", "path", dir)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+)
+
+func TestWorktrees(t *testing.T) {
+	tmp, _ := ioutil.TempDir("", "worktree")
+	defer os.RemoveAll(tmp)
+	os.Setenv("WORKSPACE_DIR", filepath.Join(tmp, "workspaces"))
+	defer os.Unsetenv("WORKSPACE_DIR")
+	logger := NewLogger("error", "text", os.Stdout)
+
+	upstreamDir := filepath.Join(tmp, "upstream")
+	cloneDir := filepath.Join(tmp, "clone")
+	upstream, _ := git.PlainInit(upstreamDir, false)
+	first := commitFile(t, upstream, upstreamDir, "a.txt", "first")
+	second := commitFile(t, upstream, upstreamDir, "a.txt", "second")
+	scm := &GitSourceProvider{}
+	if err := scm.Clone(upstreamDir, cloneDir); err != nil {
+		t.Fatalf("clone %v", err)
+	}
+	repo := Repository{Id: "1", Path: "repo"}
+
+	// clones built before worktrees fall back to HEAD
+	if sha, err := lastBuilt(scm, cloneDir); sha != second {
+		t.Errorf("Worktree last built - got (%v %v) wanted (%v)", sha, err, second)
+	}
+	scm.UpdateRef(cloneDir, BUILTREF, first)
+	if sha, err := lastBuilt(scm, cloneDir); sha != first {
+		t.Errorf("Worktree last built - got (%v %v) wanted (%v)", sha, err, first)
+	}
+
+	// every run checks out its own commit, the clone is left alone
+	for x, sha := range []string{first, second, first, second} {
+		dir, _ := runWorkspace(repo, fmt.Sprint(x))
+		if err := createWorktree(scm, cloneDir, dir, sha); err != nil {
+			t.Fatalf("Worktree create %d - got (%v) wanted (nil)", x, err)
+		}
+		want := map[string]string{first: "first", second: "second"}[sha]
+		if b, _ := ioutil.ReadFile(filepath.Join(dir, "a.txt")); string(b) != want {
+			t.Errorf("Worktree create %d - got (%q) wanted (%q)", x, b, want)
+		}
+		when := time.Now().Add(time.Duration(x-10) * time.Minute)
+		os.Chtimes(dir, when, when)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(cloneDir, "a.txt")); string(b) != "second" {
+		t.Errorf("Worktree clone - got (%q) wanted (second)", b)
+	}
+
+	// linked worktrees, the objects stay in the clone and git sees them
+	dir, _ := runWorkspace(repo, "0")
+	if info, err := os.Stat(filepath.Join(dir, ".git")); err != nil || info.IsDir() {
+		t.Errorf("Worktree link - got (%v %v) wanted (a .git file)", info, err)
+	}
+	if out, err := exec.Command("git", "-C", cloneDir, "worktree", "list", "--porcelain").Output(); err != nil || strings.Count(string(out), "worktree ") != 5 || !strings.Contains(string(out), "worktree "+dir+"\n") {
+		t.Errorf("Worktree link - got (%s %v) wanted (%v)", out, err, "the clone and 4 worktrees")
+	}
+
+	// a worktree in use by a run is never collected
+	release := useWorkspace(dir)
+
+	// create anonymous struct
+	tests := []struct {
+		Name     string
+		Keep     string
+		Want     []string
+		ErrorMsg string
+	}{
+		{"Test worktree gc : invalid keep", "two", []string{"0", "1", "2", "3"}, "Worktree %s - got (%v) wanted (%v)"},
+		{"Test worktree gc : keep", "2", []string{"0", "2", "3"}, "Worktree %s - got (%v) wanted (%v)"},
+		{"Test worktree gc : keep none", "0", []string{"0"}, "Worktree %s - got (%v) wanted (%v)"},
+	}
+
+	for _, tt := range tests {
+		fmt.Println(fmt.Sprintf("\nExecuting test : %s", tt.Name))
+		os.Setenv("WORKSPACE_KEEP", tt.Keep)
+		gcWorktrees(scm, cloneDir, repo, logger)
+		got := []string{}
+		dirs, _ := ioutil.ReadDir(filepath.Join(tmp, "workspaces", "repo"))
+		for _, d := range dirs {
+			got = append(got, d.Name())
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.Want) {
+			t.Errorf(tt.ErrorMsg, tt.Name, got, tt.Want)
+		}
+		if links, _ := ioutil.ReadDir(filepath.Join(cloneDir, ".git", "worktrees")); len(links) != len(tt.Want) {
+			t.Errorf(tt.ErrorMsg, tt.Name, len(links), len(tt.Want))
+		}
+		fmt.Println("")
+	}
+	release()
+	gcWorktrees(scm, cloneDir, repo, logger)
+	if dirs, _ := ioutil.ReadDir(filepath.Join(tmp, "workspaces", "repo")); len(dirs) != 0 {
+		t.Errorf("Worktree gc released - got (%v) wanted (none)", len(dirs))
+	}
+	os.Unsetenv("WORKSPACE_KEEP")
+}